@@ -1,6 +1,7 @@
 package venom
 
 import (
+	"context"
 	"reflect"
 	"testing"
 )
@@ -22,3 +23,40 @@ func Test_splitAssertion(t *testing.T) {
 		}
 	}
 }
+
+func Test_parseAssertions_timeSeconds(t *testing.T) {
+	// Result mirrors the result of the imap executor, its timeseconds is a float64
+	type Result struct {
+		Err         string
+		TimeSeconds float64
+	}
+	for _, tt := range []struct {
+		timeSeconds float64
+		assertion   string
+		wantErr     bool
+	}{
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeLessThan 5"},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeLessThan 0.5"},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeLessThan 0.01", wantErr: true},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeGreaterThan 0"},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeGreaterThan 0.0"},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeGreaterThan 1", wantErr: true},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeLessThanOrEqualTo 0.0123"},
+		{timeSeconds: 0.0123, assertion: "result.timeseconds ShouldBeBetween 0 1"},
+		{timeSeconds: 0, assertion: "result.timeseconds ShouldBeLessThan 0.5"},
+		{timeSeconds: 0, assertion: "result.timeseconds ShouldBeGreaterThan 0.0", wantErr: true},
+		{timeSeconds: 0, assertion: "result.timeseconds ShouldBeGreaterThanOrEqualTo 0.0"},
+		{timeSeconds: 0, assertion: "result.timeseconds ShouldEqual 0"},
+		{timeSeconds: 12, assertion: "result.timeseconds ShouldBeGreaterThan 5"},
+		{timeSeconds: 12, assertion: "result.timeseconds MustBeLessThan 5", wantErr: true},
+	} {
+		a, err := parseAssertions(context.Background(), tt.assertion, Result{TimeSeconds: tt.timeSeconds})
+		if err != nil {
+			t.Errorf("%s with %v: unexpected parse error: %v", tt.assertion, tt.timeSeconds, err)
+			continue
+		}
+		if err := a.Func(a.Actual, a.Args...); (err != nil) != tt.wantErr {
+			t.Errorf("%s with %v: error = %v, wantErr %v", tt.assertion, tt.timeSeconds, err, tt.wantErr)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package assertions
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 
@@ -16,50 +19,56 @@ type AssertFunc func(actual interface{}, expected ...interface{}) error
 
 // assertMap contains list of assertions func
 var assertMap = map[string]AssertFunc{
-	"ShouldEqual":                  ShouldEqual,
-	"ShouldNotEqual":               ShouldNotEqual,
-	"ShouldAlmostEqual":            ShouldAlmostEqual,
-	"ShouldNotAlmostEqual":         ShouldNotAlmostEqual,
-	"ShouldNotExist":               ShouldNotExist,
-	"ShouldBeNil":                  ShouldBeNil,
-	"ShouldNotBeNil":               ShouldNotBeNil,
-	"ShouldBeTrue":                 ShouldBeTrue,
-	"ShouldBeFalse":                ShouldBeFalse,
-	"ShouldBeZeroValue":            ShouldBeZeroValue,
-	"ShouldBeGreaterThan":          ShouldBeGreaterThan,
-	"ShouldBeGreaterThanOrEqualTo": ShouldBeGreaterThanOrEqualTo,
-	"ShouldBeLessThan":             ShouldBeLessThan,
-	"ShouldBeLessThanOrEqualTo":    ShouldBeLessThanOrEqualTo,
-	"ShouldBeBetween":              ShouldBeBetween,
-	"ShouldNotBeBetween":           ShouldNotBeBetween,
-	"ShouldBeBetweenOrEqual":       ShouldBeBetweenOrEqual,
-	"ShouldNotBeBetweenOrEqual":    ShouldNotBeBetweenOrEqual,
-	"ShouldContain":                ShouldContain,
-	"ShouldNotContain":             ShouldNotContain,
-	"ShouldContainKey":             ShouldContainKey,
-	"ShouldNotContainKey":          ShouldNotContainKey,
-	"ShouldBeIn":                   ShouldBeIn,
-	"ShouldNotBeIn":                ShouldNotBeIn,
-	"ShouldBeEmpty":                ShouldBeEmpty,
-	"ShouldNotBeEmpty":             ShouldNotBeEmpty,
-	"ShouldHaveLength":             ShouldHaveLength,
-	"ShouldStartWith":              ShouldStartWith,
-	"ShouldNotStartWith":           ShouldNotStartWith,
-	"ShouldEndWith":                ShouldEndWith,
-	"ShouldNotEndWith":             ShouldNotEndWith,
-	"ShouldBeBlank":                ShouldBeBlank,
-	"ShouldNotBeBlank":             ShouldNotBeBlank,
-	"ShouldContainSubstring":       ShouldContainSubstring,
-	"ShouldNotContainSubstring":    ShouldNotContainSubstring,
-	"ShouldEqualTrimSpace":         ShouldEqualTrimSpace,
-	"ShouldHappenBefore":           ShouldHappenBefore,
-	"ShouldHappenOnOrBefore":       ShouldHappenOnOrBefore,
-	"ShouldHappenAfter":            ShouldHappenAfter,
-	"ShouldHappenOnOrAfter":        ShouldHappenOnOrAfter,
-	"ShouldHappenBetween":          ShouldHappenBetween,
-	"ShouldTimeEqual":              ShouldTimeEqual,
-	"ShouldBeArray":                ShouldBeArray,
-	"ShouldBeMap":                  ShouldBeMap,
+	"ShouldEqual":                   ShouldEqual,
+	"ShouldNotEqual":                ShouldNotEqual,
+	"ShouldAlmostEqual":             ShouldAlmostEqual,
+	"ShouldNotAlmostEqual":          ShouldNotAlmostEqual,
+	"ShouldNotExist":                ShouldNotExist,
+	"ShouldBeNil":                   ShouldBeNil,
+	"ShouldNotBeNil":                ShouldNotBeNil,
+	"ShouldBeTrue":                  ShouldBeTrue,
+	"ShouldBeFalse":                 ShouldBeFalse,
+	"ShouldBeZeroValue":             ShouldBeZeroValue,
+	"ShouldBeGreaterThan":           ShouldBeGreaterThan,
+	"ShouldBeGreaterThanOrEqualTo":  ShouldBeGreaterThanOrEqualTo,
+	"ShouldBeLessThan":              ShouldBeLessThan,
+	"ShouldBeLessThanOrEqualTo":     ShouldBeLessThanOrEqualTo,
+	"ShouldBeBetween":               ShouldBeBetween,
+	"ShouldNotBeBetween":            ShouldNotBeBetween,
+	"ShouldBeBetweenOrEqual":        ShouldBeBetweenOrEqual,
+	"ShouldNotBeBetweenOrEqual":     ShouldNotBeBetweenOrEqual,
+	"ShouldContain":                 ShouldContain,
+	"ShouldNotContain":              ShouldNotContain,
+	"ShouldContainKey":              ShouldContainKey,
+	"ShouldNotContainKey":           ShouldNotContainKey,
+	"ShouldBeIn":                    ShouldBeIn,
+	"ShouldNotBeIn":                 ShouldNotBeIn,
+	"ShouldBeEmpty":                 ShouldBeEmpty,
+	"ShouldNotBeEmpty":              ShouldNotBeEmpty,
+	"ShouldHaveLength":              ShouldHaveLength,
+	"ShouldStartWith":               ShouldStartWith,
+	"ShouldNotStartWith":            ShouldNotStartWith,
+	"ShouldEndWith":                 ShouldEndWith,
+	"ShouldNotEndWith":              ShouldNotEndWith,
+	"ShouldBeBlank":                 ShouldBeBlank,
+	"ShouldNotBeBlank":              ShouldNotBeBlank,
+	"ShouldContainSubstring":        ShouldContainSubstring,
+	"ShouldNotContainSubstring":     ShouldNotContainSubstring,
+	"ShouldContainSubstringN":       ShouldContainSubstringN,
+	"ShouldEqualTrimSpace":          ShouldEqualTrimSpace,
+	"ShouldEqualIgnoringWhitespace": ShouldEqualIgnoringWhitespace,
+	"ShouldMatchRegex":              ShouldMatchRegex,
+	"ShouldNotMatchRegex":           ShouldNotMatchRegex,
+	"ShouldDecodeBase64To":          ShouldDecodeBase64To,
+	"ShouldDecodeHexTo":             ShouldDecodeHexTo,
+	"ShouldHappenBefore":            ShouldHappenBefore,
+	"ShouldHappenOnOrBefore":        ShouldHappenOnOrBefore,
+	"ShouldHappenAfter":             ShouldHappenAfter,
+	"ShouldHappenOnOrAfter":         ShouldHappenOnOrAfter,
+	"ShouldHappenBetween":           ShouldHappenBetween,
+	"ShouldTimeEqual":               ShouldTimeEqual,
+	"ShouldBeArray":                 ShouldBeArray,
+	"ShouldBeMap":                   ShouldBeMap,
 }
 
 func Get(s string) (AssertFunc, bool) {
@@ -921,6 +930,46 @@ func ShouldNotContainSubstring(actual interface{}, expected ...interface{}) erro
 	return nil
 }
 
+// ShouldContainSubstringN receives a string, a substring and a count, and ensures that the first contains the substring exactly count times.
+// The count is the last parameter, the substring may contain spaces.
+//
+// Example of testsuite file:
+//
+//  name: test ShouldContainSubstringN
+//  testcases:
+//  - name: test assertion
+//    steps:
+//    - script: echo 'foo bar foo'
+//      assertions:
+//      - result.systemout ShouldContainSubstringN foo 2
+//
+func ShouldContainSubstringN(actual interface{}, expected ...interface{}) error {
+	if len(expected) < 2 {
+		return newAssertionError("This assertion requires at least 2 comparison values (you provided %d).", len(expected))
+	}
+
+	count, err := cast.ToIntE(expected[len(expected)-1])
+	if err != nil {
+		return err
+	}
+
+	var arg string
+	for _, e := range expected[:len(expected)-1] {
+		arg += fmt.Sprintf("%v ", e)
+	}
+	ss := strings.TrimSpace(arg)
+
+	s, err := cast.ToStringE(actual)
+	if err != nil {
+		return err
+	}
+
+	if n := strings.Count(s, ss); n != count {
+		return fmt.Errorf("expected '%v' to contain '%v' %d times but it was %d times", s, ss, count, n)
+	}
+	return nil
+}
+
 // ShouldEqualTrimSpace receives exactly 2 string parameters and ensures that the first is equal to the second
 // after removing all leading and trailing whitespace using strings.TrimSpace(first).
 func ShouldEqualTrimSpace(actual interface{}, expected ...interface{}) error {
@@ -931,6 +980,196 @@ func ShouldEqualTrimSpace(actual interface{}, expected ...interface{}) error {
 	return ShouldEqual(strings.TrimSpace(actualS), expected...)
 }
 
+// ShouldEqualIgnoringWhitespace receives a string and an expected string, and ensures that they are equal
+// once each run of whitespace, including newlines, is replaced by a single space and leading and trailing
+// whitespace is removed, as in a reflowed mail body. The expected string may contain spaces.
+//
+// Example of testsuite file:
+//
+//  name: test ShouldEqualIgnoringWhitespace
+//  testcases:
+//  - name: test assertion
+//    steps:
+//    - script: printf 'Your order\n  42 is\tconfirmed.\n'
+//      assertions:
+//      - result.systemout ShouldEqualIgnoringWhitespace Your order 42 is confirmed.
+//
+func ShouldEqualIgnoringWhitespace(actual interface{}, expected ...interface{}) error {
+	if len(expected) == 0 {
+		return newAssertionError("This assertion requires at least 1 comparison value (you provided %d).", len(expected))
+	}
+
+	var arg string
+	for _, e := range expected {
+		arg += fmt.Sprintf("%v ", e)
+	}
+	want := strings.Join(strings.Fields(arg), " ")
+
+	s, err := cast.ToStringE(actual)
+	if err != nil {
+		return err
+	}
+	if got := strings.Join(strings.Fields(s), " "); got != want {
+		return fmt.Errorf("expected '%v' to equal '%v' ignoring whitespace but it was '%v'", s, want, got)
+	}
+	return nil
+}
+
+// ShouldMatchRegex receives a string and a regular expression, and ensures that the first matches the second.
+// The regular expression may contain spaces.
+//
+// Example of testsuite file:
+//
+//  name: test ShouldMatchRegex
+//  testcases:
+//  - name: test assertion
+//    steps:
+//    - script: echo 'Order 42 confirmed'
+//      assertions:
+//      - result.systemout ShouldMatchRegex ^Order [0-9]+ confirmed$
+//
+func ShouldMatchRegex(actual interface{}, expected ...interface{}) error {
+	s, re, err := regexArgs(actual, expected)
+	if err != nil {
+		return err
+	}
+
+	if re.MatchString(s) {
+		return nil
+	}
+	return fmt.Errorf("expected '%v' to match '%v' but it wasn't", s, re)
+}
+
+// ShouldNotMatchRegex receives a string and a regular expression, and ensures that the first does NOT match the second.
+// The regular expression may contain spaces.
+//
+// Example of testsuite file:
+//
+//  name: test ShouldNotMatchRegex
+//  testcases:
+//  - name: test assertion
+//    steps:
+//    - script: echo 'Order 42 confirmed'
+//      assertions:
+//      - result.systemout ShouldNotMatchRegex (?i)exception|panic
+//
+func ShouldNotMatchRegex(actual interface{}, expected ...interface{}) error {
+	s, re, err := regexArgs(actual, expected)
+	if err != nil {
+		return err
+	}
+
+	if loc := re.FindStringIndex(s); loc != nil {
+		return fmt.Errorf("expected '%v' to not match '%v' but it matched '%v'", s, re, s[loc[0]:loc[1]])
+	}
+	return nil
+}
+
+// regexArgs returns the string and the compiled regular expression of a regex assertion.
+func regexArgs(actual interface{}, expected []interface{}) (string, *regexp.Regexp, error) {
+	if len(expected) == 0 {
+		return "", nil, newAssertionError("This assertion requires at least 1 comparison value (you provided %d).", len(expected))
+	}
+
+	var arg string
+	for _, e := range expected {
+		arg += fmt.Sprintf("%v ", e)
+	}
+	re, err := regexp.Compile(strings.TrimSpace(arg))
+	if err != nil {
+		return "", nil, err
+	}
+
+	s, err := cast.ToStringE(actual)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, re, nil
+}
+
+// ShouldDecodeBase64To receives a base64 encoded string and a string, and ensures that the first decodes to the second.
+// The standard and URL alphabets are accepted, with or without padding. Whitespace in the encoded string,
+// such as line breaks in a mail body, is ignored. The expected value may contain spaces.
+//
+// Example of testsuite file:
+//
+//  name: test ShouldDecodeBase64To
+//  testcases:
+//  - name: test assertion
+//    steps:
+//    - script: echo 'dG9rZW4gNDI='
+//      assertions:
+//      - result.systemout ShouldDecodeBase64To token 42
+//
+func ShouldDecodeBase64To(actual interface{}, expected ...interface{}) error {
+	s, want, err := decodeArgs(actual, expected)
+	if err != nil {
+		return err
+	}
+
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		var erru error
+		if b, erru = base64.RawURLEncoding.DecodeString(s); erru != nil {
+			return fmt.Errorf("expected '%v' to be base64 encoded but it wasn't: %v", actual, err)
+		}
+	}
+
+	if got := string(b); got != want {
+		return fmt.Errorf("expected '%v' to decode to '%v' but it decoded to '%v'", actual, want, got)
+	}
+	return nil
+}
+
+// ShouldDecodeHexTo receives a hex encoded string and a string, and ensures that the first decodes to the second.
+// Whitespace in the encoded string is ignored. The expected value may contain spaces.
+//
+// Example of testsuite file:
+//
+//  name: test ShouldDecodeHexTo
+//  testcases:
+//  - name: test assertion
+//    steps:
+//    - script: echo '746f6b656e203432'
+//      assertions:
+//      - result.systemout ShouldDecodeHexTo token 42
+//
+func ShouldDecodeHexTo(actual interface{}, expected ...interface{}) error {
+	s, want, err := decodeArgs(actual, expected)
+	if err != nil {
+		return err
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("expected '%v' to be hex encoded but it wasn't: %v", actual, err)
+	}
+
+	if got := string(b); got != want {
+		return fmt.Errorf("expected '%v' to decode to '%v' but it decoded to '%v'", actual, want, got)
+	}
+	return nil
+}
+
+// decodeArgs returns the encoded string, without whitespace, and the expected decoded value of a decode assertion.
+func decodeArgs(actual interface{}, expected []interface{}) (string, string, error) {
+	if len(expected) == 0 {
+		return "", "", newAssertionError("This assertion requires at least 1 comparison value (you provided %d).", len(expected))
+	}
+
+	var arg string
+	for _, e := range expected {
+		arg += fmt.Sprintf("%v ", e)
+	}
+
+	s, err := cast.ToStringE(actual)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.Join(strings.Fields(s), ""), strings.TrimSpace(arg), nil
+}
+
 // ShouldHappenBefore receives exactly 2 time.Time arguments and asserts that the first happens before the second.
 // The arguments have to respect the date format RFC3339, as 2006-01-02T15:04:00+07:00
 //
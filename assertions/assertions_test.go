@@ -441,6 +441,21 @@ func TestShouldBeGreaterThan(t *testing.T) {
 				expected: []interface{}{1.0},
 			},
 		},
+		{
+			name: "with float and int",
+			args: args{
+				actual:   0.5,
+				expected: []interface{}{0},
+			},
+		},
+		{
+			name: "with zero float",
+			args: args{
+				actual:   0.0,
+				expected: []interface{}{0.0},
+			},
+			wantErr: true,
+		},
 		{
 			name: "with wrong types",
 			args: args{
@@ -459,6 +474,70 @@ func TestShouldBeGreaterThan(t *testing.T) {
 	}
 }
 
+func TestShouldBeLessThan(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "with int",
+			args: args{
+				actual:   1,
+				expected: []interface{}{2},
+			},
+		},
+		{
+			name: "with float",
+			args: args{
+				actual:   0.0123,
+				expected: []interface{}{0.5},
+			},
+		},
+		{
+			name: "with float and int",
+			args: args{
+				actual:   0.0123,
+				expected: []interface{}{5},
+			},
+		},
+		{
+			name: "with zero float",
+			args: args{
+				actual:   0.0,
+				expected: []interface{}{0.1},
+			},
+		},
+		{
+			name: "with greater float",
+			args: args{
+				actual:   5.5,
+				expected: []interface{}{5},
+			},
+			wantErr: true,
+		},
+		{
+			name: "with wrong types",
+			args: args{
+				actual:   2.0,
+				expected: []interface{}{"a"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ShouldBeLessThan(tt.args.actual, tt.args.expected...); (err != nil) != tt.wantErr {
+				t.Errorf("ShouldBeLessThan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestShouldBeGreaterThanOrEqualTo(t *testing.T) {
 	type args struct {
 		actual   interface{}
@@ -1085,6 +1164,320 @@ func TestShouldContainSubstring(t *testing.T) {
 	}
 }
 
+func TestShouldContainSubstringN(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			args: args{
+				actual:   "aaa-x",
+				expected: []interface{}{"a", 3},
+			},
+		},
+		{
+			name: "ok with string count",
+			args: args{
+				actual:   "aaa-x",
+				expected: []interface{}{"a", "3"},
+			},
+		},
+		{
+			name: "ok with spaces",
+			args: args{
+				actual:   "click to unsubscribe, or unsubscribe here",
+				expected: []interface{}{"or", "unsubscribe", 1},
+			},
+		},
+		{
+			name: "ok none",
+			args: args{
+				actual:   "aaa-x",
+				expected: []interface{}{"b", 0},
+			},
+		},
+		{
+			name: "ko",
+			args: args{
+				actual:   "aaa-x",
+				expected: []interface{}{"a", 2},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko without count",
+			args: args{
+				actual:   "aaa-x",
+				expected: []interface{}{"a"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko invalid count",
+			args: args{
+				actual:   "aaa-x",
+				expected: []interface{}{"a", "b"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ShouldContainSubstringN(tt.args.actual, tt.args.expected...); (err != nil) != tt.wantErr {
+				t.Errorf("ShouldContainSubstringN() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShouldMatchRegex(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			args: args{
+				actual:   "Order 42 confirmed",
+				expected: []interface{}{`^Order \d+`},
+			},
+		},
+		{
+			name: "ok with spaces",
+			args: args{
+				actual:   "Order 42 confirmed",
+				expected: []interface{}{"^Order", "[0-9]+", "confirmed$"},
+			},
+		},
+		{
+			name: "ok with number",
+			args: args{
+				actual:   42,
+				expected: []interface{}{"^4"},
+			},
+		},
+		{
+			name: "ko",
+			args: args{
+				actual:   "Order 42 confirmed",
+				expected: []interface{}{"^confirmed"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko invalid regex",
+			args: args{
+				actual:   "Order 42 confirmed",
+				expected: []interface{}{"(Order"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko without regex",
+			args: args{
+				actual: "Order 42 confirmed",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ShouldMatchRegex(tt.args.actual, tt.args.expected...); (err != nil) != tt.wantErr {
+				t.Errorf("ShouldMatchRegex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShouldNotMatchRegex(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr string
+	}{
+		{
+			name: "ok",
+			args: args{
+				actual:   "Order 42 confirmed",
+				expected: []interface{}{"(?i)exception|panic"},
+			},
+		},
+		{
+			name: "ko",
+			args: args{
+				actual:   "Error: NullPointerException at line 12",
+				expected: []interface{}{"[A-Za-z]+Exception"},
+			},
+			wantErr: "expected 'Error: NullPointerException at line 12' to not match '[A-Za-z]+Exception' but it matched 'NullPointerException'",
+		},
+		{
+			name: "ko invalid regex",
+			args: args{
+				actual:   "Order 42 confirmed",
+				expected: []interface{}{"(Order"},
+			},
+			wantErr: "error parsing regexp: missing closing ): `(Order`",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ShouldNotMatchRegex(tt.args.actual, tt.args.expected...)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ShouldNotMatchRegex() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("ShouldNotMatchRegex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShouldDecodeBase64To(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			args: args{
+				actual:   "dG9rZW4gNDI=",
+				expected: []interface{}{"token", "42"},
+			},
+		},
+		{
+			name: "ok without padding",
+			args: args{
+				actual:   "dG9rZW4gNDI",
+				expected: []interface{}{"token 42"},
+			},
+		},
+		{
+			name: "ok url alphabet",
+			args: args{
+				actual:   "-_8",
+				expected: []interface{}{"\xfb\xff"},
+			},
+		},
+		{
+			name: "ok with line breaks",
+			args: args{
+				actual:   "dG9r\r\nZW4g\r\nNDI=\r\n",
+				expected: []interface{}{"token 42"},
+			},
+		},
+		{
+			name: "ko",
+			args: args{
+				actual:   "dG9rZW4gNDI=",
+				expected: []interface{}{"token 43"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko invalid encoding",
+			args: args{
+				actual:   "dG9rZW4*NDI=",
+				expected: []interface{}{"token 42"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko without expected value",
+			args: args{
+				actual: "dG9rZW4gNDI=",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ShouldDecodeBase64To(tt.args.actual, tt.args.expected...); (err != nil) != tt.wantErr {
+				t.Errorf("ShouldDecodeBase64To() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShouldDecodeHexTo(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			args: args{
+				actual:   "746f6b656e203432",
+				expected: []interface{}{"token", "42"},
+			},
+		},
+		{
+			name: "ok upper case",
+			args: args{
+				actual:   "746F6B656E203432\n",
+				expected: []interface{}{"token 42"},
+			},
+		},
+		{
+			name: "ko",
+			args: args{
+				actual:   "746f6b656e203432",
+				expected: []interface{}{"token 43"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko invalid encoding",
+			args: args{
+				actual:   "746f6b656e20343",
+				expected: []interface{}{"token 42"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko without expected value",
+			args: args{
+				actual: "746f6b656e203432",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ShouldDecodeHexTo(tt.args.actual, tt.args.expected...); (err != nil) != tt.wantErr {
+				t.Errorf("ShouldDecodeHexTo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestShouldNotContainSubstring(t *testing.T) {
 	type args struct {
 		actual   interface{}
@@ -1155,6 +1548,63 @@ func TestShouldEqualTrimSpace(t *testing.T) {
 	}
 }
 
+func TestShouldEqualIgnoringWhitespace(t *testing.T) {
+	type args struct {
+		actual   interface{}
+		expected []interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			args: args{
+				actual:   "Your order\r\n  42 is\tconfirmed.\r\n",
+				expected: []interface{}{"Your", "order", "42", "is", "confirmed."},
+			},
+		},
+		{
+			name: "ok with spaces in expected",
+			args: args{
+				actual:   "Your order 42",
+				expected: []interface{}{" Your  order\n42 "},
+			},
+		},
+		{
+			name: "ko",
+			args: args{
+				actual:   "Your order 42 is confirmed.",
+				expected: []interface{}{"Your order 42 is cancelled."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko with words joined",
+			args: args{
+				actual:   "Your order42",
+				expected: []interface{}{"Your order 42"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "ko without expected value",
+			args: args{
+				actual: "Your order 42",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ShouldEqualIgnoringWhitespace(tt.args.actual, tt.args.expected...); (err != nil) != tt.wantErr {
+				t.Errorf("ShouldEqualIgnoringWhitespace() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestShouldHappenBefore(t *testing.T) {
 	type args struct {
 		actual   interface{}
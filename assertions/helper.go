@@ -59,12 +59,26 @@ func areSameTypes(i, j interface{}) bool {
 	if err != nil {
 		return false
 	}
+	// numbers of different types, as a float64 result and an int, are comparable
+	if isNumber(i) && isNumber(j) {
+		return true
+	}
 	return reflect.DeepEqual(
 		reflect.Zero(reflect.TypeOf(i)).Interface(),
 		reflect.Zero(reflect.TypeOf(j)).Interface(),
 	)
 }
 
+func isNumber(i interface{}) bool {
+	switch reflect.TypeOf(i).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 func handleJSONNumber(actual interface{}, expected interface{}) (interface{}, interface{}, error) {
 	jsNumber, is := actual.(json.Number)
 	if !is {
@@ -0,0 +1,267 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/yesnault/go-imap/imap"
+
+	"github.com/ovh/venom"
+)
+
+// Actions of the action input, run instead of searching a mail.
+const (
+	actionQuota  = "quota"
+	actionCounts = "counts"
+	actionPurge  = "purge"
+	actionList   = "list"
+)
+
+// FolderCounts are the counts of a mailbox of result.folders.
+type FolderCounts struct {
+	Messages uint32 `json:"messages" yaml:"messages"`
+	Unseen   uint32 `json:"unseen" yaml:"unseen"`
+}
+
+// MailboxTree is the hierarchy of the mailboxes of result.mailboxtree: the
+// children of a mailbox by their name, without the hierarchy delimiter.
+type MailboxTree map[string]MailboxTree
+
+// quota returns the usage and the limit of the STORAGE resource of the quota
+// root of the mailbox, in units of 1024 octets (RFC 2087). ok is false when
+// the server does not advertise the QUOTA capability or sets no STORAGE
+// limit on the mailbox.
+func (e *Executor) quota(ctx context.Context) (used, limit uint32, ok bool, err error) {
+	if err := e.checkCredentials(); err != nil {
+		return 0, 0, false, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return 0, 0, false, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return 0, 0, false, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	if !e.hasCap(ctx, c, "QUOTA") {
+		venom.Warn(ctx, "action %s skipped: the server does not advertise the QUOTA capability", actionQuota)
+		return 0, 0, false, nil
+	}
+
+	box := e.mailbox()
+	cmd, err := check(c.GetQuotaRoot(box))
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "error while getting the quota of %s", box)
+	}
+	for _, rsp := range cmd.Data {
+		if rsp.Label != "QUOTA" {
+			continue
+		}
+		root, quotas := rsp.Quota()
+		for _, q := range quotas {
+			if q.Resource == "STORAGE" {
+				venom.Debug(ctx, "quota root %q of %s: %d/%d KB", root, box, q.Usage, q.Limit)
+				return q.Usage, q.Limit, true, nil
+			}
+		}
+	}
+	venom.Warn(ctx, "action %s: no STORAGE quota set on %s", actionQuota, box)
+	return 0, 0, false, nil
+}
+
+// counts returns the number of messages and unseen messages of every mailbox.
+// With the LIST-STATUS extension (RFC 5819), they are returned by a single
+// LIST command, otherwise by a STATUS command per mailbox.
+func (e *Executor) counts(ctx context.Context) (map[string]FolderCounts, error) {
+	if err := e.checkCredentials(); err != nil {
+		return nil, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return nil, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return nil, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	folders := map[string]FolderCounts{}
+	if e.hasCap(ctx, c, "LIST-STATUS") {
+		// The STATUS responses are sent along with the LIST ones.
+		config := c.CommandConfig["LIST"]
+		c.CommandConfig["LIST"] = &imap.CommandConfig{States: config.States, Filter: imap.LabelFilter("LIST", "STATUS")}
+		cmd, err := c.Send("LIST", c.Quote(""), c.Quote("*"), "RETURN", []imap.Field{"STATUS", []imap.Field{"MESSAGES", "UNSEEN"}})
+		c.CommandConfig["LIST"] = config
+		if cmd, err = check(cmd, err); err != nil {
+			return nil, errors.Wrapf(err, "error while listing the mailboxes")
+		}
+		for _, rsp := range cmd.Data {
+			if status := rsp.MailboxStatus(); status != nil {
+				folders[status.Name] = FolderCounts{Messages: status.Messages, Unseen: status.Unseen}
+			}
+		}
+		venom.Debug(ctx, "counts of %d mailboxes with LIST-STATUS", len(folders))
+		return folders, nil
+	}
+
+	cmd, err := check(c.List("", "*"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while listing the mailboxes")
+	}
+	for _, rsp := range cmd.Data {
+		info := rsp.MailboxInfo()
+		if info == nil || !selectable(info.Attrs) {
+			continue
+		}
+		cmds, err := check(c.Status(info.Name, "MESSAGES", "UNSEEN"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while getting the status of %s", info.Name)
+		}
+		for _, rsp := range cmds.Data {
+			if status := rsp.MailboxStatus(); status != nil {
+				folders[info.Name] = FolderCounts{Messages: status.Messages, Unseen: status.Unseen}
+			}
+		}
+	}
+	venom.Debug(ctx, "counts of %d mailboxes with STATUS", len(folders))
+	return folders, nil
+}
+
+// list returns the mailboxes of the account, by name.
+func (e *Executor) list(ctx context.Context) ([]*imap.MailboxInfo, error) {
+	if err := e.checkCredentials(); err != nil {
+		return nil, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return nil, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return nil, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	cmd, err := check(c.List("", "*"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while listing the mailboxes")
+	}
+	var mailboxes []*imap.MailboxInfo
+	for _, rsp := range cmd.Data {
+		if info := rsp.MailboxInfo(); info != nil {
+			mailboxes = append(mailboxes, info)
+		}
+	}
+	sort.Slice(mailboxes, func(i, j int) bool { return mailboxes[i].Name < mailboxes[j].Name })
+	venom.Debug(ctx, "%d mailboxes listed", len(mailboxes))
+	return mailboxes, nil
+}
+
+// mailboxTree returns the hierarchy of mailboxes, split by the hierarchy
+// delimiter of each LIST response. The parents missing from the list, as the
+// ones of a server not listing them, are part of the tree anyway.
+func mailboxTree(mailboxes []*imap.MailboxInfo) MailboxTree {
+	tree := MailboxTree{}
+	for _, info := range mailboxes {
+		names := []string{info.Name}
+		if info.Delim != "" {
+			names = strings.Split(info.Name, info.Delim)
+		}
+		node := tree
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if node[name] == nil {
+				node[name] = MailboxTree{}
+			}
+			node = node[name]
+		}
+	}
+	return tree
+}
+
+// purge deletes all the messages of the mailbox and returns their number. It
+// must be confirmed by ConfirmPurge, and by AllowPurgeInbox for the INBOX.
+func (e *Executor) purge(ctx context.Context) (int, error) {
+	box := e.mailbox()
+	if !e.ConfirmPurge {
+		return 0, fmt.Errorf("action %s requires confirmpurge: true", actionPurge)
+	}
+	if strings.EqualFold(box, "INBOX") && !e.AllowPurgeInbox {
+		return 0, fmt.Errorf("action %s of INBOX requires allowpurgeinbox: true", actionPurge)
+	}
+	if err := e.checkCredentials(); err != nil {
+		return 0, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return 0, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return 0, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	if err := e.selectMailbox(ctx, c, box); err != nil {
+		return 0, errors.Wrapf(err, "error while selecting %s", box)
+	}
+	if c.Mailbox.Messages == 0 {
+		return 0, nil
+	}
+	seq, _ := imap.NewSeqSet("1:*")
+	if _, err := check(c.Store(seq, "+FLAGS.SILENT", imap.NewFlagSet(`\Deleted`))); err != nil {
+		return 0, errors.Wrapf(err, "error while deleting the messages of %s", box)
+	}
+	cmd, err := check(c.Expunge(nil))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error while expunging %s", box)
+	}
+	var purged int
+	for _, rsp := range cmd.Data {
+		if rsp.Label == "EXPUNGE" {
+			purged++
+		}
+	}
+	venom.Debug(ctx, "%d messages purged from %s", purged, box)
+	return purged, nil
+}
+
+// selectable reports whether a mailbox with these LIST attributes can be
+// selected, or has a status.
+func selectable(attrs imap.FlagSet) bool {
+	for attr := range attrs {
+		if strings.EqualFold(attr, `\Noselect`) || strings.EqualFold(attr, `\NonExistent`) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAction returns an error if action is not supported.
+func checkAction(action string) error {
+	switch action {
+	case "", actionQuota, actionCounts, actionPurge, actionList:
+		return nil
+	}
+	return fmt.Errorf("unsupported action %q", action)
+}
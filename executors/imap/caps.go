@@ -0,0 +1,35 @@
+package imap
+
+import (
+	"context"
+	"strings"
+
+	"github.com/yesnault/go-imap/imap"
+
+	"github.com/ovh/venom"
+)
+
+// hasCap returns true if the server of c advertises the capability name,
+// whatever its case.
+func hasCap(c *imap.Client, name string) bool {
+	return c.Caps[strings.ToUpper(name)]
+}
+
+// hasCap returns true if the server of c advertises the capability name, to
+// use the extension or else fall back. The first check of each capability in
+// the step is logged.
+func (e *Executor) hasCap(ctx context.Context, c *imap.Client, name string) bool {
+	ok := hasCap(c, name)
+	if e.checkedCaps == nil {
+		e.checkedCaps = map[string]bool{}
+	}
+	if _, checked := e.checkedCaps[name]; !checked {
+		e.checkedCaps[name] = ok
+		if ok {
+			venom.Debug(ctx, "Server capability %s is advertised, it is used", name)
+		} else {
+			venom.Debug(ctx, "Server capability %s is not advertised", name)
+		}
+	}
+	return ok
+}
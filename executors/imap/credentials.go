@@ -0,0 +1,89 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/yesnault/go-imap/imap"
+)
+
+// CredentialProvider returns the password, or the token, of user. It is
+// called at each connection of the steps using it, so that rotating
+// credentials are fetched when they are needed.
+type CredentialProvider func(ctx context.Context, user string) (string, error)
+
+// credentialProviders are the providers registered by name, for
+// credentialprovider.
+var credentialProviders = struct {
+	sync.RWMutex
+	m map[string]CredentialProvider
+}{m: map[string]CredentialProvider{}}
+
+// RegisterCredentialProvider registers provider under name: the steps with
+// `credentialprovider: name` get their password from it instead of
+// imappassword. Registering a name again replaces the previous provider.
+func RegisterCredentialProvider(name string, provider CredentialProvider) {
+	credentialProviders.Lock()
+	defer credentialProviders.Unlock()
+	credentialProviders.m[name] = provider
+}
+
+// credentialProvider returns the provider of CredentialProvider.
+func (e *Executor) credentialProvider() (CredentialProvider, error) {
+	credentialProviders.RLock()
+	defer credentialProviders.RUnlock()
+	if provider, ok := credentialProviders.m[e.CredentialProvider]; ok && provider != nil {
+		return provider, nil
+	}
+	names := make([]string, 0, len(credentialProviders.m))
+	for name := range credentialProviders.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown credentialprovider %q, registered ones are [%s]", e.CredentialProvider, strings.Join(names, ", "))
+}
+
+// password returns the password to log in with, or the access token with
+// imapauthmethod xoauth2: the one of the credential provider if any, or else
+// IMAPPassword or IMAPAccessToken.
+func (e *Executor) password(ctx context.Context) (string, error) {
+	if e.CredentialProvider == "" {
+		if method, _ := e.authMethod(); method == authMethodXOAuth2 {
+			return e.IMAPAccessToken, nil
+		}
+		return e.IMAPPassword, nil
+	}
+	provider, err := e.credentialProvider()
+	if err != nil {
+		return "", err
+	}
+	password, err := provider(ctx, e.IMAPUser)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to get the password from credentialprovider %s", e.CredentialProvider)
+	}
+	if password == "" && !e.AllowAnonymous {
+		return "", fmt.Errorf("credentialprovider %s returned an empty password", e.CredentialProvider)
+	}
+	e.protocolLog.redactSecret(password)
+	return password, nil
+}
+
+// xoauth2Auth is the SASL XOAUTH2 mechanism of Gmail and Office 365, logging
+// in user with an OAuth2 bearer token.
+type xoauth2Auth struct {
+	user, token string
+}
+
+func (a xoauth2Auth) Start(s *imap.ServerInfo) (string, []byte, error) {
+	return authMechanismXOAuth2, []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the error challenge sent before the failure of the
+// authentication, with an empty response as expected by the server.
+func (a xoauth2Auth) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
@@ -0,0 +1,125 @@
+package imap
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ovh/venom"
+)
+
+func TestExecutor_Run_CredentialProvider(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	var users []string
+	password := "outdated"
+	RegisterCredentialProvider("test-rotating", func(ctx context.Context, user string) (string, error) {
+		users = append(users, user)
+		return password, nil
+	})
+	RegisterCredentialProvider("test-failing", func(ctx context.Context, user string) (string, error) {
+		return "", fmt.Errorf("vault is sealed")
+	})
+
+	step := s.Step(venom.TestStep{
+		"imappassword":       nil,
+		"credentialprovider": "test-rotating",
+		"searchsubject":      "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to login")
+
+	// The rotated password is fetched at the next connection.
+	password = s.Password
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, []string{s.User, s.User}, users)
+
+	// The provider takes precedence over imappassword.
+	step["imappassword"] = "wrong"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+
+	password = ""
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "error while connecting: credentialprovider test-rotating returned an empty password", r.(Result).Err)
+
+	step["credentialprovider"] = "test-failing"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "error while connecting: unable to get the password from credentialprovider test-failing: vault is sealed", r.(Result).Err)
+
+	step["credentialprovider"] = "test-missing"
+	commands := len(s.Commands())
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `unknown credentialprovider "test-missing", registered ones are [`)
+	require.Len(t, s.Commands(), commands, "the step fails before connecting")
+}
+
+func TestExecutor_Run_XOAuth2(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.Update(func() { s.AccessToken = "ya29.token" })
+	e := s.Executor()
+
+	step := s.Step(venom.TestStep{
+		"imappassword":    nil,
+		"imapauthmethod":  "xoauth2",
+		"imapaccesstoken": "ya29.token",
+		"searchsubject":   "Order",
+		"protocollog":     true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "imapauthmethod xoauth2 requires the AUTH=XOAUTH2 capability")
+
+	for _, caps := range [][]string{{"AUTH=XOAUTH2"}, {"AUTH=XOAUTH2", "SASL-IR"}} {
+		s.Update(func() { s.Caps = append([]string{"IMAP4rev1"}, caps...) })
+		commands := len(s.Commands())
+		r, err = s.Executor().Run(context.Background(), step)
+		require.NoError(t, err)
+		result := r.(Result)
+		require.Empty(t, result.Err)
+		require.Equal(t, "Order 42 confirmed", result.Subject)
+		require.Equal(t, "XOAUTH2", result.AuthMechanism)
+		require.NotContains(t, s.Commands()[commands:], "LOGIN")
+		require.NotEmpty(t, result.ProtocolLog)
+		for _, line := range result.ProtocolLog {
+			require.NotContains(t, line, "ya29.token")
+			require.NotContains(t, line, base64.StdEncoding.EncodeToString([]byte("user="+e.IMAPUser+"\x01auth=Bearer ya29.token\x01\x01")))
+		}
+	}
+
+	step["imapaccesstoken"] = "expired"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to login")
+
+	delete(step, "imapaccesstoken")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "imapaccesstoken is required with imapauthmethod xoauth2")
+
+	// The token may come from a credential provider.
+	RegisterCredentialProvider("test-oauth2", func(ctx context.Context, user string) (string, error) {
+		return "ya29.token", nil
+	})
+	step["credentialprovider"] = "test-oauth2"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+
+	step["imapauthmethod"] = "kerberos"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `unsupported imapauthmethod "kerberos", expected password or xoauth2`)
+}
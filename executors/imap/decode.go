@@ -1,6 +1,7 @@
 package imap
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/base64"
@@ -10,6 +11,10 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/ovh/venom"
 	"github.com/yesnault/go-imap/imap"
@@ -24,12 +29,589 @@ func decodeHeader(msg *mail.Message, headerName string) (string, error) {
 	return s, nil
 }
 
-func extract(ctx context.Context, rsp imap.Response) (*Mail, error) {
+// messageData returns the header and the body of a fetched message, from
+// RFC822.HEADER and RFC822.TEXT, their BODY[HEADER] and BODY[TEXT] equivalents,
+// or else from the whole message (RFC822 or BODY[]).
+func messageData(attrs imap.FieldMap) ([]byte, []byte) {
+	header := imap.AsBytes(firstAttr(attrs, "RFC822.HEADER", "BODY[HEADER]"))
+	body := imap.AsBytes(firstAttr(attrs, "RFC822.TEXT", "BODY[TEXT]"))
+	if header != nil {
+		return header, body
+	}
+	full := imap.AsBytes(firstAttr(attrs, "RFC822", "BODY[]"))
+	if i := bytes.Index(full, []byte("\r\n\r\n")); i >= 0 {
+		header = full[:i+4]
+		if body == nil {
+			body = full[i+4:]
+		}
+	}
+	return header, body
+}
+
+// firstAttr returns the first attribute of names, or of their partial
+// version as "BODY[TEXT]<0>".
+func firstAttr(attrs imap.FieldMap, names ...string) imap.Field {
+	for _, name := range names {
+		if f, ok := attrs[name]; ok {
+			return f
+		}
+		for k, f := range attrs {
+			if strings.HasPrefix(k, name+"<") {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+func decodeGmailLabels(f imap.Field) []string {
+	var labels []string
+	for _, l := range imap.AsList(f) {
+		labels = append(labels, imap.AsMailbox(l))
+	}
+	return labels
+}
+
+// decodeEnvelope returns the content of an ENVELOPE response (RFC 3501
+// section 7.4.2), nil if the response is not a valid envelope.
+func decodeEnvelope(f imap.Field) *Envelope {
+	fields := imap.AsList(f)
+	if len(fields) != 10 {
+		return nil
+	}
+	return &Envelope{
+		Date:      imap.AsString(fields[0]),
+		Subject:   decodeWords(imap.AsString(fields[1])),
+		From:      decodeEnvelopeAddresses(fields[2]),
+		To:        decodeEnvelopeAddresses(fields[5]),
+		Cc:        decodeEnvelopeAddresses(fields[6]),
+		MessageID: imap.AsString(fields[9]),
+	}
+}
+
+// decodeEnvelopeAddresses returns the addresses of an envelope address list,
+// formatted as "Name <mailbox@host>".
+func decodeEnvelopeAddresses(f imap.Field) []string {
+	var addresses []string
+	for _, a := range imap.AsList(f) {
+		fields := imap.AsList(a)
+		if len(fields) != 4 || fields[3] == nil {
+			// Group syntax delimiters have a NIL host.
+			continue
+		}
+		address := imap.AsString(fields[2]) + "@" + imap.AsString(fields[3])
+		if name := decodeWords(imap.AsString(fields[0])); name != "" {
+			address = name + " <" + address + ">"
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// foldRegexp matches the line breaks of a folded header value.
+var foldRegexp = regexp.MustCompile(`\r?\n[ \t]+`)
+
+// unfold joins the lines of a header value folded as allowed by RFC 5322,
+// as net/mail does for the headers it reads. The envelope returned by some
+// servers keeps the folding of the raw header.
+func unfold(s string) string {
+	return foldRegexp.ReplaceAllString(s, " ")
+}
+
+// decodeWords decodes the RFC 2047 encoded-words of s, once unfolded. s is
+// returned unfolded if it can't be decoded.
+func decodeWords(s string) string {
+	s = unfold(s)
+	dec := new(mime.WordDecoder)
+	if d, err := dec.DecodeHeader(s); err == nil {
+		return d
+	}
+	return s
+}
+
+// countRecipients returns the number of addresses listed in the given headers.
+// A header which can't be parsed as an address list is not counted.
+func countRecipients(ctx context.Context, msg *mail.Message, headerNames ...string) int {
+	var count int
+	for _, name := range headerNames {
+		if msg.Header.Get(name) == "" {
+			continue
+		}
+		addresses, err := msg.Header.AddressList(name)
+		if err != nil {
+			venom.Debug(ctx, "Cannot parse %s header as an address list: %s", name, err)
+			continue
+		}
+		count += len(addresses)
+	}
+	return count
+}
+
+// Priority levels of a message.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// parsePriority returns the priority level of the message from its X-Priority
+// header (1 to 5, 1 being the highest) or, if missing, its Importance header.
+// A message without any of them has the normal priority.
+func parsePriority(header mail.Header) string {
+	if xp := strings.TrimSpace(header.Get("X-Priority")); xp != "" {
+		// The value may be followed by a comment, like "1 (Highest)".
+		switch xp[0] {
+		case '1', '2':
+			return priorityHigh
+		case '3':
+			return priorityNormal
+		case '4', '5':
+			return priorityLow
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Importance"))) {
+	case priorityHigh:
+		return priorityHigh
+	case priorityLow:
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+var (
+	// spamStatusScoreRegexp matches the score of X-Spam-Status, as
+	// "No, score=1.2 required=5.0 tests=...", set by SpamAssassin, hits=
+	// for its older versions.
+	spamStatusScoreRegexp = regexp.MustCompile(`(?i)\b(?:score|hits)=([-+]?[0-9]+(?:\.[0-9]+)?)`)
+	// spamScoreRegexp matches the number starting X-Spam-Score, as "1.2",
+	// or "1.20 / 15.00" from rspamd.
+	spamScoreRegexp = regexp.MustCompile(`^\s*([-+]?[0-9]+(?:\.[0-9]+)?)`)
+)
+
+// parseSpamScore returns the spam score of the message from its
+// X-Spam-Status header or, if missing, its X-Spam-Score header. It is nil if
+// none of them has a score.
+func parseSpamScore(header mail.Header) *float64 {
+	m := spamStatusScoreRegexp.FindStringSubmatch(header.Get("X-Spam-Status"))
+	if m == nil {
+		m = spamScoreRegexp.FindStringSubmatch(header.Get("X-Spam-Score"))
+	}
+	if m == nil {
+		return nil
+	}
+	score, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return nil
+	}
+	return &score
+}
+
+// parseAuthResults returns the method/result pairs (dkim=pass, spf=fail...)
+// of the Authentication-Results header (RFC 8601) added by authServID. When
+// authServID is empty, the topmost header is used, it was added by the last
+// receiving server.
+func parseAuthResults(header mail.Header, authServID string) map[string]string {
+	for _, value := range header["Authentication-Results"] {
+		parts := strings.Split(stripHeaderComments(value), ";")
+		id := strings.Fields(parts[0])
+		if len(id) == 0 || (authServID != "" && !strings.EqualFold(id[0], authServID)) {
+			continue
+		}
+
+		results := make(map[string]string)
+		for _, part := range parts[1:] {
+			m := authResultRegexp.FindStringSubmatch(strings.TrimSpace(part))
+			if m == nil {
+				continue
+			}
+			method := strings.ToLower(m[1])
+			if _, ok := results[method]; !ok {
+				results[method] = strings.ToLower(m[2])
+			}
+		}
+		return results
+	}
+	return nil
+}
+
+// parseDKIMSignatures returns the signing domain (d= tag) and selector (s=
+// tag) of the DKIM-Signature headers (RFC 6376), topmost first. The domains
+// are lowercased, as they are case-insensitive.
+func parseDKIMSignatures(header mail.Header) []DKIMSignature {
+	var sigs []DKIMSignature
+	for _, value := range header["Dkim-Signature"] {
+		var sig DKIMSignature
+		for _, tag := range strings.Split(value, ";") {
+			name, v, ok := strings.Cut(tag, "=")
+			if !ok {
+				continue
+			}
+			// Folding whitespace is allowed anywhere in the values.
+			v = strings.Join(strings.Fields(v), "")
+			switch strings.TrimSpace(name) {
+			case "d":
+				sig.Domain = strings.ToLower(v)
+			case "s":
+				sig.Selector = v
+			}
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+var authResultRegexp = regexp.MustCompile(`^([a-zA-Z0-9_.-]+)\s*=\s*([a-zA-Z0-9_-]+)`)
+
+// stripHeaderComments removes the parenthesized comments of a header value.
+func stripHeaderComments(value string) string {
+	var b strings.Builder
+	var depth int
+	for _, r := range value {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// transferDecoder decodes r according to its Content-Transfer-Encoding.
+func transferDecoder(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	// 7bit, 8bit and binary are not encoded.
+	return r
+}
+
+// bodyPart returns the decoded content of the part at section, fetched with
+// its MIME header. It is empty if the mail has no such part.
+func bodyPart(attrs imap.FieldMap, section string) (string, error) {
+	content := imap.AsBytes(firstAttr(attrs, "BODY["+section+"]"))
+	if len(content) == 0 {
+		return "", nil
+	}
+	var encoding string
+	if header := imap.AsBytes(firstAttr(attrs, "BODY["+section+".MIME]")); len(header) > 0 {
+		h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		encoding = h.Get("Content-Transfer-Encoding")
+	}
+	decoded, err := io.ReadAll(transferDecoder(bytes.NewReader(content), encoding))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// textParts returns the decoded text/plain parts of a message body, walking
+// its nested multipart parts and forwarded mails. The attachments are ignored.
+func textParts(contentType, encoding string, body []byte) ([]string, error) {
+	return typedParts("text/plain", contentType, encoding, body)
+}
+
+// htmlParts returns the decoded text/html parts of a message body, as
+// textParts.
+func htmlParts(contentType, encoding string, body []byte) ([]string, error) {
+	return typedParts("text/html", contentType, encoding, body)
+}
+
+// typedParts returns the decoded parts of mediaType of a message body. A
+// body without Content-Type is text/plain.
+func typedParts(want, contentType, encoding string, body []byte) ([]string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil && contentType != "" {
+		return nil, err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return partsOfType(want, multipart.NewReader(bytes.NewReader(body), params["boundary"]))
+	}
+	if mediaType == "message/rfc822" {
+		// Forwarded mail.
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(msg.Body)
+		if err != nil {
+			return nil, err
+		}
+		return typedParts(want, msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), content)
+	}
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	if mediaType != want {
+		return nil, nil
+	}
+	text, err := io.ReadAll(transferDecoder(bytes.NewReader(body), encoding))
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(text)}, nil
+}
+
+func partsOfType(want string, mr *multipart.Reader) ([]string, error) {
+	var texts []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return texts, nil
+		}
+		if err != nil {
+			return texts, err
+		}
+		if disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition")); disposition == "attachment" {
+			continue
+		}
+		content, err := io.ReadAll(p)
+		if err != nil {
+			return texts, err
+		}
+		// quoted-printable parts are already decoded by the multipart reader.
+		nested, err := typedParts(want, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), content)
+		texts = append(texts, nested...)
+		if err != nil {
+			return texts, err
+		}
+	}
+}
+
+// attachment is a part of a mail which is not the body: an attachment, or a
+// named inline part.
+type attachment struct {
+	name      string
+	mediaType string
+	inline    bool
+	// size is the decoded size, content the decoded content with
+	// ReturnAttachments, unless it exceeds MaxAttachmentSize.
+	size      int64
+	content   []byte
+	truncated bool
+}
+
+// attachmentContent bounds the attachments read by mailAttachments: their
+// content is only kept with keep, up to maxSize bytes if not 0.
+type attachmentContent struct {
+	keep    bool
+	maxSize int64
+}
+
+// mailAttachments returns the attachments of a message body, walking its
+// nested multipart parts: the parts named or with an attachment disposition.
+// The named inline parts, as the images of an HTML body, are returned as
+// inline. Their content is decoded according to ac.
+func mailAttachments(contentType string, body []byte, ac attachmentContent) ([]attachment, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil
+	}
+	return partsAttachments(multipart.NewReader(bytes.NewReader(body), params["boundary"]), ac)
+}
+
+func partsAttachments(mr *multipart.Reader, ac attachmentContent) ([]attachment, error) {
+	var attachments []attachment
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return attachments, nil
+		}
+		if err != nil {
+			return attachments, err
+		}
+
+		mediaType, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			nested, err := partsAttachments(multipart.NewReader(p, params["boundary"]), ac)
+			attachments = append(attachments, nested...)
+			if err != nil {
+				return attachments, err
+			}
+			continue
+		}
+
+		// The RFC 2231 parameters are decoded by ParseMediaType.
+		disposition, dparams, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		name := dparams["filename"]
+		if name == "" {
+			// Older clients only name the part in its Content-Type.
+			name = params["name"]
+		}
+		// An unnamed part is only an attachment with that disposition.
+		if name == "" && disposition != "attachment" {
+			continue
+		}
+		a := attachment{name: decodeWords(name), mediaType: mediaType, inline: disposition == "inline"}
+		if ac.keep {
+			if err := ac.read(&a, transferDecoder(p, p.Header.Get("Content-Transfer-Encoding"))); err != nil {
+				return attachments, err
+			}
+		}
+		attachments = append(attachments, a)
+	}
+}
+
+// read sets the size of a from its decoded content r, and its content unless
+// it is larger than maxSize: the rest of a larger one is only counted, not
+// kept in memory.
+func (ac attachmentContent) read(a *attachment, r io.Reader) error {
+	if ac.maxSize <= 0 {
+		content, err := io.ReadAll(r)
+		a.content, a.size = content, int64(len(content))
+		return err
+	}
+	content, err := io.ReadAll(io.LimitReader(r, ac.maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) <= ac.maxSize {
+		a.content, a.size = content, int64(len(content))
+		return nil
+	}
+	rest, err := io.Copy(io.Discard, r)
+	a.size, a.truncated = int64(len(content))+rest, true
+	return err
+}
+
+// mimeParts returns the media types of a message body and of its nested
+// parts, multipart ones included, each once in the order of the body. A part
+// without Content-Type is text/plain.
+func mimeParts(contentType string, body []byte) ([]string, error) {
+	var types []string
+	seen := map[string]bool{}
+	var walk func(contentType string, r io.Reader) error
+	walk = func(contentType string, r io.Reader) error {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType = "text/plain"
+		}
+		if !seen[mediaType] {
+			seen[mediaType] = true
+			types = append(types, mediaType)
+		}
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			return nil
+		}
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walk(p.Header.Get("Content-Type"), p); err != nil {
+				return err
+			}
+		}
+	}
+	err := walk(contentType, bytes.NewReader(body))
+	return types, err
+}
+
+// forwardedMessage returns the first mail forwarded as a message/rfc822 part
+// of a message body, walking its nested multipart parts. It returns nil if
+// the body forwards no mail.
+func forwardedMessage(contentType string, body []byte) (*mail.Message, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil
+	}
+	if mediaType == "message/rfc822" {
+		return mail.ReadMessage(bytes.NewReader(body))
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// quoted-printable parts are already decoded by the multipart reader.
+		content, err := io.ReadAll(transferDecoder(p, p.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return nil, err
+		}
+		if msg, err := forwardedMessage(p.Header.Get("Content-Type"), content); msg != nil || err != nil {
+			return msg, err
+		}
+	}
+}
+
+// decodeForwarded returns the headers and the text of a forwarded mail.
+func (e *Executor) decodeForwarded(msg *mail.Message) (*Forwarded, error) {
+	fwd := &Forwarded{
+		Date:      strings.TrimSpace(msg.Header.Get("Date")),
+		MessageID: strings.TrimSpace(msg.Header.Get("Message-Id")),
+	}
+	var err error
+	if fwd.Subject, err = decodeHeader(msg, "Subject"); err != nil {
+		return nil, fmt.Errorf("Cannot decode Subject header: %s", err)
+	}
+	if fwd.From, err = decodeHeader(msg, "From"); err != nil {
+		return nil, fmt.Errorf("Cannot decode From header: %s", err)
+	}
+	if fwd.To, err = decodeHeader(msg, "To"); err != nil {
+		return nil, fmt.Errorf("Cannot decode To header: %s", err)
+	}
+	content, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := textParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), content)
+	if err != nil {
+		return nil, err
+	}
+	fwd.Body = e.joinBody(parts)
+	return fwd, nil
+}
+
+func (e *Executor) extract(ctx context.Context, rsp imap.Response) (*Mail, error) {
 	tm := &Mail{}
 
-	header := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.HEADER"])
+	header, body := messageData(rsp.MessageInfo().Attrs)
 	tm.UID = imap.AsNumber((rsp.MessageInfo().Attrs["UID"]))
-	body := imap.AsBytes(rsp.MessageInfo().Attrs["RFC822.TEXT"])
+	// partial is set when the body may be cut by BodyMaxFetch, the content
+	// decoded until the cut is kept.
+	partial := false
+	if e.BodyMaxFetch > 0 && len(body) >= e.BodyMaxFetch {
+		if len(body) > e.BodyMaxFetch {
+			venom.Debug(ctx, "Partial fetch not honored, body of message %d truncated to %d bytes", tm.UID, e.BodyMaxFetch)
+			body = body[:e.BodyMaxFetch]
+		}
+		partial = true
+	}
+	tm.GmailLabels = decodeGmailLabels(rsp.MessageInfo().Attrs["X-GM-LABELS"])
+	if thrid, ok := rsp.MessageInfo().Attrs["X-GM-THRID"]; ok {
+		// The thread ID is a 64-bit number, kept as an atom when it does not
+		// fit in an uint32.
+		tm.ThreadID = fmt.Sprint(thrid)
+	}
+	tm.Envelope = decodeEnvelope(rsp.MessageInfo().Attrs["ENVELOPE"])
+	if e.FetchBodyPart != "" {
+		part, err := bodyPart(rsp.MessageInfo().Attrs, e.FetchBodyPart)
+		if err != nil {
+			return nil, fmt.Errorf("Error while reading body part %s:%s", e.FetchBodyPart, err)
+		}
+		tm.BodyPart = part
+	}
+	tm.InternalDate = rsp.MessageInfo().InternalDate
+	tm.Size = rsp.MessageInfo().Size
 
 	mmsg, err := mail.ReadMessage(bytes.NewReader(header))
 	if err != nil {
@@ -47,17 +629,94 @@ func extract(ctx context.Context, rsp imap.Response) (*Mail, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Cannot decode To header: %s", err)
 	}
+	tm.Cc, err = decodeHeader(mmsg, "Cc")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode Cc header: %s", err)
+	}
+	tm.Bcc, err = decodeHeader(mmsg, "Bcc")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode Bcc header: %s", err)
+	}
+	tm.MessageID = strings.TrimSpace(mmsg.Header.Get("Message-Id"))
+	if date, err := mmsg.Header.Date(); err == nil {
+		tm.Date = date
+	}
+	tm.RecipientCount = countRecipients(ctx, mmsg, "To", "Cc")
+	tm.AuthResults = parseAuthResults(mmsg.Header, e.TrustedAuthServ)
+	tm.Priority = parsePriority(mmsg.Header)
+	tm.SpamScore = parseSpamScore(mmsg.Header)
+	tm.DKIMSignatures = parseDKIMSignatures(mmsg.Header)
+	if len(body) > 0 {
+		parts, err := textParts(mmsg.Header.Get("Content-Type"), mmsg.Header.Get("Content-Transfer-Encoding"), body)
+		if err != nil && !partial {
+			return nil, fmt.Errorf("Error while reading text parts:%s", err)
+		}
+		tm.BodyText = e.joinBody(parts)
+	}
+	if len(body) > 0 && e.RenderHTML {
+		parts, err := htmlParts(mmsg.Header.Get("Content-Type"), mmsg.Header.Get("Content-Transfer-Encoding"), body)
+		if err != nil && !partial {
+			return nil, fmt.Errorf("Error while reading HTML parts:%s", err)
+		}
+		rendered := make([]string, 0, len(parts))
+		for _, part := range parts {
+			text, err := renderHTML(part)
+			if err != nil {
+				return nil, fmt.Errorf("Error while rendering HTML part:%s", err)
+			}
+			rendered = append(rendered, text)
+		}
+		tm.BodyRendered = e.joinBody(rendered)
+	}
+	if len(body) > 0 {
+		tm.MIMEParts, err = mimeParts(mmsg.Header.Get("Content-Type"), body)
+		if err != nil && !partial && e.SearchMIMEPart != "" {
+			return nil, fmt.Errorf("Error while reading MIME parts:%s", err)
+		}
+	}
+	if e.searchAttachments() || e.IncludeInline || e.ReturnAttachments {
+		ac := attachmentContent{keep: e.ReturnAttachments, maxSize: e.MaxAttachmentSize}
+		attachments, err := mailAttachments(mmsg.Header.Get("Content-Type"), body, ac)
+		if err != nil && !partial {
+			return nil, fmt.Errorf("Error while reading attachments:%s", err)
+		}
+		for _, a := range attachments {
+			if a.inline {
+				if !e.IncludeInline {
+					continue
+				}
+				tm.InlineParts = append(tm.InlineParts, a.name)
+			}
+			if a.name != "" {
+				tm.Attachments = append(tm.Attachments, a.name)
+			}
+			tm.AttachmentTypes = append(tm.AttachmentTypes, a.mediaType)
+			if e.ReturnAttachments {
+				tm.AttachmentContents = append(tm.AttachmentContents, Attachment{
+					Name:      a.name,
+					Type:      a.mediaType,
+					Size:      a.size,
+					Content:   string(a.content),
+					Truncated: a.truncated,
+				})
+			}
+		}
+	}
 
-	encoding := mmsg.Header.Get("Content-Transfer-Encoding")
-	var r io.Reader = bytes.NewReader(body)
-	switch encoding {
-	case "7bit", "8bit", "binary":
-		// noop, reader already initialized.
-	case "quoted-printable":
-		r = quotedprintable.NewReader(r)
-	case "base64":
-		r = base64.NewDecoder(base64.StdEncoding, r)
+	if len(body) > 0 && e.followForwarded() {
+		fwd, err := forwardedMessage(mmsg.Header.Get("Content-Type"), body)
+		if err != nil && !partial {
+			return nil, fmt.Errorf("Error while reading forwarded mail:%s", err)
+		}
+		if fwd != nil {
+			if tm.Forwarded, err = e.decodeForwarded(fwd); err != nil {
+				return nil, fmt.Errorf("Error while reading forwarded mail:%s", err)
+			}
+		}
 	}
+
+	encoding := mmsg.Header.Get("Content-Transfer-Encoding")
+	r := transferDecoder(bytes.NewReader(body), encoding)
 	venom.Debug(ctx, "Mail Content-Transfer-Encoding is %s ", encoding)
 
 	contentType, params, err := mime.ParseMediaType(mmsg.Header.Get("Content-Type"))
@@ -87,7 +746,7 @@ func extract(ctx context.Context, rsp imap.Response) (*Mail, error) {
 		}
 	} else {
 		body, err = io.ReadAll(r)
-		if err != nil {
+		if err != nil && !partial {
 			return nil, err
 		}
 	}
@@ -0,0 +1,174 @@
+package imap
+
+import (
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yesnault/go-imap/imap"
+)
+
+func TestParseAuthResults(t *testing.T) {
+	header := mail.Header{"Authentication-Results": {
+		"mx.google.com; dkim=pass header.i=@example.org header.s=s1; spf=pass (google.com: domain of a@example.org designates 1.2.3.4 as permitted sender; ok) smtp.mailfrom=a@example.org; dmarc=pass (p=NONE sp=NONE dis=NONE) header.from=example.org",
+		"relay.example.net 1; spf=fail smtp.mailfrom=example.org; dkim=none",
+	}}
+	// A header added by the sender, claiming results for the trusted server.
+	forged := mail.Header{"Authentication-Results": {
+		"mx.example.org; spf=fail smtp.mailfrom=example.org; dkim=fail",
+		"mx.attacker.example; spf=pass smtp.mailfrom=example.org; dkim=pass; dmarc=pass",
+	}}
+
+	tests := []struct {
+		name       string
+		header     mail.Header
+		authServID string
+		want       map[string]string
+	}{
+		{name: "topmost", header: header, want: map[string]string{"dkim": "pass", "spf": "pass", "dmarc": "pass"}},
+		{name: "trusted", header: header, authServID: "RELAY.example.net", want: map[string]string{"dkim": "none", "spf": "fail"}},
+		{name: "unknown authserv-id", header: header, authServID: "unknown.example.com"},
+		{name: "no header", header: mail.Header{}},
+		{name: "forged header ignored", header: forged, authServID: "mx.example.org", want: map[string]string{"dkim": "fail", "spf": "fail"}},
+		{name: "only a forged header", header: mail.Header{"Authentication-Results": forged["Authentication-Results"][1:]}, authServID: "mx.example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, parseAuthResults(tt.header, tt.authServID))
+		})
+	}
+}
+
+func TestParseDKIMSignatures(t *testing.T) {
+	header := mail.Header{"Dkim-Signature": {
+		"v=1; a=rsa-sha256; c=relaxed/relaxed; d=Example.org; s=mail2024;\r\n\th=from:to:subject; bh=abc=; b=def=",
+		"v=1; a=ed25519-sha256; d=esp.example.net; s=es\r\n pm1; b=ghi",
+		"v=1; a=rsa-sha256; b=broken",
+	}}
+
+	require.Equal(t, []DKIMSignature{
+		{Domain: "example.org", Selector: "mail2024"},
+		{Domain: "esp.example.net", Selector: "espm1"},
+		{},
+	}, parseDKIMSignatures(header))
+	require.Nil(t, parseDKIMSignatures(mail.Header{}))
+}
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		header mail.Header
+		want   string
+	}{
+		{header: mail.Header{}, want: "normal"},
+		{header: mail.Header{"X-Priority": {"1 (Highest)"}}, want: "high"},
+		{header: mail.Header{"X-Priority": {"2"}}, want: "high"},
+		{header: mail.Header{"X-Priority": {"3 (Normal)"}}, want: "normal"},
+		{header: mail.Header{"X-Priority": {"5 (Lowest)"}}, want: "low"},
+		{header: mail.Header{"Importance": {"High"}}, want: "high"},
+		{header: mail.Header{"Importance": {"low"}}, want: "low"},
+		{header: mail.Header{"X-Priority": {"4"}, "Importance": {"high"}}, want: "low"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, parsePriority(tt.header), "%v", tt.header)
+	}
+}
+
+func TestParseSpamScore(t *testing.T) {
+	tests := []struct {
+		header mail.Header
+		want   string
+	}{
+		{header: mail.Header{}, want: "none"},
+		{header: mail.Header{"X-Spam-Status": {"No, score=1.2 required=5.0 tests=DKIM_SIGNED,SPF_PASS autolearn=ham"}}, want: "1.2"},
+		{header: mail.Header{"X-Spam-Status": {"Yes, score=12 required=5.0"}}, want: "12"},
+		{header: mail.Header{"X-Spam-Status": {"No, hits=-0.1 required=5.0"}}, want: "-0.1"},
+		{header: mail.Header{"X-Spam-Score": {"3.50 / 15.00"}}, want: "3.5"},
+		{header: mail.Header{"X-Spam-Status": {"No, score=2.0"}, "X-Spam-Score": {"20"}}, want: "2"},
+		{header: mail.Header{"X-Spam-Score": {"++"}}, want: "none"},
+	}
+	for _, tt := range tests {
+		got := "none"
+		if score := parseSpamScore(tt.header); score != nil {
+			got = strconv.FormatFloat(*score, 'g', -1, 64)
+		}
+		require.Equal(t, tt.want, got, "%v", tt.header)
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	envelope := []imap.Field{
+		`"Mon, 7 Feb 1994 21:52:25 -0800"`, `"=?utf-8?q?Caf=C3=A9?="`,
+		[]imap.Field{[]imap.Field{`"Shop"`, nil, `"shop"`, `"example.org"`}},
+		nil, nil,
+		[]imap.Field{[]imap.Field{nil, nil, `"a"`, `"example.com"`}, []imap.Field{nil, nil, `"b"`, `"example.com"`}},
+		nil, nil, nil, `"<42@example.org>"`,
+	}
+	require.Equal(t, &Envelope{
+		Date:      "Mon, 7 Feb 1994 21:52:25 -0800",
+		Subject:   "Café",
+		From:      []string{"Shop <shop@example.org>"},
+		To:        []string{"a@example.com", "b@example.com"},
+		MessageID: "<42@example.org>",
+	}, decodeEnvelope(envelope))
+	require.Nil(t, decodeEnvelope(nil))
+
+	// Subject folded across three lines, as sent by some servers.
+	envelope[1] = imap.NewLiteral([]byte("Your order 42 of the\r\n\tnew espresso machine has been\r\n =?utf-8?q?exp=C3=A9di=C3=A9e?= today"))
+	require.Equal(t, "Your order 42 of the new espresso machine has been expédiée today", decodeEnvelope(envelope).Subject)
+}
+
+func TestTextParts(t *testing.T) {
+	body := strings.ReplaceAll(`--digest
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Caf=C3=A9 news
+--digest
+Content-Type: multipart/alternative; boundary="alt"
+
+--alt
+Content-Type: text/plain
+Content-Transfer-Encoding: base64
+
+T3JkZXIgNDI=
+--alt
+Content-Type: text/html
+
+<p>Order 42</p>
+--alt--
+--digest
+Content-Type: text/plain
+Content-Disposition: attachment; filename="notes.txt"
+
+Attached notes
+--digest
+Content-Type: message/rfc822
+
+From: a@example.org
+Subject: Fwd
+Content-Type: text/plain
+
+Forwarded text
+--digest--
+`, "\n", "\r\n")
+
+	parts, err := textParts(`multipart/mixed; boundary="digest"`, "", []byte(body))
+	require.NoError(t, err)
+	require.Equal(t, []string{"Café news", "Order 42", "Forwarded text"}, parts)
+
+	tests := []struct {
+		bodyJoin string
+		want     string
+	}{
+		{bodyJoin: "", want: "Café news\nOrder 42\nForwarded text"},
+		{bodyJoin: "first", want: "Café news"},
+		{bodyJoin: "LAST", want: "Forwarded text"},
+	}
+	for _, tt := range tests {
+		e := Executor{BodyJoin: tt.bodyJoin}
+		require.Equal(t, tt.want, e.joinBody(parts))
+	}
+	require.Empty(t, (&Executor{}).joinBody(nil))
+}
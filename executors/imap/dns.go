@@ -0,0 +1,81 @@
+package imap
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ovh/venom"
+)
+
+// dnsResolver resolves the domain of the From address, with validatefromdns.
+type dnsResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// resolver resolves the domain of the From address, it is replaced in tests.
+var resolver dnsResolver = net.DefaultResolver
+
+// validateFromDNS returns whether the domain of the From header from
+// resolves, to an MX record or else to an address, and whether it has an MX
+// record. A malformed address, or a domain with a null MX, is not valid. An
+// error is only returned if the lookup itself failed, such as a timeout.
+func validateFromDNS(ctx context.Context, from string) (bool, bool, error) {
+	domain := fromDomain(from)
+	if domain == "" {
+		venom.Debug(ctx, "No domain to resolve in From %q", from)
+		return false, false, nil
+	}
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return false, false, errors.Wrapf(err, "unable to resolve the MX records of %s", domain)
+	}
+	// A null MX (RFC 7505) states that the domain accepts no mail, its
+	// addresses are not looked up.
+	if len(mxs) == 1 && strings.Trim(mxs[0].Host, ".") == "" {
+		venom.Debug(ctx, "From domain %s has a null MX record, it accepts no mail", domain)
+		return false, false, nil
+	}
+	if len(mxs) > 0 {
+		venom.Debug(ctx, "From domain %s has %d MX records", domain, len(mxs))
+		return true, true, nil
+	}
+
+	hosts, err := resolver.LookupHost(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return false, false, errors.Wrapf(err, "unable to resolve %s", domain)
+	}
+	venom.Debug(ctx, "From domain %s has no MX record, %d addresses", domain, len(hosts))
+	return len(hosts) > 0, false, nil
+}
+
+// fromDomain returns the domain of the first address of the From header
+// from, "" if there is none.
+func fromDomain(from string) string {
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	i := strings.LastIndex(addrs[0].Address, "@")
+	if i < 0 {
+		return ""
+	}
+	domain := strings.ToLower(addrs[0].Address[i+1:])
+	// Domain literals, as [192.0.2.1], are not resolved.
+	if domain == "" || strings.HasPrefix(domain, "[") {
+		return ""
+	}
+	return domain
+}
+
+// isNotFound returns true if err is a DNS error stating that the domain or
+// the record does not exist.
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,107 @@
+package imap
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ovh/venom"
+)
+
+// testResolver resolves the domains of its maps, the other ones do not
+// exist.
+type testResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error
+}
+
+func (r testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func setTestResolver(t *testing.T, r testResolver) {
+	previous := resolver
+	resolver = r
+	t.Cleanup(func() { resolver = previous })
+}
+
+func TestValidateFromDNS(t *testing.T) {
+	venom.InitTestLogger(t)
+	setTestResolver(t, testResolver{
+		mx: map[string][]*net.MX{
+			"example.org":    {{Host: "mx.example.org.", Pref: 10}},
+			"nullmx.example": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"example.net":    {"192.0.2.1"},
+			"nullmx.example": {"192.0.2.2"},
+		},
+	})
+	tests := []struct {
+		from      string
+		wantValid bool
+		wantMX    bool
+	}{
+		{from: "Shop <shop@example.org>", wantValid: true, wantMX: true},
+		{from: "news@EXAMPLE.org", wantValid: true, wantMX: true},
+		{from: "news@example.net", wantValid: true},
+		// The address of the domain does not count.
+		{from: "no-reply@nullmx.example"},
+		{from: "spoof@unknown.example"},
+		{from: "Shop <shop@>"},
+		{from: "not an address"},
+		{from: "root@[192.0.2.1]"},
+		{from: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from, func(t *testing.T) {
+			valid, mx, err := validateFromDNS(context.Background(), tt.from)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantValid, valid)
+			require.Equal(t, tt.wantMX, mx)
+		})
+	}
+
+	setTestResolver(t, testResolver{err: &net.DNSError{Err: "i/o timeout", Name: "example.org", IsTimeout: true}})
+	_, _, err := validateFromDNS(context.Background(), "shop@example.org")
+	require.EqualError(t, err, "unable to resolve the MX records of example.org: lookup example.org: i/o timeout")
+}
+
+func TestExecutor_Run_ValidateFromDNS(t *testing.T) {
+	setTestResolver(t, testResolver{mx: map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}}})
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject":   "Order",
+		"validatefromdns": true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.True(t, result.FromDomainValid)
+	require.True(t, result.FromDomainMX)
+
+	step["searchsubject"] = "newsletter"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.False(t, result.FromDomainValid)
+}
@@ -0,0 +1,143 @@
+package imap
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// renderHTML converts an HTML body to the plain text a user reads: the tags
+// are stripped, the entities decoded and the whitespaces collapsed, the
+// blocks start on a new line and the links are kept as `text (url)`.
+func renderHTML(body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r := &htmlRenderer{}
+	r.render(doc)
+	return r.String(), nil
+}
+
+// htmlRenderer writes the text of HTML nodes.
+type htmlRenderer struct {
+	b strings.Builder
+	// newlines is the number of newlines ending b, space is set when a
+	// whitespace separates the next text from b.
+	newlines int
+	space    bool
+}
+
+func (r *htmlRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		r.children(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template:
+	case atom.Br:
+		r.lineBreak(1)
+	case atom.A:
+		r.link(n)
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			r.text(alt)
+		}
+	case atom.Li:
+		r.lineBreak(1)
+		r.text("- ")
+		r.children(n)
+		r.lineBreak(1)
+	case atom.Td, atom.Th:
+		r.space = true
+		r.children(n)
+		r.space = true
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Ul, atom.Ol, atom.Blockquote, atom.Pre, atom.Hr:
+		r.lineBreak(2)
+		r.children(n)
+		r.lineBreak(2)
+	case atom.Div, atom.Tr, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Dt, atom.Dd:
+		r.lineBreak(1)
+		r.children(n)
+		r.lineBreak(1)
+	default:
+		r.children(n)
+	}
+}
+
+func (r *htmlRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+// link writes the text of an anchor followed by its URL, unless the text is
+// already the URL.
+func (r *htmlRenderer) link(n *html.Node) {
+	inner := &htmlRenderer{}
+	inner.children(n)
+	text := strings.Join(strings.Fields(inner.String()), " ")
+	href := strings.TrimSpace(attr(n, "href"))
+	r.text(text)
+	if href == "" || strings.HasPrefix(href, "#") || href == text || strings.TrimPrefix(href, "mailto:") == text {
+		return
+	}
+	if text == "" {
+		r.text(href)
+		return
+	}
+	r.text(" (" + href + ")")
+}
+
+// text writes a text, its whitespaces collapsed, non-breaking spaces
+// included.
+func (r *htmlRenderer) text(s string) {
+	if s == "" {
+		return
+	}
+	if strings.TrimLeftFunc(s, unicode.IsSpace) != s {
+		r.space = true
+	}
+	for _, word := range strings.Fields(s) {
+		if r.space && r.newlines == 0 && r.b.Len() > 0 {
+			r.b.WriteByte(' ')
+		}
+		r.b.WriteString(word)
+		r.newlines = 0
+		r.space = true
+	}
+	r.space = strings.TrimRightFunc(s, unicode.IsSpace) != s
+}
+
+// lineBreak ends the current line, followed by empty lines up to n-1.
+func (r *htmlRenderer) lineBreak(n int) {
+	if r.b.Len() == 0 {
+		return
+	}
+	for ; r.newlines < n; r.newlines++ {
+		r.b.WriteByte('\n')
+	}
+	r.space = false
+}
+
+func (r *htmlRenderer) String() string {
+	return strings.TrimSpace(r.b.String())
+}
+
+// attr returns the value of the attribute key of n.
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
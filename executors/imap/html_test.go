@@ -0,0 +1,38 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{name: "text", html: "Hello <b>world</b>", want: "Hello world"},
+		{name: "whitespaces", html: "<p>\n  Your   order\n\t42 </p>", want: "Your order 42"},
+		{name: "entities", html: "<p>Caf&eacute; &amp; th&#233; &lt;3</p>", want: "Café & thé <3"},
+		{name: "paragraphs", html: "<h1>Invoice</h1><p>Line 1<br>Line 2</p><p>Thanks</p>", want: "Invoice\n\nLine 1\nLine 2\n\nThanks"},
+		{name: "divs", html: "<div>First</div><div>Second</div>", want: "First\nSecond"},
+		{name: "list", html: "<ul><li>Espresso</li><li>Milk</li></ul>", want: "- Espresso\n- Milk"},
+		{name: "table", html: "<table><tr><td>Total</td><td>42 EUR</td></tr><tr><td>VAT</td><td>7 EUR</td></tr></table>", want: "Total 42 EUR\nVAT 7 EUR"},
+		{name: "link", html: `<p>See <a href="https://shop.example.org/orders/42">your <b>order</b></a>.</p>`, want: "See your order (https://shop.example.org/orders/42)."},
+		{name: "link to itself", html: `<a href="https://shop.example.org">https://shop.example.org</a>`, want: "https://shop.example.org"},
+		{name: "mailto", html: `<a href="mailto:help@example.org">help@example.org</a>`, want: "help@example.org"},
+		{name: "anchor", html: `<a href="#top">Top</a>`, want: "Top"},
+		{name: "image link", html: `<a href="https://shop.example.org"><img src="logo.png"></a>`, want: "https://shop.example.org"},
+		{name: "image alt", html: `<img src="logo.png" alt="Shop"> news`, want: "Shop news"},
+		{name: "hidden", html: "<html><head><title>Mail</title><style>p {color: red}</style></head><body><script>alert(1)</script><p>Visible</p></body></html>", want: "Visible"},
+		{name: "empty", html: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderHTML(tt.html)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -2,14 +2,28 @@ package imap
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
+	"net"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"github.com/yesnault/go-imap/imap"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/ovh/venom"
 )
@@ -17,261 +31,2743 @@ import (
 // Name for test imap
 const Name = "imap"
 
+// imapLogMask is the log mask of the connections without debugprotocol and
+// protocollog, for the whole session: it must not include imap.LogRaw, which
+// would log the credentials.
 var imapLogMask = imap.LogNone
-var imapSafeLogMask = imap.LogNone
+
+// Default polling parameters of waitforcount.
+const (
+	defaultWaitForTimeout = 60 * time.Second
+	defaultWaitForDelay   = time.Second
+)
+
+// defaultDialTimeout bounds the connection to the server, up to its greeting,
+// without imapdialtimeout.
+const defaultDialTimeout = 30 * time.Second
+
+// Attempts and initial backoff of a refused SELECT, the backoff is doubled
+// after each attempt.
+const selectAttempts = 3
+
+var selectBackoff = 500 * time.Millisecond
+
+// Attempts and initial backoff of a search failing with one of retryoncodes,
+// without maxwait. The backoff is doubled after each attempt.
+const retryAttempts = 3
+
+var retryBackoff = time.Second
+
+// Initial and maximum backoff between two searches of the mail with maxwait,
+// the backoff is doubled after each search.
+var (
+	pollBackoff    = time.Second
+	pollMaxBackoff = 30 * time.Second
+)
+
+var (
+	errMailNotFound = errors.New("Mail not found")
+	errNoMessage    = errors.New("No message to fetch")
+)
+
+// Error codes of result.errcode.
+const (
+	// errCodeSearch is set when the mail could not be searched.
+	errCodeSearch = "search"
+	// errCodeAction is set when the action on a matched mail failed, the mail
+	// is returned anyway.
+	errCodeAction = "action"
+	// errCodeWaitTimeout is set when the mail was not found within maxwait.
+	errCodeWaitTimeout = "waittimeout"
+	// errCodeFromDNS is set when the domain of the found mail could not be
+	// resolved, with validatefromdns.
+	errCodeFromDNS = "fromdns"
+	// errCodeNotEmpty is set when the mbox is not empty, with expectempty.
+	errCodeNotEmpty = "notempty"
+	// errCodeNo and errCodeBad are set when the server refused a command
+	// (NO) or rejected it as a protocol error (BAD), without response code.
+	errCodeNo  = "no"
+	errCodeBad = "bad"
+	// errCodeExpectError is set when the step succeeded although an error
+	// was expected with expecterror.
+	errCodeExpectError = "expecterror"
+)
+
+// actionError is returned when deleting or moving a matched mail failed.
+type actionError struct {
+	error
+}
+
+// errCode returns the result.errcode of err.
+func errCode(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case actionError:
+		return errCodeAction
+	case waitTimeoutError:
+		return errCodeWaitTimeout
+	case notEmptyError:
+		return errCodeNotEmpty
+	case commandError:
+		if cause.rsp.Label != "" {
+			return cause.rsp.Label
+		}
+		switch cause.rsp.Status {
+		case imap.NO:
+			return errCodeNo
+		case imap.BAD:
+			return errCodeBad
+		}
+	}
+	return errCodeSearch
+}
+
+// waitTimeoutError is returned when the mail was not found within maxwait.
+type waitTimeoutError struct {
+	maxWait  time.Duration
+	searches int
+}
+
+func (err waitTimeoutError) Error() string {
+	return fmt.Sprintf("Mail not found after %s (%d searches)", err.maxWait, err.searches)
+}
+
+// notEmptyError is returned when the mbox is not empty, with expectempty.
+type notEmptyError struct {
+	box   string
+	count uint32
+}
+
+func (err notEmptyError) Error() string {
+	return fmt.Sprintf("mailbox %s expected empty but has %d messages", err.box, err.count)
+}
+
+// commandError is returned by check when the server did not complete a
+// command with OK. It keeps the tagged server response, whose text and
+// response code (e.g. [AUTHENTICATIONFAILED]) are usually more helpful than
+// a generic message.
+type commandError struct {
+	name string
+	rsp  *imap.Response
+}
+
+func (err commandError) Error() string {
+	text := string(err.rsp.Raw)
+	if i := strings.IndexByte(text, ' '); i >= 0 && err.rsp.Tag != "" {
+		text = text[i+1:]
+	}
+	return fmt.Sprintf("%s failed: %s", err.name, strings.TrimSpace(text))
+}
+
+// isRetryable reports whether the command failed with err may succeed later:
+// the server refused a SELECT (NO) with a transient reason, or any command
+// with one of the response codes of RetryOnCodes. A protocol error (BAD) is
+// otherwise never retried, the same command would fail again. A failed login
+// is never retried, not to lock the account.
+func (e *Executor) isRetryable(err error) bool {
+	cerr, ok := errors.Cause(err).(commandError)
+	if ok && (cerr.name == "LOGIN" || cerr.name == "AUTHENTICATE") {
+		return false
+	}
+	if e.retryOnCode(err) {
+		return true
+	}
+	return ok && cerr.name == "SELECT" && cerr.rsp.Status == imap.NO && isTransient(cerr.rsp)
+}
+
+// retryOnCode reports whether the command failed with err has one of the
+// response codes of RetryOnCodes.
+func (e *Executor) retryOnCode(err error) bool {
+	code := responseCode(err)
+	if code == "" {
+		return false
+	}
+	for _, c := range e.RetryOnCodes {
+		if strings.EqualFold(strings.Trim(c, "[] "), code) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseCode returns the response code of the server response failing a
+// command with err, as INUSE for `NO [INUSE] Mailbox in use`.
+func responseCode(err error) string {
+	switch cause := errors.Cause(err).(type) {
+	case commandError:
+		return cause.rsp.Label
+	case imap.ResponseError:
+		if cause.Response != nil {
+			return cause.Label
+		}
+	}
+	return ""
+}
+
+// TLS modes of result.tlsmode.
+const (
+	tlsModeDirect   = "direct"
+	tlsModeSTARTTLS = "starttls"
+	// tlsModePlaintext is a connection left unencrypted, with imapwithtls false
+	// and a server not advertising STARTTLS.
+	tlsModePlaintext = "plaintext"
+)
+
+// Actions on the found mail of result.actiontaken.
+const (
+	actionTakenNone    = "none"
+	actionTakenMoved   = "moved"
+	actionTakenDeleted = "deleted"
+)
+
+// Authentication mechanisms of result.authmechanism.
+const (
+	authMechanismLogin   = "LOGIN"
+	authMechanismXOAuth2 = "XOAUTH2"
+	// authMechanismPreauth is when the server greets the connection as
+	// already authenticated, without any command.
+	authMechanismPreauth = "PREAUTH"
+)
+
+// Values of imapauthmethod.
+const (
+	authMethodPassword = "password"
+	authMethodXOAuth2  = "xoauth2"
+)
+
+// maxConnectionsEnv is the environment variable bounding the number of
+// simultaneous connections, when maxconcurrentconnections is not set.
+const maxConnectionsEnv = "VENOM_IMAP_MAX_CONCURRENT_CONNECTIONS"
+
+// connections bounds the number of simultaneous connections of all the steps
+// of the run. It is sized by the first step setting a limit.
+var connections struct {
+	sync.Mutex
+	slots chan struct{}
+}
+
+// matchTimeoutUnit is the unit of matchtimeout, it is shortened in tests.
+var matchTimeoutUnit = time.Second
+
+// matchElapsed measures the matching of a mail against the search criteria,
+// it is replaced in tests.
+var matchElapsed = time.Since
+
+// dial opens the connection to addr, secured with config unless nil. The TCP
+// connection and the greeting of the server are each bounded by timeout.
+func dial(addr string, config *tls.Config, timeout time.Duration, l *protocolLog) (*imap.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, addr, config, timeout, l)
+}
+
+// clientLogMu guards imap.DefaultLogger and imap.DefaultLogMask, which
+// imap.NewClient reads for the log of the connection. They can't be set on
+// the client afterwards, its receiver reads them unguarded.
+var clientLogMu sync.Mutex
+
+// newClient starts the session on conn to addr, secured with config unless
+// nil, waiting for the greeting of the server within timeout. The session is
+// logged to l.
+func newClient(conn net.Conn, addr string, config *tls.Config, timeout time.Duration, l *protocolLog) (*imap.Client, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	logger, mask := l.logger()
+	clientLogMu.Lock()
+	prevLogger, prevMask := imap.DefaultLogger, imap.DefaultLogMask
+	imap.DefaultLogger, imap.DefaultLogMask = logger, mask
+	var once sync.Once
+	release := func() {
+		imap.DefaultLogger, imap.DefaultLogMask = prevLogger, prevMask
+		clientLogMu.Unlock()
+	}
+	defer once.Do(release)
+	// The defaults are read before the first use of conn, they are restored
+	// then not to hold the lock during the greeting.
+	conn = logDefaultsConn{Conn: conn, once: &once, release: release}
+	if config != nil {
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = host
+		}
+		conn = tls.Client(conn, config)
+	}
+	c, err := imap.NewClient(conn, host, timeout)
+	if err != nil {
+		conn.Close() // nolint
+		return nil, err
+	}
+	return c, nil
+}
+
+// logDefaultsConn calls release on the first read or write of the connection.
+type logDefaultsConn struct {
+	net.Conn
+	once    *sync.Once
+	release func()
+}
+
+func (c logDefaultsConn) Read(b []byte) (int, error) {
+	c.once.Do(c.release)
+	return c.Conn.Read(b)
+}
+
+func (c logDefaultsConn) Write(b []byte) (int, error) {
+	c.once.Do(c.release)
+	return c.Conn.Write(b)
+}
 
 // New returns a new Test Exec
 func New() venom.Executor {
 	return &Executor{}
 }
 
-// Executor represents a Test Exec
-type Executor struct {
-	IMAPHost        string `json:"imaphost,omitempty" yaml:"imaphost,omitempty"`
-	IMAPPort        string `json:"imapport,omitempty" yaml:"imapport,omitempty"`
-	IMAPUser        string `json:"imapuser,omitempty" yaml:"imapuser,omitempty"`
-	IMAPPassword    string `json:"imappassword,omitempty" yaml:"imappassword,omitempty"`
-	MBox            string `json:"mbox,omitempty" yaml:"mbox,omitempty"`
-	MBoxOnSuccess   string `json:"mboxonsuccess,omitempty" yaml:"mboxonsuccess,omitempty"`
-	DeleteOnSuccess bool   `json:"deleteonsuccess,omitempty" yaml:"deleteonsuccess,omitempty"`
-	SearchFrom      string `json:"searchfrom,omitempty" yaml:"searchfrom,omitempty"`
-	SearchTo        string `json:"searchto,omitempty" yaml:"searchto,omitempty"`
-	SearchSubject   string `json:"searchsubject,omitempty" yaml:"searchsubject,omitempty"`
-	SearchBody      string `json:"searchbody,omitempty" yaml:"searchbody,omitempty"`
-}
+// Executor represents a Test Exec
+type Executor struct {
+	IMAPURL                   string            `json:"imapurl,omitempty" yaml:"imapurl,omitempty"`
+	IMAPHost                  string            `json:"imaphost,omitempty" yaml:"imaphost,omitempty"`
+	IMAPPort                  string            `json:"imapport,omitempty" yaml:"imapport,omitempty"`
+	IMAPUser                  string            `json:"imapuser,omitempty" yaml:"imapuser,omitempty"`
+	IMAPPassword              string            `json:"imappassword,omitempty" yaml:"imappassword,omitempty"`
+	IMAPPasswordFile          string            `json:"imappasswordfile,omitempty" yaml:"imappasswordfile,omitempty"`
+	CredentialProvider        string            `json:"credentialprovider,omitempty" yaml:"credentialprovider,omitempty"`
+	IMAPAuthMethod            string            `json:"imapauthmethod,omitempty" yaml:"imapauthmethod,omitempty"`
+	IMAPAccessToken           string            `json:"imapaccesstoken,omitempty" yaml:"imapaccesstoken,omitempty"`
+	AllowAnonymous            bool              `json:"allowanonymous,omitempty" yaml:"allowanonymous,omitempty"`
+	TLSCACert                 string            `json:"tlscacert,omitempty" yaml:"tlscacert,omitempty"`
+	IMAPCACertFile            string            `json:"imapcacertfile,omitempty" yaml:"imapcacertfile,omitempty"`
+	IMAPClientCertFile        string            `json:"imapclientcertfile,omitempty" yaml:"imapclientcertfile,omitempty"`
+	IMAPClientKeyFile         string            `json:"imapclientkeyfile,omitempty" yaml:"imapclientkeyfile,omitempty"`
+	TLSCAOnly                 bool              `json:"tlscaonly,omitempty" yaml:"tlscaonly,omitempty"`
+	IMAPTLSInsecureSkipVerify bool              `json:"imaptlsinsecureskipverify,omitempty" yaml:"imaptlsinsecureskipverify,omitempty"`
+	TLSMode                   string            `json:"tlsmode,omitempty" yaml:"tlsmode,omitempty"`
+	IMAPWithTLS               *bool             `json:"imapwithtls,omitempty" yaml:"imapwithtls,omitempty"`
+	TLSCipherSuites           []string          `json:"tlsciphersuites,omitempty" yaml:"tlsciphersuites,omitempty"`
+	IMAPTLSMinVersion         string            `json:"imaptlsminversion,omitempty" yaml:"imaptlsminversion,omitempty"`
+	SSHTunnel                 *SSHTunnel        `json:"sshtunnel,omitempty" yaml:"sshtunnel,omitempty"`
+	IMAPDialTimeout           string            `json:"imapdialtimeout,omitempty" yaml:"imapdialtimeout,omitempty"`
+	RetryOnCodes              []string          `json:"retryoncodes,omitempty" yaml:"retryoncodes,omitempty"`
+	MBox                      string            `json:"mbox,omitempty" yaml:"mbox,omitempty"`
+	MBoxes                    []string          `json:"mboxes,omitempty" yaml:"mboxes,omitempty"`
+	MBoxOnSuccess             string            `json:"mboxonsuccess,omitempty" yaml:"mboxonsuccess,omitempty"`
+	DeleteOnSuccess           bool              `json:"deleteonsuccess,omitempty" yaml:"deleteonsuccess,omitempty"`
+	SearchFrom                string            `json:"searchfrom,omitempty" yaml:"searchfrom,omitempty"`
+	SearchTo                  string            `json:"searchto,omitempty" yaml:"searchto,omitempty"`
+	SearchRecipient           string            `json:"searchrecipient,omitempty" yaml:"searchrecipient,omitempty"`
+	SearchSubject             string            `json:"searchsubject,omitempty" yaml:"searchsubject,omitempty"`
+	SearchBody                string            `json:"searchbody,omitempty" yaml:"searchbody,omitempty"`
+	SearchAttachment          string            `json:"searchattachment,omitempty" yaml:"searchattachment,omitempty"`
+	ExcludeAttachment         string            `json:"excludeattachment,omitempty" yaml:"excludeattachment,omitempty"`
+	SearchAttachmentType      string            `json:"searchattachmenttype,omitempty" yaml:"searchattachmenttype,omitempty"`
+	SearchMIMEPart            string            `json:"searchmimepart,omitempty" yaml:"searchmimepart,omitempty"`
+	IncludeInline             bool              `json:"includeinline,omitempty" yaml:"includeinline,omitempty"`
+	GmailLabel                string            `json:"gmaillabel,omitempty" yaml:"gmaillabel,omitempty"`
+	SearchThreadID            string            `json:"searchthreadid,omitempty" yaml:"searchthreadid,omitempty"`
+	FetchItems                []string          `json:"fetchitems,omitempty" yaml:"fetchitems,omitempty"`
+	ReturnBody                bool              `json:"returnbody,omitempty" yaml:"returnbody,omitempty"`
+	FetchBodyPart             string            `json:"fetchbodypart,omitempty" yaml:"fetchbodypart,omitempty"`
+	RenderHTML                bool              `json:"renderhtml,omitempty" yaml:"renderhtml,omitempty"`
+	ExtractBody               string            `json:"extractbody,omitempty" yaml:"extractbody,omitempty"`
+	BodyJoin                  string            `json:"bodyjoin,omitempty" yaml:"bodyjoin,omitempty"`
+	NormalizeLineEndings      string            `json:"normalizelineendings,omitempty" yaml:"normalizelineendings,omitempty"`
+	SearchPriority            string            `json:"searchpriority,omitempty" yaml:"searchpriority,omitempty"`
+	SearchDKIMDomain          string            `json:"searchdkimdomain,omitempty" yaml:"searchdkimdomain,omitempty"`
+	SearchDKIMSelector        string            `json:"searchdkimselector,omitempty" yaml:"searchdkimselector,omitempty"`
+	FollowForwarded           bool              `json:"followforwarded,omitempty" yaml:"followforwarded,omitempty"`
+	SearchForwardedFrom       string            `json:"searchforwardedfrom,omitempty" yaml:"searchforwardedfrom,omitempty"`
+	SearchForwardedSubject    string            `json:"searchforwardedsubject,omitempty" yaml:"searchforwardedsubject,omitempty"`
+	SearchForwardedBody       string            `json:"searchforwardedbody,omitempty" yaml:"searchforwardedbody,omitempty"`
+	SortBy                    string            `json:"sortby,omitempty" yaml:"sortby,omitempty"`
+	Limit                     int               `json:"limit,omitempty" yaml:"limit,omitempty"`
+	CountMatches              bool              `json:"countmatches,omitempty" yaml:"countmatches,omitempty"`
+	StreamToDisk              bool              `json:"streamtodisk,omitempty" yaml:"streamtodisk,omitempty"`
+	BodyMaxFetch              int               `json:"bodymaxfetch,omitempty" yaml:"bodymaxfetch,omitempty"`
+	ClientID                  map[string]string `json:"clientid,omitempty" yaml:"clientid,omitempty"`
+	MinRecipients             int               `json:"minrecipients,omitempty" yaml:"minrecipients,omitempty"`
+	MaxRecipients             int               `json:"maxrecipients,omitempty" yaml:"maxrecipients,omitempty"`
+	MinSpamScore              *float64          `json:"minspamscore,omitempty" yaml:"minspamscore,omitempty"`
+	MaxSpamScore              *float64          `json:"maxspamscore,omitempty" yaml:"maxspamscore,omitempty"`
+	MinAttachments            int               `json:"minattachments,omitempty" yaml:"minattachments,omitempty"`
+	MaxAttachments            int               `json:"maxattachments,omitempty" yaml:"maxattachments,omitempty"`
+	ReturnAttachments         bool              `json:"returnattachments,omitempty" yaml:"returnattachments,omitempty"`
+	MaxAttachmentSize         int64             `json:"maxattachmentsize,omitempty" yaml:"maxattachmentsize,omitempty"`
+	SearchTimeOfDayFrom       string            `json:"searchtimeofdayfrom,omitempty" yaml:"searchtimeofdayfrom,omitempty"`
+	SearchTimeOfDayTo         string            `json:"searchtimeofdayto,omitempty" yaml:"searchtimeofdayto,omitempty"`
+	Timezone                  string            `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	Anchor                    bool              `json:"anchor,omitempty" yaml:"anchor,omitempty"`
+	MatchMode                 string            `json:"matchmode,omitempty" yaml:"matchmode,omitempty"`
+	FoldAccents               bool              `json:"foldaccents,omitempty" yaml:"foldaccents,omitempty"`
+	TrustedAuthServ           string            `json:"trustedauthserv,omitempty" yaml:"trustedauthserv,omitempty"`
+	MatchTimeout              int               `json:"matchtimeout,omitempty" yaml:"matchtimeout,omitempty"`
+	SearchSince               string            `json:"searchsince,omitempty" yaml:"searchsince,omitempty"`
+	SinceUID                  *uint32           `json:"sinceuid,omitempty" yaml:"sinceuid,omitempty"`
+	ExpectUIDNot              uint32            `json:"expectuidnot,omitempty" yaml:"expectuidnot,omitempty"`
+	WithThread                bool              `json:"withthread,omitempty" yaml:"withthread,omitempty"`
+	FirstUnseen               bool              `json:"firstunseen,omitempty" yaml:"firstunseen,omitempty"`
+	SeqNum                    int               `json:"seqnum,omitempty" yaml:"seqnum,omitempty"`
+	MaxReconnects             int               `json:"maxreconnects,omitempty" yaml:"maxreconnects,omitempty"`
+	KeepAliveInterval         int               `json:"keepaliveinterval,omitempty" yaml:"keepaliveinterval,omitempty"`
+	MaxConcurrentConnections  int               `json:"maxconcurrentconnections,omitempty" yaml:"maxconcurrentconnections,omitempty"`
+	WaitForCount              int               `json:"waitforcount,omitempty" yaml:"waitforcount,omitempty"`
+	WaitForTimeout            int               `json:"waitfortimeout,omitempty" yaml:"waitfortimeout,omitempty"`
+	WaitForDelay              int               `json:"waitfordelay,omitempty" yaml:"waitfordelay,omitempty"`
+	ExpectedCount             *int              `json:"expectedcount,omitempty" yaml:"expectedcount,omitempty"`
+	ExpectedModSeq            *uint64           `json:"expectedmodseq,omitempty" yaml:"expectedmodseq,omitempty"`
+	ExpectEmpty               bool              `json:"expectempty,omitempty" yaml:"expectempty,omitempty"`
+	ExpectError               string            `json:"expecterror,omitempty" yaml:"expecterror,omitempty"`
+	MaxWait                   int               `json:"maxwait,omitempty" yaml:"maxwait,omitempty"`
+	Action                    string            `json:"action,omitempty" yaml:"action,omitempty"`
+	ConfirmPurge              bool              `json:"confirmpurge,omitempty" yaml:"confirmpurge,omitempty"`
+	AllowPurgeInbox           bool              `json:"allowpurgeinbox,omitempty" yaml:"allowpurgeinbox,omitempty"`
+	TreeOutput                bool              `json:"treeoutput,omitempty" yaml:"treeoutput,omitempty"`
+	DebugProtocol             bool              `json:"debugprotocol,omitempty" yaml:"debugprotocol,omitempty"`
+	ProtocolLog               bool              `json:"protocollog,omitempty" yaml:"protocollog,omitempty"`
+	ValidateFromDNS           bool              `json:"validatefromdns,omitempty" yaml:"validatefromdns,omitempty"`
+
+	// alerts are the ALERT texts sent by the server.
+	alerts []string
+	// matchCount is the number of mails matching the search criteria, with
+	// CountMatches.
+	matchCount int
+	// scanned is the number of fetched mails searched, and matchIndex the
+	// position of the first matching one among them.
+	scanned    int
+	matchIndex int
+	// matchDuration is the time spent matching the mails against the
+	// search criteria, in all the mailboxes, bounded by MatchTimeout.
+	matchDuration time.Duration
+	// stepStart is when Run started, the time of searchsince teststart.
+	stepStart time.Time
+	// since is the time resolved from SearchSince.
+	since time.Time
+	// connTLSMode is how the last connection was secured, connTLSVersion
+	// and connTLSCipherSuite what its handshake negotiated.
+	connTLSMode        string
+	connTLSVersion     string
+	connTLSCipherSuite string
+	// connAuthMechanism is how the last connection was authenticated.
+	connAuthMechanism string
+	// dialTLS opens the connection to the server in tlsModeDirect, dial
+	// unless set. It is replaced in tests.
+	dialTLS func(addr string, config *tls.Config, timeout time.Duration, l *protocolLog) (*imap.Client, error)
+	// protocolLog receives the lines exchanged with the server, with
+	// DebugProtocol or ProtocolLog.
+	protocolLog *protocolLog
+	// connectDuration, selectDuration, fetchDuration and scanDuration are
+	// the time spent connecting, selecting the mailboxes, fetching the mails
+	// and matching them, for result.timings and the Metrics.
+	connectDuration time.Duration
+	selectDuration  time.Duration
+	fetchDuration   time.Duration
+	scanDuration    time.Duration
+	// spool keeps the fetched bodies on disk, with StreamToDisk.
+	spool *spool
+	// checkedCaps are the server capabilities checked during the step.
+	checkedCaps map[string]bool
+	// keepConn is set while pollMail keeps the connection open between the
+	// searches, with KeepAliveInterval, in kept.
+	keepConn bool
+	kept     *imap.Client
+}
+
+// Mail contains an analyzed mail
+type Mail struct {
+	From string
+	To   string
+	Cc   string
+	// Bcc is only in the mails whose sender kept it, as in its Sent mbox.
+	Bcc            string
+	RecipientCount int
+	Subject        string
+	Priority       string
+	// SpamScore is the score stamped by the spam filter, nil without
+	// X-Spam-Status nor X-Spam-Score header.
+	SpamScore *float64
+	MessageID string
+	// Date is the Date header, zero if it can't be parsed.
+	Date time.Time
+	// InternalDate is when the server received the mail, only fetched with
+	// SearchSince.
+	InternalDate time.Time
+	// Size is the RFC822.SIZE of the mail in bytes, only fetched with
+	// SinceUID.
+	Size uint32
+	UID  uint32
+	Body string
+	// BodyText are the text/plain parts of the body, joined according to
+	// BodyJoin.
+	BodyText string
+	// BodyRendered are the text/html parts of the body rendered as plain
+	// text, joined according to BodyJoin, with RenderHTML.
+	BodyRendered string
+	// BodyPart is the decoded content of the MIME part FetchBodyPart.
+	BodyPart    string
+	GmailLabels []string
+	ThreadID    string
+	// Attachments are the file names of the attachments, only extracted when
+	// searched.
+	Attachments []string
+	// AttachmentTypes are the media types of the attachments, named or not,
+	// only extracted when searched.
+	AttachmentTypes []string
+	// AttachmentContents are the decoded attachments, with
+	// ReturnAttachments.
+	AttachmentContents []Attachment
+	// InlineParts are the file names of the inline parts, only extracted
+	// with IncludeInline. They are also in Attachments.
+	InlineParts []string
+	// MIMEParts are the media types of the parts of the body, when it is
+	// fetched.
+	MIMEParts   []string
+	AuthResults map[string]string
+	// DKIMSignatures are the DKIM-Signature headers, topmost first.
+	DKIMSignatures []DKIMSignature
+	// Mailbox is the mbox where the mail was found.
+	Mailbox    string
+	MovedTo    string
+	MovedToUID uint32
+	// ActionTaken is the action run on the mail once found.
+	ActionTaken string
+	Envelope    *Envelope
+	// Forwarded is the mail forwarded as a message/rfc822 part, only
+	// extracted with FollowForwarded.
+	Forwarded *Forwarded
+	// Thread are the other mails of the conversation, only fetched with
+	// WithThread.
+	Thread []*Mail
+}
+
+// recipients returns the To, Cc and Bcc headers of m which are set.
+func (m *Mail) recipients() []string {
+	var recipients []string
+	for _, r := range []string{m.To, m.Cc, m.Bcc} {
+		if r != "" {
+			recipients = append(recipients, r)
+		}
+	}
+	return recipients
+}
+
+// Envelope contains the envelope of a mail, as returned by the server
+type Envelope struct {
+	Date      string   `json:"date,omitempty" yaml:"date,omitempty"`
+	Subject   string   `json:"subject,omitempty" yaml:"subject,omitempty"`
+	From      []string `json:"from,omitempty" yaml:"from,omitempty"`
+	To        []string `json:"to,omitempty" yaml:"to,omitempty"`
+	Cc        []string `json:"cc,omitempty" yaml:"cc,omitempty"`
+	MessageID string   `json:"messageid,omitempty" yaml:"messageId,omitempty"`
+}
+
+// DKIMSignature contains the signing domain and selector of a DKIM-Signature
+// header
+type DKIMSignature struct {
+	Domain   string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Selector string `json:"selector,omitempty" yaml:"selector,omitempty"`
+}
+
+// Attachment is a decoded attachment of a mail, with returnattachments.
+type Attachment struct {
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	Size int64  `json:"size" yaml:"size"`
+	// Content is empty when the attachment is larger than
+	// MaxAttachmentSize, Truncated is then set.
+	Content   string `json:"content,omitempty" yaml:"content,omitempty"`
+	Truncated bool   `json:"truncated,omitempty" yaml:"truncated,omitempty"`
+}
+
+// Forwarded contains a mail forwarded as a message/rfc822 part of a mail
+type Forwarded struct {
+	Date      string `json:"date,omitempty" yaml:"date,omitempty"`
+	Subject   string `json:"subject,omitempty" yaml:"subject,omitempty"`
+	From      string `json:"from,omitempty" yaml:"from,omitempty"`
+	To        string `json:"to,omitempty" yaml:"to,omitempty"`
+	MessageID string `json:"messageid,omitempty" yaml:"messageId,omitempty"`
+	// Body are the text/plain parts of the forwarded mail, joined according
+	// to BodyJoin.
+	Body string `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// ResultVersion is the version of the JSON shape of Result, in
+// result.version. It is increased when a field is renamed, removed or changes
+// of type, not when one is added.
+const ResultVersion = 1
+
+// Result represents a step result. Its JSON shape is checked against
+// testdata/result.json: all its fields but err and version are omitted when
+// empty.
+type Result struct {
+	Version         int                     `json:"version" yaml:"version"`
+	Err             string                  `json:"err" yaml:"error"`
+	ErrCode         string                  `json:"errcode,omitempty" yaml:"errCode,omitempty"`
+	ExpectedErr     string                  `json:"expectederr,omitempty" yaml:"expectedErr,omitempty"`
+	UID             uint32                  `json:"uid,omitempty" yaml:"uid,omitempty"`
+	MessageID       string                  `json:"messageid,omitempty" yaml:"messageId,omitempty"`
+	From            string                  `json:"from,omitempty" yaml:"from,omitempty"`
+	To              string                  `json:"to,omitempty" yaml:"to,omitempty"`
+	Subject         string                  `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Body            string                  `json:"body,omitempty" yaml:"body,omitempty"`
+	BodyText        string                  `json:"bodytext,omitempty" yaml:"bodyText,omitempty"`
+	BodyRendered    string                  `json:"bodyrendered,omitempty" yaml:"bodyRendered,omitempty"`
+	BodyPart        string                  `json:"bodypart,omitempty" yaml:"bodyPart,omitempty"`
+	BodyHash        string                  `json:"bodyhash,omitempty" yaml:"bodyHash,omitempty"`
+	Extracted       string                  `json:"extracted,omitempty" yaml:"extracted,omitempty"`
+	ExtractedAll    []string                `json:"extractedall,omitempty" yaml:"extractedAll,omitempty"`
+	Priority        string                  `json:"priority,omitempty" yaml:"priority,omitempty"`
+	SpamScore       *float64                `json:"spamscore,omitempty" yaml:"spamScore,omitempty"`
+	GmailLabels     []string                `json:"gmaillabels,omitempty" yaml:"gmailLabels,omitempty"`
+	ThreadID        string                  `json:"threadid,omitempty" yaml:"threadId,omitempty"`
+	RecipientCount  int                     `json:"recipientcount,omitempty" yaml:"recipientCount,omitempty"`
+	AttachmentCount int                     `json:"attachmentcount,omitempty" yaml:"attachmentCount,omitempty"`
+	Attachments     []Attachment            `json:"attachments,omitempty" yaml:"attachments,omitempty"`
+	FromDomainValid bool                    `json:"fromdomainvalid,omitempty" yaml:"fromDomainValid,omitempty"`
+	FromDomainMX    bool                    `json:"fromdomainmx,omitempty" yaml:"fromDomainMX,omitempty"`
+	AuthResults     map[string]string       `json:"authresults,omitempty" yaml:"authResults,omitempty"`
+	DKIMDomain      string                  `json:"dkimdomain,omitempty" yaml:"dkimDomain,omitempty"`
+	DKIMSelector    string                  `json:"dkimselector,omitempty" yaml:"dkimSelector,omitempty"`
+	DKIMSignatures  []DKIMSignature         `json:"dkimsignatures,omitempty" yaml:"dkimSignatures,omitempty"`
+	Count           int                     `json:"count,omitempty" yaml:"count,omitempty"`
+	MatchCount      int                     `json:"matchcount,omitempty" yaml:"matchCount,omitempty"`
+	MatchIndex      int                     `json:"matchindex,omitempty" yaml:"matchIndex,omitempty"`
+	Scanned         int                     `json:"scanned,omitempty" yaml:"scanned,omitempty"`
+	Exists          int                     `json:"exists,omitempty" yaml:"exists,omitempty"`
+	Changed         bool                    `json:"changed,omitempty" yaml:"changed,omitempty"`
+	HighestModSeq   uint64                  `json:"highestmodseq,omitempty" yaml:"highestModSeq,omitempty"`
+	QuotaUsed       uint32                  `json:"quotaused,omitempty" yaml:"quotaUsed,omitempty"`
+	QuotaLimit      uint32                  `json:"quotalimit,omitempty" yaml:"quotaLimit,omitempty"`
+	Folders         map[string]FolderCounts `json:"folders,omitempty" yaml:"folders,omitempty"`
+	Mailboxes       []string                `json:"mailboxes,omitempty" yaml:"mailboxes,omitempty"`
+	MailboxTree     MailboxTree             `json:"mailboxtree,omitempty" yaml:"mailboxTree,omitempty"`
+	Purged          int                     `json:"purged,omitempty" yaml:"purged,omitempty"`
+	DeliveredFolder string                  `json:"deliveredfolder,omitempty" yaml:"deliveredFolder,omitempty"`
+	MovedTo         string                  `json:"movedto,omitempty" yaml:"movedTo,omitempty"`
+	MovedToUID      uint32                  `json:"movedtouid,omitempty" yaml:"movedToUID,omitempty"`
+	ActionTaken     string                  `json:"actiontaken,omitempty" yaml:"actionTaken,omitempty"`
+	Envelope        *Envelope               `json:"envelope,omitempty" yaml:"envelope,omitempty"`
+	Forwarded       *Forwarded              `json:"forwarded,omitempty" yaml:"forwarded,omitempty"`
+	InlineParts     []string                `json:"inlineparts,omitempty" yaml:"inlineParts,omitempty"`
+	MIMEParts       []string                `json:"mimeparts,omitempty" yaml:"mimeParts,omitempty"`
+	Alerts          []string                `json:"alerts,omitempty" yaml:"alerts,omitempty"`
+	TLSMode         string                  `json:"tlsmode,omitempty" yaml:"tlsMode,omitempty"`
+	TLSVersion      string                  `json:"tlsversion,omitempty" yaml:"tlsVersion,omitempty"`
+	TLSCipherSuite  string                  `json:"tlsciphersuite,omitempty" yaml:"tlsCipherSuite,omitempty"`
+	AuthMechanism   string                  `json:"authmechanism,omitempty" yaml:"authMechanism,omitempty"`
+	Mails           []ResultMail            `json:"mails,omitempty" yaml:"mails,omitempty"`
+	Thread          []ResultMail            `json:"thread,omitempty" yaml:"thread,omitempty"`
+	TotalSize       uint64                  `json:"totalsize,omitempty" yaml:"totalSize,omitempty"`
+	HighestUID      *uint32                 `json:"highestuid,omitempty" yaml:"highestUID,omitempty"`
+	UIDValidity     uint32                  `json:"uidvalidity,omitempty" yaml:"uidValidity,omitempty"`
+	ProtocolLog     []string                `json:"protocollog,omitempty" yaml:"protocolLog,omitempty"`
+	Timings         *Timings                `json:"timings,omitempty" yaml:"timings,omitempty"`
+	TimeSeconds     float64                 `json:"timeseconds,omitempty" yaml:"timeSeconds,omitempty"`
+}
+
+// Timings is the breakdown of the duration of the step, in result.timings.
+type Timings struct {
+	ConnectSeconds float64 `json:"connectseconds" yaml:"connectSeconds"`
+	SelectSeconds  float64 `json:"selectseconds" yaml:"selectSeconds"`
+	FetchSeconds   float64 `json:"fetchseconds" yaml:"fetchSeconds"`
+	ScanSeconds    float64 `json:"scanseconds" yaml:"scanSeconds"`
+}
+
+// ResultMail is a mail of result.mails
+type ResultMail struct {
+	UID       uint32 `json:"uid,omitempty" yaml:"uid,omitempty"`
+	MessageID string `json:"messageid,omitempty" yaml:"messageId,omitempty"`
+	From      string `json:"from,omitempty" yaml:"from,omitempty"`
+	To        string `json:"to,omitempty" yaml:"to,omitempty"`
+	Subject   string `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Body      string `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// ZeroValueResult return an empty implementation of this executor result
+func (Executor) ZeroValueResult() interface{} {
+	return Result{}
+}
+
+// GetDefaultAssertions return default assertions for type exec
+func (Executor) GetDefaultAssertions() *venom.StepAssertions {
+	return &venom.StepAssertions{Assertions: []venom.Assertion{"result.err ShouldNotExist"}}
+}
+
+// Run execute TestStep of type exec
+func (x Executor) Run(ctx context.Context, step venom.TestStep) (interface{}, error) {
+	e := Executor{dialTLS: x.dialTLS}
+	if err := mapstructure.Decode(step, &e); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	e.stepStart = start
+
+	result := e.run(ctx)
+	result.Version = ResultVersion
+	result.TLSVersion = e.connTLSVersion
+	result.TLSCipherSuite = e.connTLSCipherSuite
+	result.AuthMechanism = e.connAuthMechanism
+	result.ProtocolLog = e.protocolLog.collected()
+	elapsed := time.Since(start)
+	result.TimeSeconds = elapsed.Seconds()
+	result.Timings = &Timings{
+		ConnectSeconds: e.connectDuration.Seconds(),
+		SelectSeconds:  e.selectDuration.Seconds(),
+		FetchSeconds:   e.fetchDuration.Seconds(),
+		ScanSeconds:    e.scanDuration.Seconds(),
+	}
+	venom.Debug(ctx, "Step timings: connect=%s select=%s fetch=%s scan=%s total=%s", e.connectDuration, e.selectDuration, e.fetchDuration, e.scanDuration, elapsed)
+	e.reportMetrics(ctx, result, elapsed)
+	e.expectError(&result)
+
+	return result, nil
+}
+
+// expectError inverts the outcome of the step with ExpectError: the error
+// matching it is moved to result.expectederr, keeping result.errcode, and the
+// step fails if it did not fail.
+func (e *Executor) expectError(result *Result) {
+	if e.ExpectError == "" {
+		return
+	}
+	re, err := regexp.Compile(e.ExpectError)
+	if err != nil {
+		result.Err = errors.Wrapf(err, "invalid expecterror").Error()
+		result.ErrCode = errCodeSearch
+		return
+	}
+	switch {
+	case result.Err == "":
+		result.Err = fmt.Sprintf("the step succeeded although expecterror %q was expected", e.ExpectError)
+		result.ErrCode = errCodeExpectError
+	case re.MatchString(result.Err):
+		result.ExpectedErr, result.Err = result.Err, ""
+	default:
+		result.Err = fmt.Sprintf("the error does not match expecterror %q: %s", e.ExpectError, result.Err)
+	}
+}
+
+// run runs the step, according to the action or the search parameters.
+func (e *Executor) run(ctx context.Context) Result {
+	result := Result{}
+	if err := e.applyURL(); err != nil {
+		result.Err = err.Error()
+		result.ErrCode = errCode(err)
+		return result
+	}
+	if err := e.loadPasswordFile(ctx); err != nil {
+		result.Err = err.Error()
+		result.ErrCode = errCode(err)
+		return result
+	}
+
+	e.protocolLog = e.newProtocolLog(ctx)
+
+	if err := checkAction(e.Action); err != nil {
+		result.Err = err.Error()
+		result.ErrCode = errCode(err)
+		return result
+	}
+
+	if e.Action == actionQuota {
+		used, limit, ok, err := e.quota(ctx)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		} else if ok {
+			result.QuotaUsed = used
+			result.QuotaLimit = limit
+		}
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.Action == actionCounts {
+		folders, err := e.counts(ctx)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		}
+		result.Folders = folders
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.Action == actionList {
+		mailboxes, err := e.list(ctx)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		}
+		for _, info := range mailboxes {
+			result.Mailboxes = append(result.Mailboxes, info.Name)
+		}
+		if e.TreeOutput && err == nil {
+			result.MailboxTree = mailboxTree(mailboxes)
+		}
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.Action == actionPurge {
+		purged, err := e.purge(ctx)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		}
+		result.Purged = purged
+		result.Alerts = e.alerts
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.SinceUID != nil {
+		found, err := e.searchMails(ctx, true)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		}
+		// highestuid is always set, sinceuid if nothing was searched.
+		highestUID := e.sinceUID()
+		result.HighestUID = &highestUID
+		if found != nil {
+			for _, m := range found.mails {
+				result.Mails = append(result.Mails, ResultMail{UID: m.UID, MessageID: m.MessageID, From: m.From, To: m.To, Subject: m.Subject, Body: e.lineEndings(m.Body)})
+				result.TotalSize += uint64(m.Size)
+			}
+			result.Count = len(found.mails)
+			highestUID = found.highestUID
+			result.UIDValidity = found.uidValidity
+		}
+		result.Alerts = e.alerts
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.ExpectedModSeq != nil {
+		modSeq, ok, err := e.highestModSeq(ctx)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		} else if ok {
+			result.HighestModSeq = modSeq
+			result.Changed = modSeq != *e.ExpectedModSeq
+		}
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.ExpectedCount != nil || e.ExpectEmpty {
+		count, err := e.countMails(ctx)
+		if err == nil {
+			result.Exists = int(count)
+			if e.ExpectedCount != nil {
+				result.Changed = result.Exists != *e.ExpectedCount
+			}
+			if e.ExpectEmpty && count > 0 {
+				err = notEmptyError{box: e.mailbox(), count: count}
+			}
+		}
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		}
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	if e.WaitForCount > 0 {
+		count, err := e.waitForCount(ctx)
+		if err != nil {
+			result.Err = err.Error()
+			result.ErrCode = errCode(err)
+		}
+		result.Count = int(count)
+		result.TLSMode = e.connTLSMode
+		return result
+	}
+
+	find, errs := e.pollMail(ctx)
+	if errs != nil {
+		result.Err = errs.Error()
+		result.ErrCode = errCode(errs)
+	}
+	result.Alerts = e.alerts
+	result.TLSMode = e.connTLSMode
+	result.MatchCount = e.matchCount
+	result.Scanned = e.scanned
+	if find != nil {
+		result.UID = find.UID
+		result.MatchIndex = e.matchIndex
+		result.MessageID = find.MessageID
+		result.From = find.From
+		result.To = find.To
+		result.Subject = find.Subject
+		result.Body = e.lineEndings(find.Body)
+		result.BodyText = e.lineEndings(find.BodyText)
+		result.BodyRendered = e.lineEndings(find.BodyRendered)
+		result.BodyPart = e.lineEndings(find.BodyPart)
+		if find.Body != "" {
+			result.BodyHash = bodyHash(find.BodyText)
+		}
+		result.Priority = find.Priority
+		result.GmailLabels = find.GmailLabels
+		result.ThreadID = find.ThreadID
+		result.RecipientCount = find.RecipientCount
+		result.SpamScore = find.SpamScore
+		result.AttachmentCount = len(find.AttachmentTypes)
+		result.Attachments = find.AttachmentContents
+		result.AuthResults = find.AuthResults
+		result.DKIMSignatures = find.DKIMSignatures
+		if sig, _, _ := e.matchDKIM(find); sig != nil {
+			result.DKIMDomain, result.DKIMSelector = sig.Domain, sig.Selector
+		}
+		result.DeliveredFolder = find.Mailbox
+		result.MovedTo = find.MovedTo
+		result.MovedToUID = find.MovedToUID
+		result.ActionTaken = find.ActionTaken
+		result.Envelope = find.Envelope
+		if find.Forwarded != nil {
+			forwarded := *find.Forwarded
+			forwarded.Body = e.lineEndings(forwarded.Body)
+			result.Forwarded = &forwarded
+		}
+		result.InlineParts = find.InlineParts
+		result.MIMEParts = find.MIMEParts
+		for _, m := range find.Thread {
+			result.Thread = append(result.Thread, ResultMail{UID: m.UID, MessageID: m.MessageID, From: m.From, To: m.To, Subject: m.Subject, Body: e.lineEndings(m.Body)})
+		}
+		if e.ExtractBody != "" && errs == nil {
+			extracted, err := extractSubmatches(e.ExtractBody, find.Body)
+			if err != nil {
+				result.Err = err.Error()
+				result.ErrCode = errCodeSearch
+			} else {
+				result.Extracted, result.ExtractedAll = extracted[0], extracted
+			}
+		}
+		if e.ValidateFromDNS && result.Err == "" {
+			valid, mx, err := validateFromDNS(ctx, find.From)
+			if err != nil {
+				result.Err = err.Error()
+				result.ErrCode = errCodeFromDNS
+			} else {
+				result.FromDomainValid, result.FromDomainMX = valid, mx
+			}
+		}
+	} else if result.Err == "" {
+		result.Err = "searched mail not found"
+		result.ErrCode = errCodeSearch
+	}
+
+	return result
+}
+
+// loadPasswordFile replaces IMAPPassword by the content of IMAPPasswordFile,
+// if set. Both are ignored with CredentialProvider, which is called when
+// connecting.
+func (e *Executor) loadPasswordFile(ctx context.Context) error {
+	if e.CredentialProvider != "" {
+		if e.IMAPPassword != "" || e.IMAPPasswordFile != "" {
+			venom.Warn(ctx, "credentialprovider is set, imappassword and imappasswordfile are ignored")
+		}
+		return nil
+	}
+	if e.IMAPPasswordFile == "" {
+		return nil
+	}
+	if e.IMAPPassword != "" {
+		venom.Warn(ctx, "imappassword and imappasswordfile are both set, using imappasswordfile")
+	}
+	content, err := os.ReadFile(e.IMAPPasswordFile)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read imappasswordfile")
+	}
+	e.IMAPPassword = strings.TrimRight(string(content), "\r\n")
+	return nil
+}
+
+// bodyJoinSeparator separates the text parts joined with bodyjoin concat.
+const bodyJoinSeparator = "\n"
+
+// joinBody combines the text parts of a mail according to BodyJoin: the
+// first one, the last one, or all of them by default.
+func (e *Executor) joinBody(parts []string) string {
+	if len(parts) == 0 {
+		return ""
+	}
+	switch strings.ToLower(e.BodyJoin) {
+	case "first":
+		return parts[0]
+	case "last":
+		return parts[len(parts)-1]
+	}
+	return strings.Join(parts, bodyJoinSeparator)
+}
+
+// Values of NormalizeLineEndings.
+const (
+	lineEndingsLF   = "lf"
+	lineEndingsCRLF = "crlf"
+	lineEndingsNone = "none"
+)
+
+// lineEndings converts the line endings of a returned body according to
+// NormalizeLineEndings, so that the assertions do not depend on the ones
+// of the server. They are kept as received by default.
+func (e *Executor) lineEndings(body string) string {
+	switch strings.ToLower(e.NormalizeLineEndings) {
+	case lineEndingsLF:
+		return strings.ReplaceAll(body, "\r\n", "\n")
+	case lineEndingsCRLF:
+		return strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	}
+	return body
+}
+
+// bodyHash returns the hex SHA-256 of the text body, with LF line endings
+// whatever NormalizeLineEndings so that it does not depend on the server.
+func bodyHash(text string) string {
+	sum := sha256.Sum256([]byte(strings.ReplaceAll(text, "\r\n", "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// extractSubmatches returns the capture groups of the first match of pattern
+// in body, or the whole match if pattern has no group.
+func extractSubmatches(pattern, body string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid extractbody")
+	}
+	m := re.FindStringSubmatch(body)
+	if m == nil {
+		return nil, fmt.Errorf("extractbody %q does not match the body of the mail", pattern)
+	}
+	if len(m) == 1 {
+		return m, nil
+	}
+	return m[1:], nil
+}
+
+// checkCredentials fails before dialing when the credentials are empty, as
+// with an un-interpolated variable, unless anonymous access is allowed.
+func (e *Executor) checkCredentials() error {
+	method, err := e.authMethod()
+	if err != nil {
+		return err
+	}
+	if e.AllowAnonymous {
+		return nil
+	}
+	if e.IMAPUser == "" {
+		return fmt.Errorf("imapuser is required")
+	}
+	if e.CredentialProvider != "" {
+		_, err := e.credentialProvider()
+		return err
+	}
+	if method == authMethodXOAuth2 {
+		if e.IMAPAccessToken == "" {
+			return fmt.Errorf("imapaccesstoken is required with imapauthmethod %s", authMethodXOAuth2)
+		}
+		return nil
+	}
+	// The server may authenticate the client certificate instead.
+	if e.IMAPPassword == "" && e.IMAPClientCertFile == "" {
+		return fmt.Errorf("imappassword is required")
+	}
+	return nil
+}
+
+func (e *Executor) getMail(ctx context.Context) (*Mail, error) {
+	if e.SearchFrom == "" && e.SearchSubject == "" && e.SearchBody == "" && e.SearchTo == "" && e.SearchRecipient == "" && e.GmailLabel == "" && e.SearchPriority == "" && e.SearchThreadID == "" &&
+		e.SearchDKIMDomain == "" && e.SearchDKIMSelector == "" && !e.searchAttachments() && e.SearchMIMEPart == "" && !e.searchForwarded() && e.SearchSince == "" &&
+		e.MinRecipients == 0 && e.MaxRecipients == 0 && e.SearchTimeOfDayFrom == "" && e.SearchTimeOfDayTo == "" && e.MinSpamScore == nil && e.MaxSpamScore == nil && !e.FirstUnseen && e.SeqNum == 0 {
+		return nil, fmt.Errorf("you have to use one of searchfrom, searchto, searchrecipient, searchsubject, subjectbody, gmaillabel, searchthreadid, searchattachment, excludeattachment, searchattachmenttype, minattachments, maxattachments, searchmimepart, searchforwardedfrom, searchforwardedsubject, searchforwardedbody, searchsince, searchpriority, searchdkimdomain, searchdkimselector, minrecipients, maxrecipients, searchtimeofdayfrom, searchtimeofdayto, minspamscore, maxspamscore, firstunseen or seqnum parameters")
+	}
+
+	venom.Debug(ctx, "Effective configuration: %s", e.effectiveConfig())
+	found, err := e.searchMails(ctx, false)
+	if err != nil {
+		// The mail is returned if only the action on it failed.
+		if found != nil && len(found.mails) > 0 {
+			return found.mails[0], err
+		}
+		return nil, err
+	}
+	if len(found.mails) == 0 {
+		return nil, errMailNotFound
+	}
+	return found.mails[0], nil
+}
+
+// pollMail searches the mail with getMail until it is found or MaxWait
+// elapses, with a jittered exponential backoff between the searches. Without
+// MaxWait, the mail is searched once.
+func (e *Executor) pollMail(ctx context.Context) (*Mail, error) {
+	if e.MaxWait <= 0 {
+		return e.retryMail(ctx)
+	}
+	maxWait := time.Duration(e.MaxWait) * time.Second
+	deadline := time.Now().Add(maxWait)
+	backoff := pollBackoff
+	if e.KeepAliveInterval > 0 {
+		// The connection is kept open between the searches, in its slot.
+		release, err := e.acquireConnection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		e.keepConn = true
+		defer func() {
+			e.keepConn = false
+			if e.kept != nil {
+				e.logout(e.kept)
+				e.kept = nil
+			}
+		}()
+	}
+	for searches := 1; ; searches++ {
+		m, err := e.getMail(ctx)
+		if err != errMailNotFound && err != errNoMessage && !e.isRetryable(err) {
+			return m, err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if e.isRetryable(err) {
+				return nil, err
+			}
+			return nil, waitTimeoutError{maxWait: maxWait, searches: searches}
+		}
+		// Between half the backoff and the backoff, so that steps started
+		// together do not poll the server at the same time.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if delay > remaining {
+			delay = remaining
+		}
+		if e.isRetryable(err) {
+			venom.Debug(ctx, "Search refused (%s), searching again in %s", err, delay)
+		} else {
+			venom.Debug(ctx, "Mail not found, searching again in %s", delay)
+		}
+		if e.keepConn {
+			if err := e.keepAlive(ctx, delay); err != nil {
+				return nil, err
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		if backoff *= 2; backoff > pollMaxBackoff {
+			backoff = pollMaxBackoff
+		}
+	}
+}
+
+// retryMail searches the mail with getMail, again when the search fails with
+// one of the response codes of RetryOnCodes, up to retryAttempts with an
+// exponential backoff.
+func (e *Executor) retryMail(ctx context.Context) (*Mail, error) {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		m, err := e.getMail(ctx)
+		if err == nil || !e.retryOnCode(err) || attempt >= retryAttempts {
+			return m, err
+		}
+		venom.Warn(ctx, "Search failed with %s (%s), retrying in %s", responseCode(err), err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// searchResult contains the mails found by searchMails.
+type searchResult struct {
+	mails []*Mail
+	// highestUID is the UID after which to search in the next run, from the
+	// UIDNEXT of the mailbox unless the limit was reached.
+	highestUID  uint32
+	uidValidity uint32
+	// limited is set when the search stopped at the limit.
+	limited bool
+}
+
+// searchMails returns the mails of the mailbox matching the search criteria,
+// only the first one unless all is true. With SinceUID, only the mails with a
+// greater UID are searched.
+func (e *Executor) searchMails(ctx context.Context, all bool) (*searchResult, error) {
+	if err := e.checkCredentials(); err != nil {
+		return nil, err
+	}
+	if err := e.checkFetchItems(); err != nil {
+		return nil, err
+	}
+	if e.FetchBodyPart != "" && !bodyPartRegexp.MatchString(e.FetchBodyPart) {
+		return nil, fmt.Errorf("invalid fetchbodypart %q, expected a MIME section number as 2.1", e.FetchBodyPart)
+	}
+	if _, err := e.sortCriteria(); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(e.BodyJoin) {
+	case "", "first", "last", "concat":
+	default:
+		return nil, fmt.Errorf("unsupported bodyjoin %q, expected first, last or concat", e.BodyJoin)
+	}
+	switch strings.ToLower(e.NormalizeLineEndings) {
+	case "", lineEndingsLF, lineEndingsCRLF, lineEndingsNone:
+	default:
+		return nil, fmt.Errorf("unsupported normalizelineendings %q, expected lf, crlf or none", e.NormalizeLineEndings)
+	}
+	switch strings.ToLower(e.SearchPriority) {
+	case "", priorityHigh, priorityNormal, priorityLow:
+	default:
+		return nil, fmt.Errorf("unsupported searchpriority %q, expected high, normal or low", e.SearchPriority)
+	}
+	if _, err := regexp.Compile(e.ExtractBody); err != nil {
+		return nil, errors.Wrapf(err, "invalid extractbody")
+	}
+	if e.SearchThreadID != "" && strings.Trim(e.SearchThreadID, "0123456789") != "" {
+		return nil, fmt.Errorf("searchthreadid must be a decimal number, as result.threadid")
+	}
+	since, err := e.sinceTime()
+	if err != nil {
+		return nil, err
+	}
+	e.since = since
+	if e.SeqNum < 0 {
+		return nil, fmt.Errorf("seqnum must be greater than 0, the first message is 1")
+	}
+	if e.SeqNum > 0 && e.FirstUnseen {
+		return nil, fmt.Errorf("seqnum can't be used with firstunseen")
+	}
+	if len(e.MBoxes) > 0 && e.SinceUID != nil {
+		return nil, fmt.Errorf("mboxes can't be used with sinceuid, the UIDs are those of a single mbox")
+	}
+
+	if !e.keepConn {
+		// pollMail holds the slot of the kept connection.
+		release, erra := e.acquireConnection(ctx)
+		if erra != nil {
+			return nil, erra
+		}
+		defer release()
+	}
+
+	if e.StreamToDisk {
+		sp, err := newSpool()
+		if err != nil {
+			return nil, err
+		}
+		e.spool = sp
+		defer func() {
+			if err := sp.close(); err != nil {
+				venom.Warn(ctx, "Cannot remove the streamtodisk directory: %s", err)
+			}
+			e.spool = nil
+		}()
+	}
+
+	c, errc := e.searchConnection(ctx)
+	if errc != nil {
+		return nil, errors.Wrapf(errc, "error while connecting")
+	}
+	defer func() { e.releaseSearchConnection(c) }()
+
+	if !e.hasCap(ctx, c, "X-GM-EXT-1") {
+		if e.GmailLabel != "" {
+			return nil, fmt.Errorf("gmaillabel requires the X-GM-EXT-1 capability, which is not advertised by the server")
+		}
+		if e.SearchThreadID != "" {
+			return nil, fmt.Errorf("searchthreadid requires the X-GM-EXT-1 capability, which is not advertised by the server")
+		}
+	}
+
+	found := &searchResult{highestUID: e.sinceUID()}
+	e.scanned, e.matchIndex, e.matchDuration = 0, 0, 0
+	empty := true
+	for _, box := range e.mailboxes() {
+		count, err := queryCount(c, box)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while queryCount")
+		}
+		venom.Debug(ctx, "count messages of %s:%d", box, count)
+		if count == 0 {
+			continue
+		}
+		empty = false
+
+		var errs error
+		if c, errs = e.searchMailbox(ctx, c, box, all, found); errs != nil {
+			if len(found.mails) > 0 {
+				return found, errs
+			}
+			return nil, errs
+		}
+		if !all && !e.CountMatches && len(found.mails) > 0 {
+			break
+		}
+	}
+	if empty && !all {
+		return nil, errNoMessage
+	}
+	return found, nil
+}
+
+// searchMailbox adds the mails of box matching the search criteria to found,
+// and returns the client, which is a new one if it reconnected.
+func (e *Executor) searchMailbox(ctx context.Context, c *imap.Client, box string, all bool, found *searchResult) (*imap.Client, error) {
+	c, messages, err := e.fetch(ctx, c, box)
+	if err != nil {
+		return c, errors.Wrapf(err, "Error while feching messages")
+	}
+	var uidNext uint32
+	if c.Mailbox != nil {
+		found.uidValidity = c.Mailbox.UIDValidity
+		uidNext = c.Mailbox.UIDNext
+	}
+
+	for i, msg := range messages {
+		scanStart := time.Now()
+		e.scanned++
+		if uid := msg.MessageInfo().UID; uid > found.highestUID {
+			found.highestUID = uid
+		}
+		if e.spool != nil {
+			var errl error
+			if msg, errl = e.spool.load(msg); errl != nil {
+				return c, errl
+			}
+		}
+		m, erre := e.extract(ctx, msg)
+		if erre != nil {
+			venom.Warn(ctx, "Cannot extract the content of the mail: %s", erre)
+			e.scanDuration += time.Since(scanStart)
+			continue
+		}
+		m.Mailbox = box
+
+		startMatch := time.Now()
+		ok, errs := e.isSearched(m)
+		if errs != nil {
+			return c, errs
+		}
+		e.matchDuration += matchElapsed(startMatch)
+		e.scanDuration += time.Since(scanStart)
+		// A slow match fails the search even if it is the searched mail.
+		if e.MatchTimeout > 0 && e.matchDuration > time.Duration(e.MatchTimeout)*matchTimeoutUnit {
+			return c, fmt.Errorf("matchtimeout of %ds exceeded while processing message %d/%d (UID %d) of %s", e.MatchTimeout, i+1, len(messages), m.UID, box)
+		}
+		if !ok {
+			continue
+		}
+		if e.ExpectUIDNot != 0 && m.UID == e.ExpectUIDNot {
+			venom.Debug(ctx, "Message %d matches but it is expectuidnot, it is skipped", m.UID)
+			continue
+		}
+		if e.CountMatches {
+			e.matchCount++
+		}
+		if !all && len(found.mails) > 0 {
+			// The other mails are only counted, with CountMatches.
+			continue
+		}
+
+		if len(found.mails) == 0 {
+			e.matchIndex = e.scanned - 1
+			if e.WithThread && !all {
+				thread, errt := e.thread(ctx, messages, m)
+				if errt != nil {
+					return c, errt
+				}
+				m.Thread = thread
+			}
+		}
+		m.ActionTaken = actionTakenNone
+		if e.DeleteOnSuccess {
+			venom.Debug(ctx, "Delete message %v", m.UID)
+			if err := m.delete(c); err != nil {
+				found.mails = append(found.mails, m)
+				return c, actionError{err}
+			}
+			m.ActionTaken = actionTakenDeleted
+		} else if e.MBoxOnSuccess != "" {
+			venom.Debug(ctx, "Move to %s", e.MBoxOnSuccess)
+			uid, err := e.move(ctx, c, m, e.MBoxOnSuccess)
+			if err != nil {
+				found.mails = append(found.mails, m)
+				return c, actionError{err}
+			}
+			m.MovedTo, m.MovedToUID = e.MBoxOnSuccess, uid
+			m.ActionTaken = actionTakenMoved
+		}
+		found.mails = append(found.mails, m)
+		if !all && !e.CountMatches {
+			break
+		}
+		if all && e.Limit > 0 && len(found.mails) >= e.Limit {
+			// The mails after the limit are searched in the next run.
+			found.limited = true
+			break
+		}
+	}
+	// The UIDs below UIDNEXT are all searched, even those of the mails not
+	// fetched or expunged.
+	if !found.limited && uidNext > found.highestUID+1 {
+		found.highestUID = uidNext - 1
+	}
+	return c, nil
+}
+
+// sinceUID returns the UID after which the mails are searched, 0 to search
+// all of them.
+func (e *Executor) sinceUID() uint32 {
+	if e.SinceUID == nil {
+		return 0
+	}
+	return *e.SinceUID
+}
+
+// countMails returns the number of messages of the mailbox, with a single
+// STATUS command.
+func (e *Executor) countMails(ctx context.Context) (uint32, error) {
+	if err := e.checkCredentials(); err != nil {
+		return 0, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return 0, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return 0, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	count, err := queryCount(c, e.mailbox())
+	if err != nil {
+		return 0, errors.Wrapf(err, "error while queryCount")
+	}
+	if e.ExpectedCount != nil {
+		venom.Debug(ctx, "count messages:%d, expected %d", count, *e.ExpectedCount)
+	} else {
+		venom.Debug(ctx, "count messages:%d, expected empty", count)
+	}
+	return count, nil
+}
+
+// highestModSeq returns the HIGHESTMODSEQ of the mailbox (RFC 7162), which
+// increases with any change of its mails. It returns false, with a warning, if
+// the server does not advertise the CONDSTORE capability.
+func (e *Executor) highestModSeq(ctx context.Context) (uint64, bool, error) {
+	if err := e.checkCredentials(); err != nil {
+		return 0, false, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return 0, false, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return 0, false, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	if !e.hasCap(ctx, c, "CONDSTORE") {
+		venom.Warn(ctx, "The server does not advertise the CONDSTORE capability, result.highestmodseq is not set")
+		return 0, false, nil
+	}
+	cmd, err := check(c.Status(e.mailbox(), "HIGHESTMODSEQ"))
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "error while getting the highestmodseq")
+	}
+	for _, rsp := range cmd.Data {
+		if rsp.Label != "STATUS" || len(rsp.Fields) < 3 {
+			continue
+		}
+		items := imap.AsList(rsp.Fields[2])
+		for i := 0; i+1 < len(items); i += 2 {
+			if !strings.EqualFold(imap.AsAtom(items[i]), "HIGHESTMODSEQ") {
+				continue
+			}
+			modSeq, ok := parseModSeq(items[i+1])
+			if !ok {
+				return 0, false, fmt.Errorf("invalid HIGHESTMODSEQ %v", items[i+1])
+			}
+			venom.Debug(ctx, "highestmodseq:%d, expected %d", modSeq, *e.ExpectedModSeq)
+			return modSeq, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("no HIGHESTMODSEQ in the STATUS response of mailbox %s", e.mailbox())
+}
+
+// parseModSeq returns the value of a mod-sequence (RFC 7162), a 63-bit number.
+// Those larger than 32 bits are parsed as atoms by the IMAP client.
+func parseModSeq(f imap.Field) (uint64, bool) {
+	switch v := f.(type) {
+	case uint32:
+		return uint64(v), true
+	case string:
+		n, err := strconv.ParseUint(v, 10, 63)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// waitForCount polls the number of messages of the mailbox until it reaches
+// WaitForCount or WaitForTimeout elapses.
+func (e *Executor) waitForCount(ctx context.Context) (uint32, error) {
+	if err := e.checkCredentials(); err != nil {
+		return 0, err
+	}
+	release, erra := e.acquireConnection(ctx)
+	if erra != nil {
+		return 0, erra
+	}
+	defer release()
+
+	c, tlsMode, errc := e.connect(ctx)
+	if errc != nil {
+		return 0, errors.Wrapf(errc, "error while connecting")
+	}
+	e.connTLSMode = tlsMode
+	defer e.logout(c)
+
+	box := e.mailbox()
+	timeout := defaultWaitForTimeout
+	if e.WaitForTimeout > 0 {
+		timeout = time.Duration(e.WaitForTimeout) * time.Second
+	}
+	delay := defaultWaitForDelay
+	if e.WaitForDelay > 0 {
+		delay = time.Duration(e.WaitForDelay) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		count, err := queryCount(c, box)
+		if err != nil {
+			return 0, errors.Wrapf(err, "error while queryCount")
+		}
+		venom.Debug(ctx, "count messages:%d, waiting for %d", count, e.WaitForCount)
+		if count >= uint32(e.WaitForCount) {
+			return count, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return count, fmt.Errorf("mailbox %s has %d messages after %s, expected %d", box, count, timeout, e.WaitForCount)
+		}
+		select {
+		case <-ctx.Done():
+			return count, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// mailboxes returns the mailboxes to search in, in order: MBoxes, or else
+// the mailbox.
+func (e *Executor) mailboxes() []string {
+	if len(e.MBoxes) > 0 {
+		return e.MBoxes
+	}
+	return []string{e.mailbox()}
+}
+
+// mailbox returns the mailbox to search in.
+func (e *Executor) mailbox() string {
+	if e.MBox == "" {
+		return "INBOX"
+	}
+	return e.MBox
+}
+
+func (e *Executor) isSearched(m *Mail) (bool, error) {
+	if e.SearchFrom != "" {
+		ma, erra := e.match(e.SearchFrom, m.From)
+		if erra != nil || !ma {
+			return false, erra
+		}
+	}
+	if e.SearchTo != "" {
+		mt, erra := e.match(e.SearchTo, m.To)
+		if erra != nil || !mt {
+			return false, erra
+		}
+	}
+	if e.SearchRecipient != "" {
+		mr, errr := e.matchAny(e.SearchRecipient, m.recipients())
+		if errr != nil || !mr {
+			return false, errr
+		}
+	}
+	if e.SearchSubject != "" {
+		mb, errb := e.match(e.SearchSubject, m.Subject)
+		if errb != nil || !mb {
+			return false, errb
+		}
+	}
+	if e.SearchBody != "" {
+		mc, errc := e.match(e.SearchBody, m.Body)
+		if errc != nil || !mc {
+			return false, errc
+		}
+	}
+	if e.searchForwarded() && m.Forwarded == nil {
+		return false, nil
+	}
+	if e.SearchForwardedFrom != "" {
+		mf, errf := e.match(e.SearchForwardedFrom, m.Forwarded.From)
+		if errf != nil || !mf {
+			return false, errf
+		}
+	}
+	if e.SearchForwardedSubject != "" {
+		mf, errf := e.match(e.SearchForwardedSubject, m.Forwarded.Subject)
+		if errf != nil || !mf {
+			return false, errf
+		}
+	}
+	if e.SearchForwardedBody != "" {
+		mf, errf := e.match(e.SearchForwardedBody, m.Forwarded.Body)
+		if errf != nil || !mf {
+			return false, errf
+		}
+	}
+	if e.SearchAttachment != "" {
+		found, err := e.matchAny(e.SearchAttachment, m.Attachments)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+	if e.ExcludeAttachment != "" {
+		found, err := e.matchAny(e.ExcludeAttachment, m.Attachments)
+		if err != nil || found {
+			return false, err
+		}
+	}
+	if e.SearchAttachmentType != "" {
+		found, err := e.matchAny(e.SearchAttachmentType, m.AttachmentTypes)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+	if e.SearchMIMEPart != "" {
+		found, err := e.matchAny(e.SearchMIMEPart, m.MIMEParts)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+	if e.SearchPriority != "" && !strings.EqualFold(e.SearchPriority, m.Priority) {
+		return false, nil
+	}
+	if e.SearchDKIMDomain != "" || e.SearchDKIMSelector != "" {
+		if _, found, err := e.matchDKIM(m); err != nil || !found {
+			return false, err
+		}
+	}
+	if e.MinRecipients > 0 && m.RecipientCount < e.MinRecipients {
+		return false, nil
+	}
+	if e.MaxRecipients > 0 && m.RecipientCount > e.MaxRecipients {
+		return false, nil
+	}
+	if e.MinSpamScore != nil || e.MaxSpamScore != nil {
+		// A mail without score is not known to be within the bounds.
+		if m.SpamScore == nil ||
+			e.MinSpamScore != nil && *m.SpamScore < *e.MinSpamScore ||
+			e.MaxSpamScore != nil && *m.SpamScore > *e.MaxSpamScore {
+			return false, nil
+		}
+	}
+	if e.MinAttachments > 0 && len(m.AttachmentTypes) < e.MinAttachments {
+		return false, nil
+	}
+	if e.MaxAttachments > 0 && len(m.AttachmentTypes) > e.MaxAttachments {
+		return false, nil
+	}
+	if !e.since.IsZero() && m.InternalDate.Before(e.since) {
+		return false, nil
+	}
+	if e.SearchTimeOfDayFrom != "" || e.SearchTimeOfDayTo != "" {
+		in, err := e.inTimeOfDay(m.Date)
+		if err != nil || !in {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// searchSinceTestStart is the searchsince value of the start of the step.
+const searchSinceTestStart = "teststart"
+
+// sinceTime returns the time from which the mails are searched, zero without
+// SearchSince: the start of the step for teststart, or else an RFC 3339 time.
+// It is truncated to the second, as the INTERNALDATE of the mails.
+func (e *Executor) sinceTime() (time.Time, error) {
+	if e.SearchSince == "" {
+		return time.Time{}, nil
+	}
+	if strings.EqualFold(e.SearchSince, searchSinceTestStart) {
+		if e.stepStart.IsZero() {
+			return time.Now().Truncate(time.Second), nil
+		}
+		return e.stepStart.Truncate(time.Second), nil
+	}
+	since, err := time.Parse(time.RFC3339, e.SearchSince)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid searchsince %q, expected %s or an RFC 3339 time", e.SearchSince, searchSinceTestStart)
+	}
+	return since.Truncate(time.Second), nil
+}
+
+// match reports whether value matches the search pattern. With anchor, the
+// pattern must match the whole value instead of a substring.
+func (e *Executor) match(pattern, value string) (bool, error) {
+	if e.FoldAccents {
+		pattern, value = foldAccents(pattern), foldAccents(value)
+	}
+	re, err := e.regexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	if e.FoldAccents {
+		re = "(?i)" + re
+	}
+	return regexp.MatchString(re, value)
+}
+
+// foldAccents removes the diacritics of s, so that José is Jose.
+func foldAccents(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return folded
+}
+
+// regexp returns the regular expression of a search pattern, according to
+// MatchMode.
+func (e *Executor) regexp(pattern string) (string, error) {
+	switch strings.ToLower(e.MatchMode) {
+	case "", "regex":
+		if e.Anchor {
+			pattern = "^(?:" + pattern + ")$"
+		}
+		return pattern, nil
+	case "glob":
+		return globRegexp(pattern), nil
+	}
+	return "", fmt.Errorf("unsupported matchmode %q, expected regex or glob", e.MatchMode)
+}
+
+// globRegexp translates a shell-style glob, where * matches any sequence of
+// characters and ? any character, to a regular expression matching the whole
+// value. The other characters match themselves.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// inTimeOfDay returns true if the time of day of date, in Timezone or else
+// in the timezone of the date, is between SearchTimeOfDayFrom included and
+// SearchTimeOfDayTo excluded. The window may span midnight, as 22:00 to
+// 06:00. A mail without date is not in the window.
+func (e *Executor) inTimeOfDay(date time.Time) (bool, error) {
+	from, err := parseTimeOfDay(e.SearchTimeOfDayFrom, 0)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid searchtimeofdayfrom")
+	}
+	to, err := parseTimeOfDay(e.SearchTimeOfDayTo, 24*time.Hour)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid searchtimeofdayto")
+	}
+	if e.Timezone != "" {
+		loc, err := time.LoadLocation(e.Timezone)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid timezone")
+		}
+		date = date.In(loc)
+	}
+	if date.IsZero() {
+		return false, nil
+	}
+
+	h, m, s := date.Clock()
+	t := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if from <= to {
+		return t >= from && t < to, nil
+	}
+	return t >= from || t < to, nil
+}
+
+// parseTimeOfDay parses a time of day as 15:04 or 15:04:05, def if empty.
+func parseTimeOfDay(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse("15:04:05", s)
+	if err != nil {
+		if t, err = time.Parse("15:04", s); err != nil {
+			return 0, fmt.Errorf("%q is not a time of day as 09:00", s)
+		}
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+}
+
+// matchAny returns true if one of values matches pattern.
+func (e *Executor) matchAny(pattern string, values []string) (bool, error) {
+	for _, v := range values {
+		ok, err := e.match(pattern, v)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	// Report an invalid pattern even without value.
+	re, err := e.regexp(pattern)
+	if err == nil {
+		_, err = regexp.Compile(re)
+	}
+	return false, err
+}
+
+// matchDKIM returns the first DKIM signature of m whose domain and selector
+// match SearchDKIMDomain and SearchDKIMSelector, both on the same signature.
+// Without them, it is the topmost signature.
+func (e *Executor) matchDKIM(m *Mail) (*DKIMSignature, bool, error) {
+	for i, sig := range m.DKIMSignatures {
+		if e.SearchDKIMDomain != "" {
+			ok, err := e.match(e.SearchDKIMDomain, sig.Domain)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		if e.SearchDKIMSelector != "" {
+			ok, err := e.match(e.SearchDKIMSelector, sig.Selector)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		return &m.DKIMSignatures[i], true, nil
+	}
+	return nil, false, nil
+}
+
+// searchedLocally returns true if the fetched mails are matched against
+// search criteria, which are not handled by the server.
+func (e *Executor) searchedLocally() bool {
+	return e.SearchFrom != "" || e.SearchTo != "" || e.SearchRecipient != "" || e.SearchSubject != "" || e.SearchBody != "" ||
+		e.SearchPriority != "" || e.SearchDKIMDomain != "" || e.SearchDKIMSelector != "" || e.MinRecipients > 0 || e.MaxRecipients > 0 || e.MinSpamScore != nil || e.MaxSpamScore != nil || e.searchAttachments() || e.SearchMIMEPart != "" || e.searchForwarded() || e.SearchSince != ""
+}
+
+// searchAttachments returns true if the mails are searched by their
+// attachments, which are extracted only in this case.
+func (e *Executor) searchAttachments() bool {
+	return e.SearchAttachment != "" || e.ExcludeAttachment != "" || e.SearchAttachmentType != "" ||
+		e.MinAttachments > 0 || e.MaxAttachments > 0
+}
+
+// searchForwarded returns true if the mails are searched by the mail they
+// forward.
+func (e *Executor) searchForwarded() bool {
+	return e.SearchForwardedFrom != "" || e.SearchForwardedSubject != "" || e.SearchForwardedBody != ""
+}
+
+// followForwarded returns true if the forwarded mails are extracted.
+func (e *Executor) followForwarded() bool {
+	return e.FollowForwarded || e.searchForwarded()
+}
+
+// move moves the message to mbox. Without the MOVE extension (RFC 6851), the
+// message is copied to mbox then deleted. It returns the UID of the message in
+// mbox, or 0 if the server does not send it (UIDPLUS extension, RFC 4315).
+func (e *Executor) move(ctx context.Context, c *imap.Client, m *Mail, mbox string) (uint32, error) {
+	seq, _ := imap.NewSeqSet("")
+	seq.AddNum(m.UID)
+
+	if !e.hasCap(ctx, c, "MOVE") {
+		venom.Debug(ctx, "MOVE is not supported by the server, copy then delete message %v", m.UID)
+		cmd, err := check(c.UIDCopy(seq, mbox))
+		if err != nil {
+			return 0, fmt.Errorf("Error while copy msg to %s: %v", mbox, err.Error())
+		}
+		rsp, _ := cmd.Result(imap.OK)
+		if _, err := check(c.UIDStore(seq, "+FLAGS.SILENT", imap.NewFlagSet(`\Deleted`))); err != nil {
+			return 0, fmt.Errorf("Error while deleting msg, err: %s", err.Error())
+		}
+		if _, err := check(c.Expunge(nil)); err != nil {
+			return 0, fmt.Errorf("Error while expunging messages: err: %s", err.Error())
+		}
+		return copyUID([]*imap.Response{rsp}), nil
+	}
+
+	venom.Debug(ctx, "Move message %v with MOVE", m.UID)
+	cmd, err := check(c.UIDMove(seq, mbox))
+	if err != nil {
+		return 0, fmt.Errorf("Error while move msg to %s: %v", mbox, err.Error())
+	}
+	// The COPYUID response code is sent in an untagged OK response before the
+	// EXPUNGE responses of MOVE.
+	rsp, _ := cmd.Result(imap.OK)
+	uid := copyUID(append([]*imap.Response{rsp}, c.Data...))
+	c.Data = nil
+	return uid, nil
+}
+
+// copyUID returns the destination UID of the first COPYUID response code.
+func copyUID(rsps []*imap.Response) uint32 {
+	for _, rsp := range rsps {
+		if rsp != nil && rsp.Label == "COPYUID" && len(rsp.Fields) == 4 {
+			return imap.AsNumber(rsp.Fields[3])
+		}
+	}
+	return 0
+}
+
+func (m *Mail) delete(c *imap.Client) error {
+	seq, _ := imap.NewSeqSet("")
+	seq.AddNum(m.UID)
+
+	if _, err := c.UIDStore(seq, "+FLAGS.SILENT", imap.NewFlagSet(`\Deleted`)); err != nil {
+		return fmt.Errorf("Error while deleting msg, err: %s", err.Error())
+	}
+	if _, err := c.Expunge(nil); err != nil {
+		return fmt.Errorf("Error while expunging messages: err: %s", err.Error())
+	}
+	return nil
+}
+
+// acquireConnection waits for a free connection slot when the number of
+// simultaneous connections is bounded, by maxconcurrentconnections or else by
+// the VENOM_IMAP_MAX_CONCURRENT_CONNECTIONS environment variable. The returned
+// function releases the slot, once the connection is logged out. A reconnection
+// reuses the slot of the closed connection.
+func (e *Executor) acquireConnection(ctx context.Context) (func(), error) {
+	limit := e.MaxConcurrentConnections
+	if limit == 0 {
+		if v := os.Getenv(maxConnectionsEnv); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %s", maxConnectionsEnv, v, err)
+			}
+			limit = n
+		}
+	}
+	if limit <= 0 {
+		return func() {}, nil
+	}
 
-// Mail contains an analyzed mail
-type Mail struct {
-	From    string
-	To      string
-	Subject string
-	UID     uint32
-	Body    string
-}
+	connections.Lock()
+	if connections.slots == nil {
+		connections.slots = make(chan struct{}, limit)
+	} else if cap(connections.slots) != limit {
+		venom.Warn(ctx, "maxconcurrentconnections %d ignored, connections are already bounded to %d", limit, cap(connections.slots))
+	}
+	slots := connections.slots
+	connections.Unlock()
 
-// Result represents a step result
-type Result struct {
-	Err         string  `json:"err" yaml:"error"`
-	Subject     string  `json:"subject,omitempty" yaml:"subject,omitempty"`
-	Body        string  `json:"body,omitempty" yaml:"body,omitempty"`
-	TimeSeconds float64 `json:"timeseconds,omitempty" yaml:"timeSeconds,omitempty"`
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "error while waiting for a connection slot")
+	}
+	return func() { <-slots }, nil
 }
 
-// ZeroValueResult return an empty implementation of this executor result
-func (Executor) ZeroValueResult() interface{} {
-	return Result{}
-}
+// connect dials the server and logs in. It also returns how the connection is
+// secured: tlsModeDirect, or tlsModeSTARTTLS when the connection was upgraded.
+func (e *Executor) connect(ctx context.Context) (*imap.Client, string, error) {
+	defer func(start time.Time) { e.connectDuration += time.Since(start) }(time.Now())
+	tlsMode, err := e.tlsMode()
+	if err != nil {
+		return nil, "", err
+	}
+	tlsConfig, err := e.tlsConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		venom.Warn(ctx, "The certificate of %s is not verified, imaptlsinsecureskipverify must only be used with test servers", e.address())
+	}
 
-// GetDefaultAssertions return default assertions for type exec
-func (Executor) GetDefaultAssertions() *venom.StepAssertions {
-	return &venom.StepAssertions{Assertions: []venom.Assertion{"result.err ShouldNotExist"}}
-}
+	timeout, err := e.dialTimeout()
+	if err != nil {
+		return nil, "", err
+	}
 
-// Run execute TestStep of type exec
-func (Executor) Run(ctx context.Context, step venom.TestStep) (interface{}, error) {
-	var e Executor
-	if err := mapstructure.Decode(step, &e); err != nil {
-		return nil, err
+	var c *imap.Client
+	var errd error
+	if e.SSHTunnel != nil {
+		c, errd = e.dialTunnel(ctx, tlsMode, tlsConfig, timeout)
+	} else if tlsMode == tlsModeSTARTTLS || tlsMode == tlsModePlaintext {
+		c, errd = dial(e.address(), nil, timeout, e.protocolLog)
+	} else if e.dialTLS != nil {
+		c, errd = e.dialTLS(e.address(), tlsConfig, timeout, e.protocolLog)
+	} else {
+		c, errd = dial(e.address(), tlsConfig, timeout, e.protocolLog)
+	}
+	if errd != nil {
+		return nil, "", fmt.Errorf("unable to dial %s: %s", e.address(), e.handshakeError(errd))
 	}
+	// The connection is closed on any error once dialed.
+	connected := false
+	defer func() {
+		if !connected {
+			c.Logout(5 * time.Second) // nolint
+		}
+	}()
 
-	start := time.Now()
+	if tlsMode == tlsModePlaintext && e.hasCap(ctx, c, "STARTTLS") {
+		tlsMode = tlsModeSTARTTLS
+	}
+	if tlsMode == tlsModeSTARTTLS {
+		if !e.hasCap(ctx, c, "STARTTLS") {
+			return nil, "", fmt.Errorf("tlsmode %s requires the STARTTLS capability, which is not advertised by the server", tlsModeSTARTTLS)
+		}
+		if _, err := check(c.StartTLS(tlsConfig)); err != nil {
+			return nil, "", errors.Wrap(e.handshakeError(err), "unable to start TLS")
+		}
+	}
 
-	result := Result{}
-	find, errs := e.getMail(ctx)
-	if errs != nil {
-		result.Err = errs.Error()
+	if c.State() == imap.Auth {
+		venom.Debug(ctx, "The server preauthenticated the connection, no login")
+		e.connAuthMechanism = authMechanismPreauth
+	} else {
+		if tlsMode == tlsModePlaintext {
+			venom.Warn(ctx, "The connection to %s is not encrypted, the credentials are sent in plain text", e.address())
+		}
+		if err := e.login(ctx, c); err != nil {
+			return nil, "", err
+		}
 	}
-	if find != nil {
-		result.Subject = find.Subject
-		result.Body = find.Body
-	} else if result.Err == "" {
-		result.Err = "searched mail not found"
+
+	if len(e.ClientID) > 0 && e.hasCap(ctx, c, "ID") {
+		if _, err := check(c.ID(clientIDFields(e.ClientID)...)); err != nil {
+			return nil, "", errors.Wrap(err, "unable to send client ID")
+		}
 	}
 
-	elapsed := time.Since(start)
-	result.TimeSeconds = elapsed.Seconds()
+	connected = true
+	return c, tlsMode, nil
+}
 
-	return result, nil
+// login authenticates c with IMAPAuthMethod: LOGIN with the password, or
+// AUTHENTICATE XOAUTH2 with the access token. The credentials are never
+// logged.
+func (e *Executor) login(ctx context.Context, c *imap.Client) error {
+	method, err := e.authMethod()
+	if err != nil {
+		return err
+	}
+	if method == authMethodXOAuth2 && !e.hasCap(ctx, c, "AUTH="+authMechanismXOAuth2) {
+		return fmt.Errorf("imapauthmethod %s requires the AUTH=%s capability, which is not advertised by the server", authMethodXOAuth2, authMechanismXOAuth2)
+	}
+	secret, err := e.password(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.protocolLog.login(false)
+	if method == authMethodXOAuth2 {
+		_, err = check(c.Auth(xoauth2Auth{user: e.IMAPUser, token: secret}))
+	} else {
+		_, err = check(c.Login(e.IMAPUser, secret))
+	}
+	e.protocolLog.login(true)
+	if err != nil {
+		return errors.Wrap(err, "unable to login")
+	}
+	if method == authMethodXOAuth2 {
+		e.connAuthMechanism = authMechanismXOAuth2
+	} else {
+		e.connAuthMechanism = authMechanismLogin
+	}
+	return nil
 }
 
-func (e *Executor) getMail(ctx context.Context) (*Mail, error) {
-	if e.SearchFrom == "" && e.SearchSubject == "" && e.SearchBody == "" && e.SearchTo == "" {
-		return nil, fmt.Errorf("you have to use one of searchfrom, searchto, searchsubject or subjectbody parameters")
+// authMethod returns IMAPAuthMethod, authMethodPassword by default.
+func (e *Executor) authMethod() (string, error) {
+	switch method := strings.ToLower(e.IMAPAuthMethod); method {
+	case "", authMethodPassword:
+		return authMethodPassword, nil
+	case authMethodXOAuth2:
+		return method, nil
 	}
+	return "", fmt.Errorf("unsupported imapauthmethod %q, expected %s or %s", e.IMAPAuthMethod, authMethodPassword, authMethodXOAuth2)
+}
 
-	c, errc := connect(e.IMAPHost, e.IMAPPort, e.IMAPUser, e.IMAPPassword)
-	if errc != nil {
-		return nil, errors.Wrapf(errc, "error while connecting")
+// dialTimeout returns IMAPDialTimeout, defaultDialTimeout by default.
+func (e *Executor) dialTimeout() (time.Duration, error) {
+	if e.IMAPDialTimeout == "" {
+		return defaultDialTimeout, nil
 	}
-	defer c.Logout(5 * time.Second) // nolint
+	timeout, err := time.ParseDuration(e.IMAPDialTimeout)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid imapdialtimeout %q, expected a positive duration such as 10s", e.IMAPDialTimeout)
+	}
+	return timeout, nil
+}
 
-	var box string
+// tlsMode returns how the connection must be secured, TLSMode or else
+// tlsModeDirect, or tlsModePlaintext with IMAPWithTLS false: the connection is
+// then only upgraded if the server advertises STARTTLS.
+func (e *Executor) tlsMode() (string, error) {
+	mode := strings.ToLower(e.TLSMode)
+	if e.IMAPWithTLS != nil && !*e.IMAPWithTLS {
+		switch mode {
+		case "":
+			return tlsModePlaintext, nil
+		case tlsModeSTARTTLS:
+			return mode, nil
+		}
+		return "", fmt.Errorf("imapwithtls false is incompatible with tlsmode %q", e.TLSMode)
+	}
+	switch mode {
+	case "":
+		return tlsModeDirect, nil
+	case tlsModeDirect, tlsModeSTARTTLS:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unsupported tlsmode %q, expected %s or %s", e.TLSMode, tlsModeDirect, tlsModeSTARTTLS)
+}
 
-	if e.MBox == "" {
-		box = "INBOX"
-	} else {
-		box = e.MBox
+// address returns the host:port of the server. The default port depends on
+// the TLS mode: 993 for direct TLS, 143 for STARTTLS and plain connections.
+func (e *Executor) address() string {
+	host, port := e.IMAPHost, e.IMAPPort
+	if !strings.Contains(host, ":") {
+		if port == "" {
+			port = ":993"
+			if mode, _ := e.tlsMode(); mode == tlsModeSTARTTLS || mode == tlsModePlaintext {
+				port = ":143"
+			}
+		} else if !strings.HasPrefix(port, ":") {
+			port = ":" + port
+		}
 	}
+	return host + port
+}
 
-	count, err := queryCount(c, box)
+// effectiveConfig describes the configuration used to search the mail, once
+// the defaults applied, for the debug logs. The password is never included.
+func (e *Executor) effectiveConfig() string {
+	password := "<empty>"
+	if e.CredentialProvider != "" {
+		password = "<credentialprovider " + e.CredentialProvider + ">"
+	} else if e.IMAPPassword != "" || e.IMAPAccessToken != "" {
+		password = "<redacted>"
+	}
+	tlsMode, err := e.tlsMode()
 	if err != nil {
-		return nil, errors.Wrapf(err, "error while queryCount")
+		tlsMode = e.TLSMode
 	}
+	if caCert, option, _ := e.caCert(); caCert != "" {
+		tlsMode += ", " + option + " " + caCert
+		if e.TLSCAOnly {
+			tlsMode += " only"
+		}
+	}
+	criteria := []string{}
+	for _, c := range []struct{ name, value string }{
+		{"searchfrom", e.SearchFrom},
+		{"searchto", e.SearchTo},
+		{"searchrecipient", e.SearchRecipient},
+		{"searchsubject", e.SearchSubject},
+		{"searchbody", e.SearchBody},
+		{"searchattachment", e.SearchAttachment},
+		{"excludeattachment", e.ExcludeAttachment},
+		{"searchattachmenttype", e.SearchAttachmentType},
+		{"searchmimepart", e.SearchMIMEPart},
+		{"gmaillabel", e.GmailLabel},
+		{"searchthreadid", e.SearchThreadID},
+		{"searchpriority", e.SearchPriority},
+		{"searchdkimdomain", e.SearchDKIMDomain},
+		{"searchdkimselector", e.SearchDKIMSelector},
+		{"searchforwardedfrom", e.SearchForwardedFrom},
+		{"searchforwardedsubject", e.SearchForwardedSubject},
+		{"searchforwardedbody", e.SearchForwardedBody},
+		{"searchsince", e.SearchSince},
+		{"searchtimeofdayfrom", e.SearchTimeOfDayFrom},
+		{"searchtimeofdayto", e.SearchTimeOfDayTo},
+	} {
+		if c.value != "" {
+			criteria = append(criteria, fmt.Sprintf("%s=%q", c.name, c.value))
+		}
+	}
+	return fmt.Sprintf("address=%s user=%q password=%s mbox=%q tls=%q criteria=[%s]",
+		e.address(), e.IMAPUser, password, strings.Join(e.mailboxes(), ","), tlsMode, strings.Join(criteria, " "))
+}
 
-	venom.Debug(ctx, "count messages:%d", count)
-
-	if count == 0 {
-		return nil, errors.New("No message to fetch")
+// logout closes the mailbox selected on c, if any, then ends the connection.
+// It is the only teardown of the connections, deferred once they are open.
+func (e *Executor) logout(c *imap.Client) {
+	if c.State() == imap.Selected {
+		c.Close(false) // nolint
 	}
+	c.Logout(5 * time.Second) // nolint
+}
 
-	messages, err := fetch(ctx, c, box, count)
+// tlsConfig returns the configuration of the TLS connection. The
+// certificates of TLSCACert, or IMAPCACertFile, are trusted besides the system
+// roots, or instead of them with TLSCAOnly, and only the TLSCipherSuites are
+// allowed, from IMAPTLSMinVersion. The client certificate IMAPClientCertFile
+// is presented to the servers requiring one. The negotiated version and
+// cipher suite are kept for the result.
+func (e *Executor) tlsConfig() (*tls.Config, error) {
+	minVersion, err := e.tlsMinVersion()
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error while feching messages")
+		return nil, err
+	}
+	// The certificate of a staging server may be self-signed.
+	config := &tls.Config{InsecureSkipVerify: e.IMAPTLSInsecureSkipVerify} // nolint
+	if err := e.restrictCipherSuites(config); err != nil {
+		return nil, err
+	}
+	if config.MinVersion < minVersion {
+		config.MinVersion = minVersion
+	}
+	if config.MaxVersion != 0 && config.MaxVersion < config.MinVersion {
+		return nil, fmt.Errorf("imaptlsminversion %s excludes all the tlsciphersuites, add a TLS 1.3 cipher suite", e.IMAPTLSMinVersion)
+	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		e.connTLSVersion = tlsVersionName(cs.Version)
+		e.connTLSCipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+		// The TLS 1.3 cipher suites are not configurable, they are checked
+		// once negotiated.
+		if len(e.TLSCipherSuites) > 0 && !e.allowedCipherSuite(e.connTLSCipherSuite) {
+			return fmt.Errorf("tls: the negotiated cipher suite %s is not allowed by tlsciphersuites", e.connTLSCipherSuite)
+		}
+		return nil
 	}
-	defer c.Close(false)
 
-	for _, msg := range messages {
-		m, erre := extract(ctx, msg)
-		if erre != nil {
-			venom.Warn(ctx, "Cannot extract the content of the mail: %s", erre)
-			continue
+	if e.IMAPClientCertFile != "" || e.IMAPClientKeyFile != "" {
+		if e.IMAPClientCertFile == "" || e.IMAPClientKeyFile == "" {
+			return nil, fmt.Errorf("imapclientcertfile and imapclientkeyfile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(e.IMAPClientCertFile, e.IMAPClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load the client certificate")
 		}
+		config.Certificates = []tls.Certificate{cert}
+	}
 
-		found, errs := e.isSearched(m)
-		if errs != nil {
-			return nil, errs
+	caCert, option, err := e.caCert()
+	if err != nil {
+		return nil, err
+	}
+	if caCert == "" {
+		if e.TLSCAOnly {
+			return nil, fmt.Errorf("tlscaonly requires tlscacert")
 		}
+		return config, nil
+	}
 
-		if found {
-			if e.DeleteOnSuccess {
-				venom.Debug(ctx, "Delete message %v", m.UID)
-				if err := m.delete(c); err != nil {
-					return nil, err
-				}
-			} else if e.MBoxOnSuccess != "" {
-				venom.Debug(ctx, "Move to %s", e.MBoxOnSuccess)
-				if err := m.move(c, e.MBoxOnSuccess); err != nil {
-					return nil, err
-				}
-			}
-			return m, nil
+	pem, err := os.ReadFile(caCert)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", option)
+	}
+	pool := x509.NewCertPool()
+	if !e.TLSCAOnly {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, errors.Wrapf(err, "unable to load the system roots")
 		}
 	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s %s", option, caCert)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
 
-	return nil, errors.New("Mail not found")
+// tlsMinVersion returns the minimum TLS version of IMAPTLSMinVersion, TLS 1.2
+// by default.
+func (e *Executor) tlsMinVersion() (uint16, error) {
+	switch e.IMAPTLSMinVersion {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported imaptlsminversion %q, expected 1.0, 1.1, 1.2 or 1.3", e.IMAPTLSMinVersion)
 }
 
-func (e *Executor) isSearched(m *Mail) (bool, error) {
-	if e.SearchFrom != "" {
-		ma, erra := regexp.MatchString(e.SearchFrom, m.From)
-		if erra != nil || !ma {
-			return false, erra
-		}
+// caCert returns the path of the CA certificates, TLSCACert or its alias
+// IMAPCACertFile, and the name of the option setting it.
+func (e *Executor) caCert() (string, string, error) {
+	switch {
+	case e.IMAPCACertFile == "":
+		return e.TLSCACert, "tlscacert", nil
+	case e.TLSCACert == "" || e.TLSCACert == e.IMAPCACertFile:
+		return e.IMAPCACertFile, "imapcacertfile", nil
 	}
-	if e.SearchTo != "" {
-		mt, erra := regexp.MatchString(e.SearchTo, m.To)
-		if erra != nil || !mt {
-			return false, erra
-		}
+	return "", "", fmt.Errorf("imapcacertfile and tlscacert are both set, use only one of them")
+}
+
+// restrictCipherSuites allows only the TLSCipherSuites in config, Go's
+// defaults without them. As the TLS 1.3 cipher suites cannot be configured,
+// the versions are bounded to those of the allowed cipher suites.
+func (e *Executor) restrictCipherSuites(config *tls.Config) error {
+	if len(e.TLSCipherSuites) == 0 {
+		return nil
 	}
-	if e.SearchSubject != "" {
-		mb, errb := regexp.MatchString(e.SearchSubject, m.Subject)
-		if errb != nil || !mb {
-			return false, errb
+	known := map[string]*tls.CipherSuite{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs
+	}
+
+	var tls12, tls13 bool
+	for _, name := range e.TLSCipherSuites {
+		cs, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown tlsciphersuites %q, expected a cipher suite name such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", name)
+		}
+		// The cipher suites are either specific to TLS 1.3 or older.
+		if cs.SupportedVersions[0] == tls.VersionTLS13 {
+			tls13 = true
+			continue
 		}
+		tls12 = true
+		config.CipherSuites = append(config.CipherSuites, cs.ID)
 	}
-	if e.SearchBody != "" {
-		mc, errc := regexp.MatchString(e.SearchBody, m.Body)
-		if errc != nil || !mc {
-			return false, errc
+	if !tls13 {
+		config.MaxVersion = tls.VersionTLS12
+	}
+	if !tls12 {
+		config.MinVersion = tls.VersionTLS13
+	}
+	return nil
+}
+
+// allowedCipherSuite returns true if the cipher suite name is one of the
+// TLSCipherSuites.
+func (e *Executor) allowedCipherSuite(name string) bool {
+	for _, allowed := range e.TLSCipherSuites {
+		if strings.EqualFold(allowed, name) {
+			return true
 		}
 	}
-	return true, nil
+	return false
 }
 
-func (m *Mail) move(c *imap.Client, mbox string) error {
-	seq, _ := imap.NewSeqSet("")
-	seq.AddNum(m.UID)
+// handshakeError adds a hint to a TLS error of the handshake when the cipher
+// suites are restricted, as the server usually just aborts it.
+func (e *Executor) handshakeError(err error) error {
+	if len(e.TLSCipherSuites) == 0 || !strings.Contains(err.Error(), "tls:") {
+		return err
+	}
+	return fmt.Errorf("%s (the server may not support any of the tlsciphersuites %s)", err, strings.Join(e.TLSCipherSuites, ", "))
+}
 
-	if _, err := c.UIDMove(seq, mbox); err != nil {
-		return fmt.Errorf("Error while move msg to %s: %v", mbox, err.Error())
+// tlsVersionName returns the name of a TLS version, as result.tlsversion.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
 	}
-	return nil
+	return fmt.Sprintf("0x%04X", version)
 }
 
-func (m *Mail) delete(c *imap.Client) error {
-	seq, _ := imap.NewSeqSet("")
-	seq.AddNum(m.UID)
+// clientIDFields flattens the client ID map into the field-value list
+// expected by the ID command (RFC 2971), sorted by field name.
+func clientIDFields(clientID map[string]string) []string {
+	keys := make([]string, 0, len(clientID))
+	for k := range clientID {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	if _, err := c.UIDStore(seq, "+FLAGS.SILENT", imap.NewFlagSet(`\Deleted`)); err != nil {
-		return fmt.Errorf("Error while deleting msg, err: %s", err.Error())
+	fields := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		fields = append(fields, k, clientID[k])
 	}
-	if _, err := c.Expunge(nil); err != nil {
-		return fmt.Errorf("Error while expunging messages: err: %s", err.Error())
+	return fields
+}
+
+// fetch returns the messages of box. If the server closes the connection
+// meanwhile, it reconnects up to MaxReconnects times and fetches the messages
+// after the last received UID. The client to use afterwards is returned.
+func (e *Executor) fetch(ctx context.Context, c *imap.Client, box string) (*imap.Client, []imap.Response, error) {
+	defer func(start time.Time, connect, sel time.Duration) {
+		// The reconnections and the selections are timed apart.
+		e.fetchDuration += time.Since(start) - (e.connectDuration - connect) - (e.selectDuration - sel)
+	}(time.Now(), e.connectDuration, e.selectDuration)
+	messages := []imap.Response{}
+	lastUID := e.sinceUID()
+	criteria, _ := e.sortCriteria()
+	// sorted are the UIDs in the order of the server, if it can sort them.
+	var sorted []uint32
+	for reconnects := 0; ; reconnects++ {
+		var msgs []imap.Response
+		err := e.selectMailbox(ctx, c, box)
+		if err == nil && len(criteria) > 0 && sorted == nil && e.hasCap(ctx, c, "SORT") {
+			sorted, err = e.serverSort(c, criteria, e.searchKeys(c), lastUID)
+		}
+		if err == nil && (e.FirstUnseen || e.SeqNum > 0) {
+			seqNum := e.seqNum(ctx, c, box)
+			if seqNum == 0 {
+				return c, messages, nil
+			}
+			msgs, err = fetchSeqNum(ctx, c, e.fetchItems(ctx, c), seqNum, e.spool)
+			messages = append(messages, msgs...)
+		} else if err == nil {
+			msgs, err = fetchSince(ctx, c, e.fetchItems(ctx, c), e.searchKeys(c), sorted, lastUID, e.spool)
+			messages = append(messages, msgs...)
+		}
+		if err == nil {
+			return c, sortMessages(messages, criteria, sorted), nil
+		}
+		if c.State() != imap.Closed || reconnects >= e.MaxReconnects {
+			return c, messages, err
+		}
+
+		for _, msg := range msgs {
+			if uid := msg.MessageInfo().UID; uid > lastUID {
+				lastUID = uid
+			}
+		}
+		venom.Warn(ctx, "Connection closed while fetching messages (%s), reconnecting %d/%d from UID %d", err, reconnects+1, e.MaxReconnects, lastUID)
+		nc, tlsMode, errc := e.connect(ctx)
+		if errc != nil {
+			return c, messages, errors.Wrapf(errc, "error while reconnecting")
+		}
+		c = nc
+		e.connTLSMode = tlsMode
 	}
-	return nil
 }
 
-func connect(host, port, imapUsername, imapPassword string) (*imap.Client, error) {
-	if !strings.Contains(host, ":") {
-		if port == "" {
-			port = ":993"
-		} else if port != "" && !strings.HasPrefix(port, ":") {
-			port = ":" + port
+// seqNum returns the sequence number of the message to fetch in the selected
+// mailbox box, with FirstUnseen or SeqNum, 0 if there is no such message.
+func (e *Executor) seqNum(ctx context.Context, c *imap.Client, box string) uint32 {
+	if c.Mailbox == nil {
+		return 0
+	}
+	if e.FirstUnseen {
+		if c.Mailbox.Unseen == 0 {
+			venom.Debug(ctx, "No unseen message in %s", box)
+		} else {
+			venom.Debug(ctx, "First unseen message: %d", c.Mailbox.Unseen)
 		}
+		return c.Mailbox.Unseen
+	}
+	if uint32(e.SeqNum) > c.Mailbox.Messages {
+		venom.Debug(ctx, "No message %d in %s, which has %d messages", e.SeqNum, box, c.Mailbox.Messages)
+		return 0
 	}
+	return uint32(e.SeqNum)
+}
 
-	c, errd := imap.DialTLS(host+port, nil)
-	if errd != nil {
-		return nil, fmt.Errorf("unable to dial: %s", errd)
+// fetchItems returns the data items to fetch for each message: FetchItems if
+// set, plus UID which is always needed. Otherwise the body is only fetched if
+// needed to search the mail or asked with ReturnBody. The Gmail labels are
+// fetched when searched, and the thread ID on Gmail servers.
+func (e *Executor) fetchItems(ctx context.Context, c *imap.Client) []string {
+	items := []string{"ENVELOPE", "RFC822.HEADER", "UID"}
+	if len(e.FetchItems) > 0 {
+		items = []string{}
+		for _, item := range e.FetchItems {
+			items = append(items, strings.ToUpper(item))
+		}
+	} else {
+		if e.SearchBody != "" || e.ReturnBody || e.RenderHTML || e.ExtractBody != "" || e.searchAttachments() || e.ReturnAttachments || e.SearchMIMEPart != "" || e.IncludeInline || e.followForwarded() {
+			if e.BodyMaxFetch > 0 {
+				items = append(items, fmt.Sprintf("BODY[TEXT]<0.%d>", e.BodyMaxFetch))
+			} else {
+				items = append(items, "RFC822.TEXT")
+			}
+		}
+		if e.hasCap(ctx, c, "X-GM-EXT-1") {
+			items = append(items, "X-GM-THRID")
+		}
+		if e.SortBy != "" && !e.hasCap(ctx, c, "SORT") {
+			// Attributes compared to sort the messages.
+			items = append(items, "INTERNALDATE", "RFC822.SIZE")
+		}
 	}
+	if e.GmailLabel != "" {
+		items = append(items, "X-GM-LABELS")
+	}
+	if e.SearchSince != "" {
+		items = appendMissing(items, "INTERNALDATE")
+	}
+	if e.SinceUID != nil {
+		// For result.totalsize.
+		items = appendMissing(items, "RFC822.SIZE")
+	}
+	if e.FetchBodyPart != "" {
+		// The MIME header of the part tells how to decode it.
+		items = appendMissing(items, "BODY.PEEK["+e.FetchBodyPart+".MIME]")
+		items = appendMissing(items, "BODY.PEEK["+e.FetchBodyPart+"]")
+	}
+	return appendMissing(items, "UID")
+}
 
-	if c.Caps["STARTTLS"] {
-		if _, err := check(c.StartTLS(nil)); err != nil {
-			return nil, fmt.Errorf("unable to start TLS: %s", err)
+// appendMissing appends item to items, unless it is already there.
+func appendMissing(items []string, item string) []string {
+	for _, i := range items {
+		if i == item {
+			return items
 		}
 	}
+	return append(items, item)
+}
 
-	c.SetLogMask(imapSafeLogMask)
-	if _, err := check(c.Login(imapUsername, imapPassword)); err != nil {
-		return nil, fmt.Errorf("unable to login: %s", err)
+// selectMailbox selects box. The SELECT is retried a few times if the server
+// refuses it, the mailbox may be locked by another session. The ALERT texts
+// sent by the server are kept in alerts.
+func (e *Executor) selectMailbox(ctx context.Context, c *imap.Client, box string) error {
+	defer func(start time.Time) { e.selectDuration += time.Since(start) }(time.Now())
+	backoff := selectBackoff
+	for attempt := 1; ; attempt++ {
+		venom.Debug(ctx, "call Select")
+		_, err := c.Select(box, false)
+		e.alerts = append(e.alerts, alerts(c)...)
+		if err == nil {
+			return nil
+		}
+		rerr, ok := err.(imap.ResponseError)
+		if ok && rerr.Response != nil {
+			if rerr.Label == "ALERT" {
+				e.alerts = append(e.alerts, rerr.Info)
+			}
+			err = commandError{name: "SELECT", rsp: rerr.Response}
+		}
+		if !e.isRetryable(err) || attempt >= selectAttempts {
+			venom.Error(ctx, "Error with select %s", err.Error())
+			return err
+		}
+		venom.Warn(ctx, "Select %s refused (%s), retrying in %s", box, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
 	}
-	c.SetLogMask(imapLogMask)
+}
 
-	return c, nil
+// isTransient reports whether a NO response may succeed later, by its
+// response code. The refusals without one, as for a mailbox which does not
+// exist, are only retried with retryoncodes.
+func isTransient(rsp *imap.Response) bool {
+	switch rsp.Label {
+	case "ALERT", "INUSE", "UNAVAILABLE":
+		return true
+	}
+	return false
 }
 
-func fetch(ctx context.Context, c *imap.Client, box string, nb uint32) ([]imap.Response, error) {
-	venom.Debug(ctx, "call Select")
-	if _, err := c.Select(box, false); err != nil {
-		venom.Error(ctx, "Error with select %s", err.Error())
-		return []imap.Response{}, err
+// alerts returns the text of the untagged ALERT responses received by c and
+// removes them from c.Data.
+func alerts(c *imap.Client) []string {
+	var texts []string
+	data := c.Data[:0]
+	for _, rsp := range c.Data {
+		if rsp.Label == "ALERT" {
+			texts = append(texts, rsp.Info)
+			continue
+		}
+		data = append(data, rsp)
+	}
+	c.Data = data
+	return texts
+}
+
+// knownFetchItems are the data items which can be set in FetchItems, besides
+// BODY[<section>] and BODY.PEEK[<section>].
+var knownFetchItems = map[string]bool{
+	"ENVELOPE":      true,
+	"FLAGS":         true,
+	"INTERNALDATE":  true,
+	"RFC822":        true,
+	"RFC822.HEADER": true,
+	"RFC822.SIZE":   true,
+	"RFC822.TEXT":   true,
+	"UID":           true,
+	"BODYSTRUCTURE": true,
+	"X-GM-LABELS":   true,
+	"X-GM-MSGID":    true,
+	"X-GM-THRID":    true,
+}
+
+// bodyPartRegexp matches the MIME section numbers of FetchBodyPart.
+var bodyPartRegexp = regexp.MustCompile(`^[1-9][0-9]*(\.[1-9][0-9]*)*$`)
+
+var bodySectionRegexp = regexp.MustCompile(`^BODY(\.PEEK)?\[[A-Z0-9.]*\](<\d+\.\d+>)?$`)
+
+// checkFetchItems returns an error if FetchItems contains an unknown item.
+func (e *Executor) checkFetchItems() error {
+	for _, item := range e.FetchItems {
+		item = strings.ToUpper(item)
+		if !knownFetchItems[item] && !bodySectionRegexp.MatchString(item) {
+			return fmt.Errorf("unsupported fetchitems item %q", item)
+		}
 	}
+	return nil
+}
 
-	seqset, _ := imap.NewSeqSet("1:*")
+// fetchSince returns the messages of the selected mailbox with an UID greater
+// than sinceUID, all of them if sinceUID is 0. With uids, only these messages
+// are fetched, otherwise with search keys, only the messages found by the
+// server. With sp, the bodies are written to disk as they are received.
+func fetchSince(ctx context.Context, c *imap.Client, items []string, search []imap.Field, uids []uint32, sinceUID uint32, sp *spool) ([]imap.Response, error) {
+	var cmd *imap.Command
+	var err error
+	if uids == nil && len(search) > 0 {
+		var errs error
+		uids, errs = uidSearch(c, search...)
+		if errs != nil {
+			venom.Error(ctx, "Error with search %v:%s", search, errs)
+			return []imap.Response{}, errs
+		}
+		venom.Debug(ctx, "Nb messages found by search %v:%d", search, len(uids))
+		if uids == nil {
+			uids = []uint32{}
+		}
+	}
+	if uids != nil {
+		seqset, _ := imap.NewSeqSet("")
+		for _, uid := range uids {
+			if uid > sinceUID {
+				seqset.AddNum(uid)
+			}
+		}
+		if seqset.Empty() {
+			return []imap.Response{}, nil
+		}
+		cmd, err = c.UIDFetch(seqset, items...)
+	} else if sinceUID > 0 {
+		seqset, _ := imap.NewSeqSet(fmt.Sprintf("%d:*", sinceUID+1))
+		cmd, err = c.UIDFetch(seqset, items...)
+	} else {
+		seqset, _ := imap.NewSeqSet("1:*")
+		cmd, err = c.Fetch(seqset, items...)
+	}
+	if err != nil {
+		venom.Error(ctx, "Error with fetch:%s", err)
+		return []imap.Response{}, err
+	}
+	return receive(ctx, c, cmd, sinceUID, sp)
+}
 
-	cmd, err := c.Fetch(seqset, "ENVELOPE", "RFC822.HEADER", "RFC822.TEXT", "UID")
+// fetchSeqNum fetches the message of sequence number seqNum.
+func fetchSeqNum(ctx context.Context, c *imap.Client, items []string, seqNum uint32, sp *spool) ([]imap.Response, error) {
+	seqset, _ := imap.NewSeqSet("")
+	seqset.AddNum(seqNum)
+	cmd, err := c.Fetch(seqset, items...)
 	if err != nil {
 		venom.Error(ctx, "Error with fetch:%s", err)
 		return []imap.Response{}, err
 	}
+	return receive(ctx, c, cmd, 0, sp)
+}
 
+// receive returns the messages fetched by cmd as they are received, the ones
+// with a UID greater than sinceUID.
+func receive(ctx context.Context, c *imap.Client, cmd *imap.Command, sinceUID uint32, sp *spool) ([]imap.Response, error) {
 	messages := []imap.Response{}
 	for cmd.InProgress() {
 		// Wait for the next response (no timeout)
-		c.Recv(-1)
+		errr := c.Recv(-1)
 
 		// Process command data
 		for _, rsp := range cmd.Data {
+			// "n:*" always returns the last message, even if its UID is lower than n.
+			if rsp.MessageInfo().UID <= sinceUID {
+				continue
+			}
+			if sp != nil {
+				if err := sp.store(rsp); err != nil {
+					return messages, err
+				}
+			}
 			messages = append(messages, *rsp)
 		}
 		cmd.Data = nil
 		c.Data = nil
+		if errr != nil {
+			venom.Debug(ctx, "Error while receiving messages:%s", errr)
+			break
+		}
 	}
 	venom.Debug(ctx, "Nb messages fetch:%d", len(messages))
+	if _, err := cmd.Result(imap.OK); err != nil {
+		return messages, err
+	}
 	return messages, nil
 }
 
+// uidSearch returns the UIDs of the messages of the selected mailbox
+// matching the search keys.
+func uidSearch(c *imap.Client, keys ...imap.Field) ([]uint32, error) {
+	cmd, err := check(c.UIDSearch(keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, rsp := range cmd.Data {
+		uids = append(uids, rsp.SearchResults()...)
+	}
+	return uids, nil
+}
+
+// searchKeys returns the search keys of the criteria handled by the server,
+// Gmail ones.
+func (e *Executor) searchKeys(c *imap.Client) []imap.Field {
+	var keys []imap.Field
+	if e.GmailLabel != "" {
+		keys = append(keys, "X-GM-LABELS", c.Quote(imap.UTF7Encode(e.GmailLabel)))
+	}
+	if e.SearchThreadID != "" {
+		keys = append(keys, "X-GM-THRID", e.SearchThreadID)
+	}
+	if !e.since.IsZero() {
+		// SINCE ignores the time and the timezone, the day before narrows
+		// the search whatever the timezone of the server.
+		keys = append(keys, "SINCE", e.since.AddDate(0, 0, -1).Format("2-Jan-2006"))
+	}
+	return keys
+}
+
 func queryCount(imapClient *imap.Client, box string) (uint32, error) {
 	cmd, errc := check(imapClient.Status(box))
 	if errc != nil {
@@ -290,13 +2786,18 @@ func queryCount(imapClient *imap.Client, box string) (uint32, error) {
 }
 
 func check(cmd *imap.Command, erri error) (*imap.Command, error) {
-	if erri != nil {
-		return nil, erri
+	err := erri
+	if err == nil {
+		_, err = cmd.Result(imap.OK)
 	}
-
-	if _, err := cmd.Result(imap.OK); err != nil {
-		return nil, err
+	if err == nil {
+		return cmd, nil
 	}
 
-	return cmd, nil
+	// Commands such as LOGIN already wait for their completion.
+	if rerr, ok := err.(imap.ResponseError); ok && cmd != nil && rerr.Response != nil {
+		// The command name only, cmd.String() holds the LOGIN password.
+		return nil, commandError{name: cmd.Name(true), rsp: rerr.Response}
+	}
+	return nil, err
 }
@@ -0,0 +1,2805 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ovh/cds/sdk/interpolate"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ovh/venom"
+)
+
+// updateGolden rewrites testdata/result.json from TestResult_JSON.
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+const (
+	testMailOrder = `From: Shop <shop@example.org>
+To: customer@example.com
+Subject: Order 42 confirmed
+Content-Type: text/plain; charset=utf-8
+
+Your order 42 is confirmed.
+`
+	testMailNewsletter = `From: news@example.net
+To: customer@example.com
+Subject: Weekly newsletter
+Content-Type: text/plain; charset=utf-8
+
+Read the news of the week.
+`
+	testMailInvoice = `From: Shop <shop@example.org>
+To: customer@example.com
+Subject: Invoice 42
+Content-Type: multipart/mixed; boundary="mixed"
+
+--mixed
+Content-Type: multipart/related; boundary="related"
+
+--related
+Content-Type: text/html; charset=utf-8
+
+<p>Your invoice 42.</p><img src="cid:logo">
+--related
+Content-Type: image/png; name="logo.png"
+Content-Disposition: inline; filename="logo.png"
+Content-Id: <logo>
+
+iVBORw0KGgo=
+--related--
+--mixed
+Content-Type: application/pdf; name="invoice-42.pdf"
+Content-Disposition: attachment; filename="invoice-42.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--mixed
+Content-Type: text/csv; name="=?utf-8?q?d=C3=A9tails.csv?="
+
+id;amount
+--mixed
+Content-Type: text/calendar; method=REQUEST
+Content-Disposition: attachment
+
+BEGIN:VCALENDAR
+END:VCALENDAR
+--mixed--
+`
+)
+
+func newTestServerWithMails(t *testing.T) *testServer {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailNewsletter)
+	s.AddMessage("INBOX", testMailOrder)
+	return s
+}
+
+func TestExecutor_getMail(t *testing.T) {
+	tests := []struct {
+		name        string
+		criteria    Executor
+		wantSubject string
+		wantErr     string
+	}{
+		{name: "no criteria", wantErr: "you have to use one of"},
+		{name: "from", criteria: Executor{SearchFrom: `shop@example\.org`}, wantSubject: "Order 42 confirmed"},
+		{name: "to", criteria: Executor{SearchTo: `customer@`}, wantSubject: "Weekly newsletter"},
+		{name: "subject", criteria: Executor{SearchSubject: "Order .* confirmed"}, wantSubject: "Order 42 confirmed"},
+		{name: "body", criteria: Executor{SearchBody: "news of the week"}, wantSubject: "Weekly newsletter"},
+		{name: "from and subject", criteria: Executor{SearchFrom: "news@", SearchSubject: "newsletter"}, wantSubject: "Weekly newsletter"},
+		{name: "from and body mismatch", criteria: Executor{SearchFrom: "news@", SearchBody: "order 42"}, wantErr: "Mail not found"},
+		{name: "all criteria", criteria: Executor{SearchFrom: "shop@", SearchTo: "customer@", SearchSubject: "Order", SearchBody: "confirmed"}, wantSubject: "Order 42 confirmed"},
+		{name: "not found", criteria: Executor{SearchSubject: "Invoice"}, wantErr: "Mail not found"},
+		{name: "invalid regexp", criteria: Executor{SearchSubject: "(Order"}, wantErr: "error parsing regexp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServerWithMails(t)
+			e := s.Executor()
+			e.SearchFrom, e.SearchTo, e.SearchSubject, e.SearchBody = tt.criteria.SearchFrom, tt.criteria.SearchTo, tt.criteria.SearchSubject, tt.criteria.SearchBody
+
+			m, err := e.getMail(context.Background())
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSubject, m.Subject)
+		})
+	}
+}
+
+func TestExecutor_getMail_CriteriaAlone(t *testing.T) {
+	score := 0.0
+	for name, criteria := range map[string]func(e *Executor){
+		"minrecipients":       func(e *Executor) { e.MinRecipients = 1 },
+		"maxrecipients":       func(e *Executor) { e.MaxRecipients = 5 },
+		"searchtimeofdayfrom": func(e *Executor) { e.SearchTimeOfDayFrom = "00:00" },
+		"searchtimeofdayto":   func(e *Executor) { e.SearchTimeOfDayTo = "23:59" },
+		"minspamscore":        func(e *Executor) { e.MinSpamScore = &score },
+		"maxspamscore":        func(e *Executor) { e.MaxSpamScore = &score },
+	} {
+		s := newTestServerWithMails(t)
+		e := s.Executor()
+		criteria(&e)
+
+		_, err := e.getMail(context.Background())
+		if err != nil {
+			require.NotContains(t, err.Error(), "you have to use one of", name)
+		}
+	}
+}
+
+func TestExecutor_getMail_EmptyMailbox(t *testing.T) {
+	s := newTestServer(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	_, err := e.getMail(context.Background())
+	require.EqualError(t, err, "No message to fetch")
+}
+
+func TestExecutor_getMail_BadCredentials(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.IMAPPassword = "wrong"
+	e.SearchSubject = "Order"
+
+	_, err := e.getMail(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to login")
+}
+
+func TestExecutor_Run_BadCredentials(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"imappassword":  "wrong",
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+
+	result := r.(Result)
+	require.Contains(t, result.Err, "unable to login: LOGIN failed: NO [AUTHENTICATIONFAILED] Invalid credentials")
+	require.NotContains(t, result.Err, "wrong")
+	require.Equal(t, "AUTHENTICATIONFAILED", result.ErrCode)
+}
+
+func TestExecutor_getMail_EmptyCredentials(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	e.IMAPUser = ""
+	_, err := e.getMail(context.Background())
+	require.EqualError(t, err, "imapuser is required")
+
+	e.IMAPUser, e.IMAPPassword = s.User, ""
+	_, err = e.getMail(context.Background())
+	require.EqualError(t, err, "imappassword is required")
+	require.Empty(t, s.Commands())
+
+	s.Update(func() { s.User, s.Password = "anonymous", "" })
+	e.IMAPUser, e.AllowAnonymous = "anonymous", true
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+}
+
+func TestExecutor_getMail_Teardown(t *testing.T) {
+	tail := func(commands []string) []string {
+		if len(commands) < 3 {
+			return commands
+		}
+		return commands[len(commands)-3:]
+	}
+
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	_, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"FETCH", "EXAMINE", "LOGOUT"}, tail(s.Commands()))
+
+	// The mailbox is closed on the error paths too.
+	s = newTestServerWithMails(t)
+	e = s.Executor()
+	e.SearchSubject = "Order"
+	e.FetchItems = []string{"BODYSTRUCTURE"}
+	_, err = e.getMail(context.Background())
+	require.Error(t, err)
+	require.Equal(t, []string{"FETCH", "EXAMINE", "LOGOUT"}, tail(s.Commands()))
+}
+
+func TestExecutor_getMail_TLSCACert(t *testing.T) {
+	s := newTestServerWithMails(t)
+	other := newTestServer(t)
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, content, 0600))
+		return path
+	}
+	tests := []struct {
+		name       string
+		caCert     string
+		caCertFile string
+		caOnly     bool
+		wantErr    string
+	}{
+		{name: "server CA only", caCert: write("server.pem", s.CACert), caOnly: true},
+		{name: "imapcacertfile", caCertFile: write("server.pem", s.CACert), caOnly: true},
+		{name: "imapcacertfile and the same tlscacert", caCert: write("server.pem", s.CACert), caCertFile: write("server.pem", s.CACert), caOnly: true},
+		{name: "imapcacertfile and another tlscacert", caCert: write("other.pem", other.CACert), caCertFile: write("server.pem", s.CACert), wantErr: "imapcacertfile and tlscacert are both set"},
+		{name: "missing imapcacertfile", caCertFile: filepath.Join(dir, "missing.pem"), wantErr: "unable to read imapcacertfile"},
+		{name: "server CA and system roots", caCert: write("server.pem", s.CACert)},
+		{name: "other CA", caCert: write("other.pem", other.CACert), caOnly: true, wantErr: "certificate signed by unknown authority"},
+		{name: "no certificate", caCert: write("empty.pem", []byte("not a certificate")), wantErr: "no certificate found in tlscacert"},
+		{name: "missing file", caCert: filepath.Join(dir, "missing.pem"), wantErr: "unable to read tlscacert"},
+		{name: "ca only without cert", caOnly: true, wantErr: "tlscaonly requires tlscacert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := s.Executor()
+			e.SearchSubject = "Order"
+			e.TLSCACert, e.IMAPCACertFile, e.TLSCAOnly = tt.caCert, tt.caCertFile, tt.caOnly
+
+			m, err := e.getMail(context.Background())
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "Order 42 confirmed", m.Subject)
+		})
+	}
+}
+
+func TestExecutor_getMail_ClientCertificate(t *testing.T) {
+	s := newTestServerWithMails(t)
+	certPEM, keyPEM, pool := testClientCertificate(t)
+	s.Update(func() {
+		s.serverTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		s.serverTLSConfig.ClientCAs = pool
+	})
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, content, 0600))
+		return path
+	}
+	certFile, keyFile := write("client.pem", certPEM), write("client.key", keyPEM)
+	caCert := write("server.pem", s.CACert)
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		wantErr  string
+	}{
+		{name: "client certificate", certFile: certFile, keyFile: keyFile},
+		{name: "no client certificate", wantErr: "unable to dial"},
+		{name: "no key", certFile: certFile, wantErr: "imapclientcertfile and imapclientkeyfile must be set together"},
+		{name: "no certificate", keyFile: keyFile, wantErr: "imapclientcertfile and imapclientkeyfile must be set together"},
+		{name: "mismatched files", certFile: keyFile, keyFile: certFile, wantErr: "unable to load the client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := s.Executor()
+			e.SearchSubject = "Order"
+			e.IMAPCACertFile = caCert
+			e.IMAPClientCertFile, e.IMAPClientKeyFile = tt.certFile, tt.keyFile
+
+			m, err := e.getMail(context.Background())
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "Order 42 confirmed", m.Subject)
+		})
+	}
+
+	// The server may authenticate the client by its certificate only.
+	s.Update(func() { s.Preauth = true })
+	e := s.Executor()
+	e.SearchSubject, e.IMAPPassword = "Order", ""
+	e.IMAPCACertFile, e.IMAPClientCertFile, e.IMAPClientKeyFile = caCert, certFile, keyFile
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+	require.Equal(t, authMechanismPreauth, e.connAuthMechanism)
+}
+
+func TestExecutor_getMail_Capabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		caps         []string
+		wantCommands []string
+		noCommands   []string
+	}{
+		{name: "extensions", caps: []string{"MOVE", "SORT"}, wantCommands: []string{"UID SORT", "UID MOVE"}, noCommands: []string{"UID COPY", "EXPUNGE"}},
+		{name: "fallbacks", wantCommands: []string{"UID COPY", "UID STORE", "EXPUNGE"}, noCommands: []string{"UID SORT", "UID MOVE"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServerWithMails(t)
+			s.Update(func() { s.Caps = append(s.Caps, tt.caps...) })
+			s.AddMessage("INBOX", testMailInvoice)
+			s.AddMessage("Archive", testMailNewsletter)
+			e := s.Executor()
+			e.SearchFrom = "shop@"
+			e.SortBy = "SUBJECT"
+			e.MBoxOnSuccess = "Archive"
+
+			m, err := e.getMail(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, "Invoice 42", m.Subject)
+			require.Len(t, s.Messages("Archive"), 2)
+			for _, cmd := range tt.wantCommands {
+				require.Contains(t, s.Commands(), cmd)
+			}
+			for _, cmd := range tt.noCommands {
+				require.NotContains(t, s.Commands(), cmd)
+			}
+			for _, c := range []string{"MOVE", "SORT"} {
+				require.Contains(t, e.checkedCaps, c)
+			}
+		})
+	}
+}
+
+func TestHasCap(t *testing.T) {
+	s := newTestServer(t)
+	s.Update(func() { s.Caps = append(s.Caps, "move") })
+	e := s.Executor()
+	c, err := e.dialTLS(e.address(), nil, defaultDialTimeout, nil)
+	require.NoError(t, err)
+	defer c.Logout(time.Second) // nolint
+
+	require.True(t, hasCap(c, "MOVE"))
+	require.True(t, hasCap(c, "Move"))
+	require.False(t, hasCap(c, "SORT"))
+}
+
+func TestExecutor_getMail_ExpectUIDNot(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), m.UID)
+
+	e.ExpectUIDNot = m.UID
+	_, err = e.getMail(context.Background())
+	require.EqualError(t, err, "Mail not found")
+
+	s.AddMessage("INBOX", testMailOrder)
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), m.UID)
+}
+
+func TestExecutor_getMail_DeleteOnSuccess(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	e.DeleteOnSuccess = true
+
+	_, err := e.getMail(context.Background())
+	require.NoError(t, err)
+
+	msgs := s.Messages("INBOX")
+	require.Len(t, msgs, 1)
+	require.Contains(t, string(msgs[0].raw), "Weekly newsletter")
+}
+
+func TestExecutor_getMail_MoveOnSuccess(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.Update(func() { s.Caps = append(s.Caps, "MOVE") })
+	s.AddMessage("Archive", testMailNewsletter)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	e.MBoxOnSuccess = "Archive"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, s.Messages("INBOX"), 1)
+	archived := s.Messages("Archive")
+	require.Len(t, archived, 2)
+	require.Contains(t, string(archived[1].raw), "Order 42 confirmed")
+	require.Equal(t, "Archive", m.MovedTo)
+	require.Zero(t, m.MovedToUID)
+
+	s.Update(func() { s.Caps = append(s.Caps, "UIDPLUS") })
+	e.SearchSubject = "newsletter"
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Archive", m.MovedTo)
+	require.Equal(t, uint32(3), m.MovedToUID)
+}
+
+func TestExecutor_getMail_MoveWithoutMOVE(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.Update(func() { s.Caps = append(s.Caps, "UIDPLUS") })
+	s.AddMessage("Archive", testMailNewsletter)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	e.MBoxOnSuccess = "Archive"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), m.MovedToUID)
+	require.NotContains(t, s.Commands(), "UID MOVE")
+
+	require.Len(t, s.Messages("INBOX"), 1)
+	archived := s.Messages("Archive")
+	require.Len(t, archived, 2)
+	require.Contains(t, string(archived[1].raw), "Order 42 confirmed")
+}
+
+func TestExecutor_getMail_GmailLabel(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.Messages("INBOX")[0].labels = []string{"Newsletters"}
+	e := s.Executor()
+	e.GmailLabel = "Newsletters"
+
+	_, err := e.getMail(context.Background())
+	require.EqualError(t, err, "gmaillabel requires the X-GM-EXT-1 capability, which is not advertised by the server")
+
+	s.Update(func() { s.Caps = append(s.Caps, "X-GM-EXT-1") })
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Weekly newsletter", m.Subject)
+	require.Equal(t, []string{"Newsletters"}, m.GmailLabels)
+}
+
+func TestExecutor_getMail_SearchThreadID(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.Messages("INBOX")[1].thrid = "1780000000000000001"
+	e := s.Executor()
+	e.SearchThreadID = "1780000000000000001"
+
+	_, err := e.getMail(context.Background())
+	require.EqualError(t, err, "searchthreadid requires the X-GM-EXT-1 capability, which is not advertised by the server")
+
+	s.Update(func() { s.Caps = append(s.Caps, "X-GM-EXT-1") })
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), m.UID)
+	require.Equal(t, "1780000000000000001", m.ThreadID)
+
+	e.SearchThreadID = "1780000000000000002"
+	_, err = e.getMail(context.Background())
+	require.EqualError(t, err, "Mail not found")
+
+	e.SearchThreadID = "thread"
+	_, err = e.getMail(context.Background())
+	require.EqualError(t, err, "searchthreadid must be a decimal number, as result.threadid")
+}
+
+func TestExecutor_getMail_SearchAttachment(t *testing.T) {
+	tests := []struct {
+		name        string
+		criteria    Executor
+		wantSubject string
+		wantErr     string
+	}{
+		{name: "attachment", criteria: Executor{SearchAttachment: `\.pdf$`}, wantSubject: "Invoice 42"},
+		{name: "name in content type", criteria: Executor{SearchAttachment: "détails"}, wantSubject: "Invoice 42"},
+		{name: "inline part", criteria: Executor{SearchAttachment: "logo"}, wantErr: "Mail not found"},
+		{name: "exclude", criteria: Executor{SearchFrom: "shop@", ExcludeAttachment: `\.pdf$`}, wantSubject: "Order 42 confirmed"},
+		{name: "exclude all", criteria: Executor{ExcludeAttachment: ".*"}, wantSubject: "Weekly newsletter"},
+		{name: "invalid regexp", criteria: Executor{ExcludeAttachment: "(pdf"}, wantErr: "error parsing regexp"},
+		{name: "type", criteria: Executor{SearchAttachmentType: "^application/pdf$"}, wantSubject: "Invoice 42"},
+		{name: "type without name", criteria: Executor{SearchAttachmentType: "^text/calendar$"}, wantSubject: "Invoice 42"},
+		{name: "type of inline part", criteria: Executor{SearchAttachmentType: "^image/"}, wantErr: "Mail not found"},
+		{name: "inline part included", criteria: Executor{SearchAttachment: "logo", IncludeInline: true}, wantSubject: "Invoice 42"},
+		{name: "type of inline part included", criteria: Executor{SearchAttachmentType: "^image/", IncludeInline: true}, wantSubject: "Invoice 42"},
+		{name: "min attachments", criteria: Executor{MinAttachments: 3}, wantSubject: "Invoice 42"},
+		{name: "too few attachments", criteria: Executor{MinAttachments: 4}, wantErr: "Mail not found"},
+		{name: "max attachments", criteria: Executor{SearchFrom: "shop@", MaxAttachments: 2}, wantSubject: "Order 42 confirmed"},
+		{name: "inline part counted", criteria: Executor{MinAttachments: 4, IncludeInline: true}, wantSubject: "Invoice 42"},
+		{name: "mime part", criteria: Executor{SearchMIMEPart: "^text/calendar$"}, wantSubject: "Invoice 42"},
+		{name: "mime part inline", criteria: Executor{SearchMIMEPart: "^image/png$"}, wantSubject: "Invoice 42"},
+		{name: "mime part multipart", criteria: Executor{SearchMIMEPart: "^multipart/related$"}, wantSubject: "Invoice 42"},
+		{name: "mime part single", criteria: Executor{SearchFrom: "shop@", SearchMIMEPart: "^text/plain$"}, wantSubject: "Order 42 confirmed"},
+		{name: "mime part missing", criteria: Executor{SearchMIMEPart: "^text/vcard$"}, wantErr: "Mail not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.AddMessage("INBOX", testMailInvoice)
+			s.AddMessage("INBOX", testMailNewsletter)
+			s.AddMessage("INBOX", testMailOrder)
+			e := s.Executor()
+			e.SearchFrom, e.SearchAttachment, e.ExcludeAttachment = tt.criteria.SearchFrom, tt.criteria.SearchAttachment, tt.criteria.ExcludeAttachment
+			e.SearchAttachmentType, e.IncludeInline = tt.criteria.SearchAttachmentType, tt.criteria.IncludeInline
+			e.SearchMIMEPart, e.MinAttachments, e.MaxAttachments = tt.criteria.SearchMIMEPart, tt.criteria.MinAttachments, tt.criteria.MaxAttachments
+
+			m, err := e.getMail(context.Background())
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSubject, m.Subject)
+		})
+	}
+}
+
+func TestExecutor_Run_AttachmentCount(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", testMailInvoice)
+
+	step := s.Step(venom.TestStep{
+		"minattachments": 2,
+		"maxattachments": 3,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Invoice 42", result.Subject)
+	require.Equal(t, 3, result.AttachmentCount)
+}
+
+func TestExecutor_Run_ReturnAttachments(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", testMailInvoice)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject":     "Invoice",
+		"returnattachments": true,
+		"maxattachmentsize": 10,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, []Attachment{
+		{Name: "invoice-42.pdf", Type: "application/pdf", Size: 9, Content: "%PDF-1.4\n"},
+		{Name: "détails.csv", Type: "text/csv", Size: 9, Content: "id;amount"},
+		{Type: "text/calendar", Size: 30, Truncated: true},
+	}, result.Attachments)
+
+	delete(step, "maxattachmentsize")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Len(t, result.Attachments, 3)
+	require.Equal(t, "BEGIN:VCALENDAR\r\nEND:VCALENDAR", result.Attachments[2].Content)
+	require.False(t, result.Attachments[2].Truncated)
+}
+
+func TestExecutor_Run_DKIM(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", "DKIM-Signature: v=1; a=rsa-sha256; d=esp.example.net; s=esp1; b=abc\n"+
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.org;\n s=mail2024; b=def\n"+
+		"From: Shop <shop@example.org>\n"+
+		"To: customer@example.com\n"+
+		"Subject: Signed order\n"+
+		"Content-Type: text/plain\n"+
+		"\n"+
+		"Your order is signed.\n")
+
+	step := s.Step(venom.TestStep{
+		"searchdkimdomain": "^example\\.org$",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Signed order", result.Subject)
+	require.Equal(t, "example.org", result.DKIMDomain)
+	require.Equal(t, "mail2024", result.DKIMSelector)
+	require.Equal(t, []DKIMSignature{{Domain: "esp.example.net", Selector: "esp1"}, {Domain: "example.org", Selector: "mail2024"}}, result.DKIMSignatures)
+
+	// The domain and the selector must match the same signature.
+	step["searchdkimselector"] = "^esp1$"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "Mail not found", r.(Result).Err)
+
+	delete(step, "searchdkimdomain")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "esp.example.net", result.DKIMDomain)
+
+	// Without DKIM criteria, the topmost signature is returned.
+	step = s.Step(venom.TestStep{
+		"searchsubject": "Signed",
+	})
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "esp.example.net", r.(Result).DKIMDomain)
+}
+
+func TestExecutor_Run_MatchTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailOrder)
+	previous := matchTimeoutUnit
+	matchTimeoutUnit = time.Nanosecond
+	t.Cleanup(func() { matchTimeoutUnit = previous })
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+
+	// The timeout is checked even when the last mail matches.
+	step["matchtimeout"] = 1
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "matchtimeout of 1s exceeded while processing message 1/1 (UID 1) of INBOX")
+}
+
+func TestExecutor_Run_MatchTimeout_MBoxes(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailNewsletter)
+	s.AddMessage("Archive", testMailOrder)
+	previous := matchElapsed
+	matchElapsed = func(time.Time) time.Duration { return 600 * time.Millisecond }
+	t.Cleanup(func() { matchElapsed = previous })
+
+	// Each mailbox is matched within the timeout, but not both.
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"mboxes":        []string{"INBOX", "Archive"},
+		"matchtimeout":  1,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "matchtimeout of 1s exceeded while processing message 1/1 (UID 1) of Archive")
+}
+
+func TestExecutor_Run_TrustedAuthServ(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", "Authentication-Results: mx.attacker.example; dkim=pass; spf=pass; dmarc=pass\n"+testMailOrder)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject":   "Order",
+		"trustedauthserv": "mx.example.org",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Nil(t, result.AuthResults, "the results of an untrusted server are ignored")
+
+	delete(step, "trustedauthserv")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"dkim": "pass", "spf": "pass", "dmarc": "pass"}, r.(Result).AuthResults)
+}
+
+func TestExecutor_Run_WithThread(t *testing.T) {
+	s := newTestServerWithMails(t)
+	conversation := func(header, subject string) string {
+		return header +
+			"From: Support <support@example.org>\n" +
+			"To: customer@example.com\n" +
+			"Subject: " + subject + "\n" +
+			"Content-Type: text/plain\n" +
+			"\n" +
+			"Hello.\n"
+	}
+	s.AddMessage("INBOX", conversation("Message-Id: <ticket-1@example.org>\n", "Ticket 1 opened"))
+	s.AddMessage("INBOX", conversation("Message-Id: <ticket-2@example.org>\n", "Ticket 2 opened"))
+	s.AddMessage("INBOX", conversation("Message-Id: <reply-1@example.org>\nIn-Reply-To: <ticket-1@example.org>\n", "Re: Ticket 1 opened"))
+	// The second reply is only linked to the ticket through the first one.
+	s.AddMessage("INBOX", conversation("Message-Id: <reply-2@example.org>\nReferences: <reply-1@example.org>\n", "Re: Re: Ticket 1 opened"))
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "^Re: Ticket 1",
+		"withthread":    true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "<reply-1@example.org>", result.MessageID)
+	require.Len(t, result.Thread, 2)
+	require.Equal(t, "Ticket 1 opened", result.Thread[0].Subject)
+	require.Equal(t, "<ticket-1@example.org>", result.Thread[0].MessageID)
+	require.Equal(t, "Re: Re: Ticket 1 opened", result.Thread[1].Subject)
+
+	step["searchsubject"] = "^Ticket 2"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Empty(t, result.Thread)
+
+	// The mails without Message-Id are not in the same conversation.
+	s.AddMessage("INBOX", conversation("", "Newsletter 1"))
+	s.AddMessage("INBOX", conversation("", "Newsletter 2"))
+	step["searchsubject"] = "^Newsletter 1"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Empty(t, result.MessageID)
+	require.Empty(t, result.Thread)
+
+	// The conversation is only fetched when asked.
+	step["searchsubject"] = "^Ticket 1"
+	delete(step, "withthread")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Thread)
+}
+
+func TestExecutor_Run_FetchBodyPart(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailInvoice)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Invoice",
+	})
+	for section, want := range map[string]string{
+		"1.1": `<p>Your invoice 42.</p><img src="cid:logo">`,
+		"2":   "%PDF-1.4\n",
+		"3":   "id;amount",
+		"9":   "",
+	} {
+		step["fetchbodypart"] = section
+		r, err := s.Executor().Run(context.Background(), step)
+		require.NoError(t, err)
+		result := r.(Result)
+		require.Empty(t, result.Err, section)
+		require.Equal(t, want, result.BodyPart, section)
+		require.Empty(t, result.Body, "the body is not downloaded")
+	}
+
+	step["fetchbodypart"] = "2..1"
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, `invalid fetchbodypart "2..1", expected a MIME section number as 2.1`, r.(Result).Err)
+}
+
+func TestExecutor_Run_SearchPriority(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject":  "Order",
+		"searchpriority": "Normal",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+
+	// A misspelled priority would never match.
+	step["searchpriority"] = "urgent"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, `unsupported searchpriority "urgent", expected high, normal or low`, r.(Result).Err)
+}
+
+func TestExecutor_Run_RenderHTML(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailInvoice)
+	s.AddMessage("INBOX", "From: Shop <shop@example.org>\n"+
+		"To: customer@example.com\n"+
+		"Subject: Your order\n"+
+		"Content-Type: multipart/alternative; boundary=\"alt\"\n"+
+		"\n"+
+		"--alt\n"+
+		"Content-Type: text/plain\n"+
+		"\n"+
+		"Your order 42 is shipped: https://shop.example.org/track/42\n"+
+		"--alt\n"+
+		"Content-Type: text/html; charset=utf-8\n"+
+		"Content-Transfer-Encoding: quoted-printable\n"+
+		"\n"+
+		"<p>Your order 42 is <b>exp=C3=A9di=C3=A9e</b>&nbsp;!</p><p><a href=3D\"https://shop.example.org/track/42\">Track it</a></p>\n"+
+		"--alt--\n")
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Your order",
+		"renderhtml":    true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Your order 42 is expédiée !\n\nTrack it (https://shop.example.org/track/42)", result.BodyRendered)
+	require.Equal(t, "Your order 42 is shipped: https://shop.example.org/track/42", result.BodyText)
+
+	step["searchsubject"] = "Invoice"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "Your invoice 42.", r.(Result).BodyRendered)
+
+	delete(step, "renderhtml")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).BodyRendered)
+}
+
+func TestExecutor_getMail_MIMEParts(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailInvoice)
+	e := s.Executor()
+	e.SearchMIMEPart = "^text/calendar$"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"multipart/mixed", "multipart/related", "text/html", "image/png", "application/pdf", "text/csv", "text/calendar"}, m.MIMEParts)
+
+	e.SearchMIMEPart = ""
+	e.SearchSubject = "Invoice"
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, m.MIMEParts, "the body is not fetched")
+}
+
+func TestExecutor_getMail_IncludeInline(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", "From: Shop <shop@example.org>\n"+
+		"To: customer@example.com\n"+
+		"Subject: Your plan\n"+
+		"Content-Type: multipart/related; boundary=\"related\"\n"+
+		"\n"+
+		"--related\n"+
+		"Content-Type: text/plain\n"+
+		"\n"+
+		"See the plan.\n"+
+		"--related\n"+
+		"Content-Type: image/png\n"+
+		"Content-Disposition: inline; filename*=utf-8''sch%C3%A9ma.png\n"+
+		"\n"+
+		"iVBORw0KGgo=\n"+
+		"--related\n"+
+		"Content-Type: image/png; name=\"=?utf-8?q?l=C3=A9gende.png?=\"\n"+
+		"Content-Disposition: inline\n"+
+		"\n"+
+		"iVBORw0KGgo=\n"+
+		"--related\n"+
+		"Content-Type: image/gif\n"+
+		"Content-Disposition: inline\n"+
+		"\n"+
+		"R0lGOD==\n"+
+		"--related--\n")
+	e := s.Executor()
+	e.SearchSubject = "plan"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, m.InlineParts)
+
+	e.IncludeInline = true
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"schéma.png", "légende.png"}, m.InlineParts)
+	require.Equal(t, []string{"schéma.png", "légende.png"}, m.Attachments)
+}
+
+func TestExecutor_getMail_FoldedSubject(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", "From: Shop <shop@example.org>\n"+
+		"To: customer@example.com\n"+
+		"Subject: Your order 42 of the\n"+
+		"\tnew espresso machine has been\n"+
+		" =?utf-8?q?exp=C3=A9di=C3=A9?=\n"+
+		" =?utf-8?q?e_today?=\n"+
+		"Content-Type: text/plain; charset=utf-8\n\nShipped.\n")
+	e := s.Executor()
+	e.SearchSubject = "espresso machine has been expédiée today$"
+	e.Anchor = false
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Your order 42 of the new espresso machine has been expédiée today", m.Subject)
+}
+
+func TestExecutor_getMail_ReturnBody(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, m.Body)
+
+	e.ReturnBody = true
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Contains(t, m.Body, "Your order 42 is confirmed.")
+}
+
+func TestExecutor_getMail_SelectBusy(t *testing.T) {
+	defer func(b time.Duration) { selectBackoff = b }(selectBackoff)
+	selectBackoff = time.Millisecond
+
+	s := newTestServerWithMails(t)
+	s.Update(func() { s.SelectBusy = 2 })
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+	require.Equal(t, []string{"Mailbox is locked by another session", "Mailbox is locked by another session"}, e.alerts)
+
+	s.Update(func() { s.SelectBusy = selectAttempts })
+	_, err = e.getMail(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Mailbox in use")
+}
+
+func TestExecutor_selectMailbox_Missing(t *testing.T) {
+	defer func(b time.Duration) { selectBackoff = b }(selectBackoff)
+	selectBackoff = time.Millisecond
+
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	c, _, err := e.connect(context.Background())
+	require.NoError(t, err)
+	defer e.logout(c)
+
+	// A refusal without response code is not retried.
+	commands := len(s.Commands())
+	err = e.selectMailbox(context.Background(), c, "Missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "NO Mailbox does not exist")
+	require.Equal(t, []string{"SELECT"}, s.Commands()[commands:])
+}
+
+func TestExecutor_Run_NoBad(t *testing.T) {
+	defer func(b time.Duration) { selectBackoff = b }(selectBackoff)
+	selectBackoff = time.Millisecond
+	defer func(b time.Duration) { pollBackoff = b }(pollBackoff)
+	pollBackoff = time.Millisecond
+
+	s := newTestServerWithMails(t)
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	selects := func() int {
+		n := 0
+		for _, c := range s.Commands() {
+			if c == "SELECT" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// A protocol error is not retried.
+	s.Update(func() { s.SelectBad = 1 })
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Equal(t, "Error while feching messages: SELECT failed: BAD Invalid mailbox name", result.Err)
+	require.Equal(t, "bad", result.ErrCode)
+	require.Equal(t, 1, selects())
+
+	step["mbox"] = "Missing"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, "error while queryCount: STATUS failed: NO Mailbox does not exist", result.Err)
+	require.Equal(t, "no", result.ErrCode)
+
+	// A transient refusal is retried, its response code is errcode.
+	delete(step, "mbox")
+	s.Update(func() { s.SelectBusy = selectAttempts })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Contains(t, result.Err, "SELECT failed: NO [INUSE] Mailbox in use")
+	require.Equal(t, "INUSE", result.ErrCode)
+	require.Equal(t, 1+selectAttempts, selects())
+
+	// With maxwait, a transient refusal is searched again, but not a
+	// protocol error.
+	step["maxwait"] = 5
+	s.Update(func() { s.SelectBusy = selectAttempts })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+
+	s.Update(func() { s.SelectBad = 1 })
+	start := selects()
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "bad", r.(Result).ErrCode)
+	require.Equal(t, start+1, selects())
+}
+
+func TestExecutor_Run_MaxWait_LoginRefused(t *testing.T) {
+	defer func(b time.Duration) { pollBackoff = b }(pollBackoff)
+	pollBackoff = time.Millisecond
+
+	s := newTestServerWithMails(t)
+	logins := func() int {
+		n := 0
+		for _, c := range s.Commands() {
+			if c == "LOGIN" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// A failed login is never searched again, with or without response
+	// code, not to lock the account.
+	for _, plain := range []bool{true, false} {
+		s.Update(func() { s.PlainLoginRefusal = plain })
+		start := logins()
+		step := s.Step(venom.TestStep{
+			"imappassword":  "wrong",
+			"searchsubject": "Order",
+			"maxwait":       5,
+			"retryoncodes":  []string{"AUTHENTICATIONFAILED"},
+		})
+		r, err := s.Executor().Run(context.Background(), step)
+		require.NoError(t, err)
+		require.Contains(t, r.(Result).Err, "LOGIN failed: NO")
+		require.Equal(t, start+1, logins())
+	}
+}
+
+func TestExecutor_Run_RetryOnCodes(t *testing.T) {
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	s := newTestServerWithMails(t)
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+
+	// The codes are not retried by default.
+	s.Update(func() { s.FetchFail, s.FetchFailCode = 1, "SERVERBUG" })
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "Try again later")
+
+	step["retryoncodes"] = []string{"LIMIT", "[serverbug]"}
+	s.Update(func() { s.FetchFail = retryAttempts - 1 })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+
+	s.Update(func() { s.FetchFail = retryAttempts })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "Try again later")
+	s.Update(func() { s.FetchFail = 0 })
+
+	// Another code is not retried.
+	s.Update(func() { s.FetchFail, s.FetchFailCode = 1, "OVERQUOTA" })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "Try again later")
+	require.Zero(t, s.FetchFail)
+}
+
+func TestExecutor_getMail_FetchItems(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchBody = "order 42"
+	e.FetchItems = []string{"body.peek[]"}
+
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+	require.Contains(t, m.Body, "Your order 42 is confirmed.")
+	require.Nil(t, m.Envelope)
+	require.False(t, s.Messages("INBOX")[1].flags[`\Seen`])
+
+	e.SearchBody, e.SearchSubject = "", "Order"
+	e.FetchItems = []string{"BODY[HEADER]", "BODY[TEXT]<0.10>", "RFC822.SIZE"}
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Your order", m.Body)
+
+	e.FetchItems = []string{"ENVELOPE", "BODY"}
+	_, err = e.getMail(context.Background())
+	require.EqualError(t, err, `unsupported fetchitems item "BODY"`)
+}
+
+func TestExecutor_getMail_Reconnect(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.Update(func() { s.DropFetchAfter = 1 })
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	_, err := e.getMail(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Error while feching messages")
+
+	s.Update(func() { s.DropFetchAfter = 1 })
+	e.MaxReconnects = 1
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+	require.Contains(t, s.Commands(), "UID FETCH")
+}
+
+func TestExecutor_getMail_MaxConcurrentConnections(t *testing.T) {
+	connections.slots = nil
+	t.Cleanup(func() { connections.slots = nil })
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	e.MaxConcurrentConnections = 1
+
+	release, err := e.acquireConnection(context.Background())
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := e.getMail(context.Background())
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("getMail connected while all the connection slots are used")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	require.NoError(t, <-done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release, err = e.acquireConnection(ctx)
+	require.NoError(t, err)
+	defer release()
+	cancel()
+	_, err = e.getMail(ctx)
+	require.EqualError(t, err, "error while waiting for a connection slot: context canceled")
+}
+
+func TestExecutor_acquireConnection_Env(t *testing.T) {
+	connections.slots = nil
+	t.Cleanup(func() { connections.slots = nil })
+	e := Executor{}
+
+	t.Setenv(maxConnectionsEnv, "2")
+	release, err := e.acquireConnection(context.Background())
+	require.NoError(t, err)
+	defer release()
+	require.Equal(t, 2, cap(connections.slots))
+	require.Len(t, connections.slots, 1)
+
+	t.Setenv(maxConnectionsEnv, "many")
+	_, err = e.acquireConnection(context.Background())
+	require.EqualError(t, err, `invalid VENOM_IMAP_MAX_CONCURRENT_CONNECTIONS "many": strconv.Atoi: parsing "many": invalid syntax`)
+}
+
+func TestExecutor_Run(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"returnbody":    true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Contains(t, result.Body, "Your order 42 is confirmed.")
+	require.Equal(t, []string{"Shop <shop@example.org>"}, result.Envelope.From)
+	require.Equal(t, "Order 42 confirmed", result.Envelope.Subject)
+	require.Equal(t, "direct", result.TLSMode)
+}
+
+func TestExecutor_Run_ExpectError(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+
+	tests := []struct {
+		name         string
+		password     string
+		expectError  string
+		wantErr      string
+		wantExpected string
+		wantErrCode  string
+	}{
+		{name: "expected", password: "wrong", expectError: "AUTHENTICATIONFAILED", wantExpected: "error while connecting: unable to login: LOGIN failed: NO [AUTHENTICATIONFAILED] Invalid credentials", wantErrCode: "AUTHENTICATIONFAILED"},
+		{name: "other error", password: "wrong", expectError: "TLS", wantErr: `the error does not match expecterror "TLS": error while connecting: unable to login`, wantErrCode: "AUTHENTICATIONFAILED"},
+		{name: "no error", password: e.IMAPPassword, expectError: "AUTHENTICATIONFAILED", wantErr: `the step succeeded although expecterror "AUTHENTICATIONFAILED" was expected`, wantErrCode: errCodeExpectError},
+		{name: "invalid", password: "wrong", expectError: "(", wantErr: "invalid expecterror: error parsing regexp", wantErrCode: errCodeSearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := s.Step(venom.TestStep{
+				"imappassword":  tt.password,
+				"searchsubject": "Order",
+				"expecterror":   tt.expectError,
+			})
+			r, err := s.Executor().Run(context.Background(), step)
+			require.NoError(t, err)
+
+			result := r.(Result)
+			if tt.wantErr == "" {
+				require.Empty(t, result.Err)
+			} else {
+				require.Contains(t, result.Err, tt.wantErr)
+			}
+			require.Equal(t, tt.wantExpected, result.ExpectedErr)
+			require.Equal(t, tt.wantErrCode, result.ErrCode)
+		})
+	}
+}
+
+func TestExecutor_Run_NormalizeLineEndings(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", "From: shop@example.org\nTo: customer@example.com\nSubject: Order 42 shipped\nContent-Type: text/plain\n\nYour order 42\nis shipped.\n")
+
+	tests := []struct {
+		normalize string
+		wantBody  string
+		wantErr   string
+	}{
+		{normalize: "", wantBody: "Your order 42\r\nis shipped.\r\n"},
+		{normalize: "none", wantBody: "Your order 42\r\nis shipped.\r\n"},
+		{normalize: "LF", wantBody: "Your order 42\nis shipped.\n"},
+		{normalize: "crlf", wantBody: "Your order 42\r\nis shipped.\r\n"},
+		{normalize: "cr", wantErr: `unsupported normalizelineendings "cr", expected lf, crlf or none`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.normalize, func(t *testing.T) {
+			step := s.Step(venom.TestStep{
+				"searchsubject":        "shipped",
+				"returnbody":           true,
+				"normalizelineendings": tt.normalize,
+			})
+			r, err := s.Executor().Run(context.Background(), step)
+			require.NoError(t, err)
+
+			result := r.(Result)
+			if tt.wantErr != "" {
+				require.Equal(t, tt.wantErr, result.Err)
+				return
+			}
+			require.Empty(t, result.Err)
+			require.Equal(t, tt.wantBody, result.Body)
+			require.Equal(t, tt.wantBody, result.BodyText)
+			// sha256("Your order 42\nis shipped.\n")
+			require.Equal(t, "dabc124cc01bfdc8a6d5f88bffa3a66a5f8b9c6dd9d6b1e89bd251656f22695e", result.BodyHash)
+		})
+	}
+}
+
+func TestExecutor_Run_ExtractBody(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailOrder)
+	s.AddMessage("INBOX", "From: auth@example.org\nTo: customer@example.com\nSubject: Your code\nContent-Type: text/plain\n\nHello Alice,\nyour code is 482913, valid 10 minutes.\n")
+
+	tests := []struct {
+		name        string
+		extractBody string
+		wantAll     []string
+		wantErr     string
+	}{
+		{name: "groups", extractBody: `Hello (\w+),\s+your code is (\d{6})`, wantAll: []string{"Alice", "482913"}},
+		{name: "whole match", extractBody: `\d{6}`, wantAll: []string{"482913"}},
+		{name: "no match", extractBody: `code: (\d+)`, wantErr: `extractbody "code: (\\d+)" does not match the body of the mail`},
+		{name: "invalid", extractBody: `(\d+`, wantErr: "invalid extractbody: error parsing regexp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := s.Step(venom.TestStep{
+				"searchsubject": "code",
+				"extractbody":   tt.extractBody,
+			})
+			r, err := s.Executor().Run(context.Background(), step)
+			require.NoError(t, err)
+
+			result := r.(Result)
+			if tt.wantErr != "" {
+				require.Contains(t, result.Err, tt.wantErr)
+				require.Empty(t, result.Extracted)
+				return
+			}
+			require.Empty(t, result.Err)
+			require.Equal(t, tt.wantAll[0], result.Extracted)
+			require.Equal(t, tt.wantAll, result.ExtractedAll)
+		})
+	}
+}
+
+func TestExecutor_Run_ActionError(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"mboxonsuccess": "Missing",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+
+	result := r.(Result)
+	require.Contains(t, result.Err, "Mailbox does not exist")
+	require.Equal(t, "action", result.ErrCode)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, uint32(2), result.UID)
+	require.Empty(t, result.MovedTo)
+	require.Equal(t, "none", result.ActionTaken)
+
+	step["searchsubject"] = "Invoice"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, "Mail not found", result.Err)
+	require.Equal(t, "search", result.ErrCode)
+	require.Empty(t, result.Subject)
+}
+
+func TestExecutor_Run_ActionTaken(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("Archive", testMailNewsletter)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "none", r.(Result).ActionTaken)
+
+	step["mboxonsuccess"] = "Archive"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "moved", result.ActionTaken)
+	require.Len(t, s.Messages("Archive"), 2)
+
+	delete(step, "mboxonsuccess")
+	step["deleteonsuccess"] = true
+	step["searchsubject"] = "newsletter"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "deleted", result.ActionTaken)
+	require.Empty(t, s.Messages("INBOX"))
+
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "No message to fetch", r.(Result).Err)
+	require.Empty(t, r.(Result).ActionTaken)
+}
+
+func TestExecutor_Run_SinceUID(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"sinceuid": 0,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, 2, result.Count)
+	require.Equal(t, uint32(2), *result.HighestUID)
+	require.Equal(t, uint32(1), result.UIDValidity)
+	require.Equal(t, "Weekly newsletter", result.Mails[0].Subject)
+	require.Equal(t, "Order 42 confirmed", result.Mails[1].Subject)
+	crlf := func(raw string) int { return len(strings.ReplaceAll(raw, "\n", "\r\n")) }
+	require.Equal(t, uint64(crlf(testMailNewsletter)+crlf(testMailOrder)), result.TotalSize)
+
+	step["sinceuid"] = *result.HighestUID
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Zero(t, result.Count)
+	require.Zero(t, result.TotalSize)
+	require.Equal(t, uint32(2), *result.HighestUID)
+
+	s.AddMessage("INBOX", testMailOrder)
+	step["searchsubject"] = "Order"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, []ResultMail{{UID: 3, From: "Shop <shop@example.org>", To: "customer@example.com", Subject: "Order 42 confirmed"}}, result.Mails)
+	require.Equal(t, uint32(3), *result.HighestUID)
+
+	// The UIDs of the expunged mails are not searched again.
+	s.AddMessage("INBOX", testMailNewsletter)
+	s.Update(func() { s.mailboxes["INBOX"] = s.mailboxes["INBOX"][:3] })
+	step["sinceuid"] = *result.HighestUID
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Zero(t, result.Count)
+	require.Equal(t, uint32(4), *result.HighestUID)
+}
+
+func TestExecutor_Run_SinceUID_EmptyMailbox(t *testing.T) {
+	s := newTestServer(t)
+
+	step := s.Step(venom.TestStep{
+		"sinceuid": 0,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.NotNil(t, result.HighestUID, "highestuid is set even without mails")
+	require.Zero(t, *result.HighestUID)
+}
+
+func TestExecutor_searchMails_SortBy(t *testing.T) {
+	mails := []string{
+		"From: b@example.org\nSubject: Beta\nDate: Mon, 2 Jan 2006 10:00:00 +0000\nContent-Type: text/plain\n\nSecond.\n",
+		"From: a@example.org\nSubject: Alpha\nDate: Tue, 3 Jan 2006 10:00:00 +0000\nContent-Type: text/plain\n\nThe third one, with a longer body.\n",
+		"From: c@example.org\nSubject: Gamma\nDate: Sun, 1 Jan 2006 10:00:00 +0000\nContent-Type: text/plain\n\n1st\n",
+	}
+	tests := []struct {
+		name         string
+		sortBy       string
+		limit        int
+		searchFrom   string
+		wantSubjects []string
+		wantHighest  uint32
+		wantErr      string
+	}{
+		{name: "date", sortBy: "DATE", wantSubjects: []string{"Gamma", "Beta", "Alpha"}, wantHighest: 3},
+		{name: "reverse date with limit", sortBy: "reverse date", limit: 2, wantSubjects: []string{"Alpha", "Beta"}, wantHighest: 2},
+		{name: "size", sortBy: "SIZE", wantSubjects: []string{"Gamma", "Beta", "Alpha"}, wantHighest: 3},
+		{name: "from", sortBy: "FROM", wantSubjects: []string{"Alpha", "Beta", "Gamma"}, wantHighest: 3},
+		{name: "limit with criteria", sortBy: "REVERSE SUBJECT", limit: 1, searchFrom: "[ab]@", wantSubjects: []string{"Beta"}, wantHighest: 3},
+		{name: "limit in uid order", sortBy: "", limit: 2, wantSubjects: []string{"Beta", "Alpha"}, wantHighest: 2},
+		{name: "unknown key", sortBy: "DATE SPAM", wantErr: `unsupported sortby key "SPAM"`},
+		{name: "reverse alone", sortBy: "DATE REVERSE", wantErr: "sortby: REVERSE must be followed by a sort key"},
+	}
+	for _, tt := range tests {
+		for _, withSort := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/sort=%t", tt.name, withSort), func(t *testing.T) {
+				s := newTestServer(t)
+				if withSort {
+					s.Update(func() { s.Caps = append(s.Caps, "SORT") })
+				}
+				for _, m := range mails {
+					s.AddMessage("INBOX", m)
+				}
+				e := s.Executor()
+				e.SinceUID = new(uint32)
+				e.SortBy, e.Limit, e.SearchFrom = tt.sortBy, tt.limit, tt.searchFrom
+
+				found, err := e.searchMails(context.Background(), true)
+				if tt.wantErr != "" {
+					require.EqualError(t, err, tt.wantErr)
+					return
+				}
+				require.NoError(t, err)
+				var subjects []string
+				for _, m := range found.mails {
+					subjects = append(subjects, m.Subject)
+				}
+				require.Equal(t, tt.wantSubjects, subjects)
+				require.Equal(t, tt.wantHighest, found.highestUID)
+				if withSort && tt.sortBy != "" {
+					require.Contains(t, s.Commands(), "UID SORT")
+				} else {
+					require.NotContains(t, s.Commands(), "UID SORT")
+				}
+			})
+		}
+	}
+}
+
+func TestExecutor_Run_PasswordFile(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte(e.IMAPPassword+"\n"), 0600))
+
+	step := s.Step(venom.TestStep{
+		"imappassword":     "wrong",
+		"imappasswordfile": passwordFile,
+		"searchsubject":    "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+
+	step["imappasswordfile"] = filepath.Join(t.TempDir(), "missing")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to read imappasswordfile")
+}
+
+// TestExecutor_Run_Extract reuses the result of an imap step in a later step
+// of a testcase named findmail.
+func TestExecutor_Run_Extract(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+
+	dump, err := venom.DumpString(r)
+	require.NoError(t, err)
+	vars := map[string]string{}
+	for k, v := range dump {
+		vars["findmail."+k] = v
+	}
+	require.Equal(t, "2", vars["findmail.result.uid"])
+	require.Equal(t, "Shop <shop@example.org>", vars["findmail.result.from"])
+
+	next, err := interpolate.Do(`{"type": "http", "url": "http://localhost/mails/{{.findmail.result.uid}}?subject={{.findmail.result.subject}}"}`, vars)
+	require.NoError(t, err)
+	require.Equal(t, `{"type": "http", "url": "http://localhost/mails/2?subject=Order 42 confirmed"}`, next)
+}
+
+func TestExecutor_isSearched(t *testing.T) {
+	m := &Mail{From: "Shop <shop@example.org>", To: "customer@example.com", Cc: "sales@example.org", Bcc: "audit@example.org", RecipientCount: 2, Subject: "Order 42 confirmed", Priority: "high", Body: "Your order"}
+	tests := []struct {
+		name    string
+		e       Executor
+		want    bool
+		wantErr bool
+	}{
+		{name: "no criteria", want: true},
+		{name: "from", e: Executor{SearchFrom: "shop@"}, want: true},
+		{name: "from mismatch", e: Executor{SearchFrom: "news@"}},
+		{name: "to", e: Executor{SearchTo: "customer"}, want: true},
+		{name: "recipient in to", e: Executor{SearchRecipient: "customer@"}, want: true},
+		{name: "recipient in cc", e: Executor{SearchRecipient: "^sales@"}, want: true},
+		{name: "recipient in bcc", e: Executor{SearchRecipient: "audit@"}, want: true},
+		{name: "recipient mismatch", e: Executor{SearchRecipient: "news@"}},
+		{name: "anchored recipient", e: Executor{SearchRecipient: "sales@example.org", Anchor: true}, want: true},
+		{name: "subject and body", e: Executor{SearchSubject: "^Order", SearchBody: "order$"}, want: true},
+		{name: "subject and body mismatch", e: Executor{SearchSubject: "^Order", SearchBody: "^order"}},
+		{name: "invalid regexp", e: Executor{SearchBody: "(order"}, wantErr: true},
+		{name: "unanchored subject", e: Executor{SearchSubject: "Order"}, want: true},
+		{name: "anchored subject", e: Executor{SearchSubject: "Order", Anchor: true}},
+		{name: "anchored alternation", e: Executor{SearchSubject: "Invoice|Order.*", Anchor: true}, want: true},
+		{name: "recipients in bounds", e: Executor{MinRecipients: 2, MaxRecipients: 2}, want: true},
+		{name: "too few recipients", e: Executor{MinRecipients: 3}},
+		{name: "too many recipients", e: Executor{MaxRecipients: 1}},
+		{name: "priority", e: Executor{SearchPriority: "High"}, want: true},
+		{name: "priority mismatch", e: Executor{SearchPriority: "low"}},
+		{name: "glob", e: Executor{SearchSubject: "Order * confirmed", MatchMode: "glob"}, want: true},
+		{name: "glob matches the whole value", e: Executor{SearchSubject: "Order *", SearchFrom: "*@example.org", MatchMode: "glob"}},
+		{name: "glob question mark", e: Executor{SearchSubject: "Order ?? confirmed", MatchMode: "glob"}, want: true},
+		{name: "glob escapes regexp", e: Executor{SearchFrom: "Shop <shop@example.org>", SearchTo: "customer@example.com", MatchMode: "glob"}, want: true},
+		{name: "glob metacharacters", e: Executor{SearchSubject: "Order 4. confirmed", MatchMode: "glob"}},
+		{name: "unknown matchmode", e: Executor{SearchSubject: "Order", MatchMode: "fuzzy"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.e.isSearched(m)
+			require.Equal(t, tt.wantErr, err != nil)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExecutor_isSearched_SpamScore(t *testing.T) {
+	score := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name  string
+		score *float64
+		e     Executor
+		want  bool
+	}{
+		{name: "no bounds", want: true},
+		{name: "below max", score: score(1.2), e: Executor{MaxSpamScore: score(5)}, want: true},
+		{name: "above max", score: score(6.5), e: Executor{MaxSpamScore: score(5)}},
+		{name: "within band", score: score(-0.1), e: Executor{MinSpamScore: score(-1), MaxSpamScore: score(0)}, want: true},
+		{name: "below min", score: score(-0.1), e: Executor{MinSpamScore: score(0)}},
+		{name: "without score", e: Executor{MaxSpamScore: score(5)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.e.isSearched(&Mail{SpamScore: tt.score})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExecutor_isSearched_FoldAccents(t *testing.T) {
+	m := &Mail{From: "José Müller <jose@example.org>", Subject: "Commande validée"}
+	tests := []struct {
+		name string
+		e    Executor
+		want bool
+	}{
+		{name: "accents are kept by default", e: Executor{SearchFrom: "Jose"}},
+		{name: "value accents", e: Executor{SearchFrom: "Jose Muller", FoldAccents: true}, want: true},
+		{name: "pattern accents", e: Executor{SearchSubject: "commande VALIDÉE$", FoldAccents: true}, want: true},
+		{name: "anchored", e: Executor{SearchSubject: "Commande validee", FoldAccents: true, Anchor: true}, want: true},
+		{name: "glob", e: Executor{SearchFrom: "jose muller *", FoldAccents: true, MatchMode: "glob"}, want: true},
+		{name: "mismatch", e: Executor{SearchFrom: "Josef", FoldAccents: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.e.isSearched(m)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExecutor_isSearched_TimeOfDay(t *testing.T) {
+	// 08:30 in Paris, 07:30 UTC.
+	date := time.Date(2021, 3, 1, 8, 30, 0, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		name    string
+		e       Executor
+		date    time.Time
+		want    bool
+		wantErr string
+	}{
+		{name: "before the window", e: Executor{SearchTimeOfDayFrom: "09:00", SearchTimeOfDayTo: "17:00"}, date: date},
+		{name: "in the window", e: Executor{SearchTimeOfDayFrom: "08:00", SearchTimeOfDayTo: "17:00"}, date: date, want: true},
+		{name: "from only", e: Executor{SearchTimeOfDayFrom: "08:30"}, date: date, want: true},
+		{name: "to excluded", e: Executor{SearchTimeOfDayTo: "08:30"}, date: date},
+		{name: "timezone", e: Executor{SearchTimeOfDayFrom: "07:00", SearchTimeOfDayTo: "08:00", Timezone: "UTC"}, date: date, want: true},
+		{name: "across midnight", e: Executor{SearchTimeOfDayFrom: "22:00", SearchTimeOfDayTo: "09:00:00"}, date: date, want: true},
+		{name: "no date", e: Executor{SearchTimeOfDayFrom: "00:00"}},
+		{name: "invalid time", e: Executor{SearchTimeOfDayFrom: "9h"}, date: date, wantErr: `invalid searchtimeofdayfrom: "9h" is not a time of day as 09:00`},
+		{name: "invalid timezone", e: Executor{SearchTimeOfDayTo: "17:00", Timezone: "Mars/Olympus"}, date: date, wantErr: "invalid timezone: unknown time zone Mars/Olympus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.e.isSearched(&Mail{Date: tt.date})
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExecutor_waitForCount(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.WaitForCount = 2
+
+	count, err := e.waitForCount(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), count)
+
+	e.WaitForCount = 3
+	e.WaitForTimeout = 1
+	count, err = e.waitForCount(context.Background())
+	require.EqualError(t, err, "mailbox INBOX has 2 messages after 1s, expected 3")
+	require.Equal(t, uint32(2), count)
+}
+
+func TestExecutor_Run_ExpectedCount(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"expectedcount": 2,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, 2, result.Exists)
+	require.False(t, result.Changed)
+	require.NotContains(t, s.Commands(), "FETCH")
+
+	s.AddMessage("INBOX", testMailOrder)
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, 3, result.Exists)
+	require.True(t, result.Changed)
+}
+
+func TestExecutor_Run_ExpectedModSeq(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"expectedmodseq": 2,
+	})
+	// Nothing is done without CONDSTORE.
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Zero(t, result.HighestModSeq)
+	require.False(t, result.Changed)
+	require.NotContains(t, s.Commands(), "STATUS")
+
+	s.Update(func() { s.Caps = append(s.Caps, "CONDSTORE") })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, uint64(2), result.HighestModSeq)
+	require.False(t, result.Changed)
+	require.NotContains(t, s.Commands(), "FETCH")
+
+	s.AddMessage("INBOX", testMailOrder)
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, uint64(3), result.HighestModSeq)
+	require.True(t, result.Changed)
+
+	// A mod-sequence larger than 32 bits.
+	s.mu.Lock()
+	s.modSeq = 1 << 40
+	s.mu.Unlock()
+	step["expectedmodseq"] = uint64(1 << 40)
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, uint64(1<<40), result.HighestModSeq)
+	require.False(t, result.Changed)
+}
+
+func TestExecutor_Run_Timings(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.NotNil(t, result.Timings)
+	require.Positive(t, result.Timings.ConnectSeconds)
+	require.Positive(t, result.Timings.SelectSeconds)
+	require.Positive(t, result.Timings.FetchSeconds)
+	require.Positive(t, result.Timings.ScanSeconds)
+	total := result.Timings.ConnectSeconds + result.Timings.SelectSeconds + result.Timings.FetchSeconds + result.Timings.ScanSeconds
+	require.LessOrEqual(t, total, result.TimeSeconds)
+
+	// Nothing is fetched to count the mails.
+	step["expectedcount"] = 2
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Positive(t, result.Timings.ConnectSeconds)
+	require.Zero(t, result.Timings.FetchSeconds)
+	require.Zero(t, result.Timings.ScanSeconds)
+}
+
+func TestExecutor_Run_ExpectEmpty(t *testing.T) {
+	s := newTestServer(t)
+
+	step := s.Step(venom.TestStep{
+		"expectempty": true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, 0, result.Exists)
+	require.NotContains(t, s.Commands(), "FETCH")
+
+	s.AddMessage("INBOX", testMailOrder)
+	s.AddMessage("INBOX", testMailNewsletter)
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, "mailbox INBOX expected empty but has 2 messages", result.Err)
+	require.Equal(t, "notempty", result.ErrCode)
+	require.Equal(t, 2, result.Exists)
+}
+
+func TestExecutor_Run_Quota(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"action": "quota",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Zero(t, result.QuotaUsed)
+	require.Zero(t, result.QuotaLimit)
+	require.NotContains(t, s.Commands(), "GETQUOTAROOT")
+
+	s.Update(func() {
+		s.Caps = append(s.Caps, "QUOTA")
+		s.QuotaUsage = 900
+		s.QuotaLimit = 1024
+	})
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, uint32(900), result.QuotaUsed)
+	require.Equal(t, uint32(1024), result.QuotaLimit)
+
+	step["mbox"] = "Missing"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Contains(t, result.Err, "GETQUOTAROOT failed: NO Mailbox does not exist")
+
+	step["action"] = "unknown"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, `unsupported action "unknown"`, r.(Result).Err)
+}
+
+func TestExecutor_searchMails_StreamToDisk(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+	e.SearchBody = "order 42"
+	e.StreamToDisk = true
+
+	found, err := e.searchMails(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, found.mails, 1)
+	require.Equal(t, "Order 42 confirmed", found.mails[0].Subject)
+	require.Contains(t, found.mails[0].Body, "order 42")
+
+	files, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestExecutor_Run_CountMatches(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", strings.Replace(testMailOrder, "42", "43", -1))
+	s.AddMessage("Archive", testMailNewsletter)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"countmatches":  true,
+		"mboxonsuccess": "Archive",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, 2, result.MatchCount)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, "Archive", result.MovedTo)
+	require.Len(t, s.Messages("Archive"), 2)
+	require.Len(t, s.Messages("INBOX"), 2)
+}
+
+const testMailForwarded = "From: Monitoring <monitoring@example.org>\r\n" +
+	"To: oncall@example.com\r\n" +
+	"Subject: Fwd: alert\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See the original alert.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"\r\n" +
+	"From: Probe <probe@example.net>\r\n" +
+	"To: monitoring@example.org\r\n" +
+	"Subject: =?UTF-8?Q?Disk_full_on_h=C3=B4te?=\r\n" +
+	"Date: Mon, 02 Jan 2023 15:04:05 +0000\r\n" +
+	"Message-Id: <alert-1@example.net>\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"/var is 98% full =E2=80=94 act now.\r\n" +
+	"--outer--\r\n"
+
+func TestExecutor_searchMails_FollowForwarded(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", testMailForwarded)
+
+	tests := []struct {
+		name      string
+		criteria  Executor
+		wantFound bool
+	}{
+		{name: "subject", criteria: Executor{SearchForwardedSubject: "^Disk full"}, wantFound: true},
+		{name: "from", criteria: Executor{SearchForwardedFrom: "probe@"}, wantFound: true},
+		{name: "body", criteria: Executor{SearchForwardedBody: "98% full — act"}, wantFound: true},
+		{name: "body mismatch", criteria: Executor{SearchForwardedBody: "99%"}},
+		{name: "no forwarded mail", criteria: Executor{SearchSubject: "Order", SearchForwardedFrom: "."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := s.Executor()
+			e.SearchForwardedFrom = tt.criteria.SearchForwardedFrom
+			e.SearchForwardedSubject = tt.criteria.SearchForwardedSubject
+			e.SearchForwardedBody = tt.criteria.SearchForwardedBody
+			e.SearchSubject = tt.criteria.SearchSubject
+
+			found, err := e.searchMails(context.Background(), false)
+			require.NoError(t, err)
+			if !tt.wantFound {
+				require.Empty(t, found.mails)
+				return
+			}
+			require.Len(t, found.mails, 1)
+			require.Equal(t, &Forwarded{
+				Date:      "Mon, 02 Jan 2023 15:04:05 +0000",
+				Subject:   "Disk full on hôte",
+				From:      "Probe <probe@example.net>",
+				To:        "monitoring@example.org",
+				MessageID: "<alert-1@example.net>",
+				Body:      "/var is 98% full — act now.",
+			}, found.mails[0].Forwarded)
+		})
+	}
+
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	e.FollowForwarded = true
+	found, err := e.searchMails(context.Background(), false)
+	require.NoError(t, err)
+	require.Len(t, found.mails, 1)
+	require.Nil(t, found.mails[0].Forwarded)
+}
+
+func TestExecutor_Run_MaxWait(t *testing.T) {
+	previous := pollBackoff
+	pollBackoff = 50 * time.Millisecond
+	defer func() { pollBackoff = previous }()
+
+	s := newTestServer(t)
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"maxwait":       1,
+	})
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.AddMessage("INBOX", testMailOrder)
+	}()
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+
+	step["searchsubject"] = "Invoice"
+	start := time.Now()
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Regexp(t, `^Mail not found after 1s \(\d+ searches\)$`, result.Err)
+	require.Equal(t, "waittimeout", result.ErrCode)
+	require.WithinDuration(t, start.Add(time.Second), time.Now(), 500*time.Millisecond)
+}
+
+func TestExecutor_Run_KeepAliveInterval(t *testing.T) {
+	// The first delay is between 1s and 2s, a NOOP is sent at 1s.
+	previous := pollBackoff
+	pollBackoff = 2 * time.Second
+	defer func() { pollBackoff = previous }()
+
+	for _, drop := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drop %t", drop), func(t *testing.T) {
+			s := newTestServer(t)
+			s.Update(func() { s.DropNoop = drop })
+			step := s.Step(venom.TestStep{
+				"searchsubject":     "Order",
+				"maxwait":           5,
+				"keepaliveinterval": 1,
+			})
+
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				s.AddMessage("INBOX", testMailOrder)
+			}()
+			r, err := s.Executor().Run(context.Background(), step)
+			require.NoError(t, err)
+			result := r.(Result)
+			require.Empty(t, result.Err)
+			require.Equal(t, "Order 42 confirmed", result.Subject)
+
+			var logins, noops int
+			for _, c := range s.Commands() {
+				switch c {
+				case "LOGIN":
+					logins++
+				case "NOOP":
+					noops++
+				}
+			}
+			require.NotZero(t, noops)
+			if drop {
+				require.Equal(t, 2, logins, "the dropped connection is replaced")
+			} else {
+				require.Equal(t, 1, logins, "the connection is kept between the searches")
+			}
+			require.Equal(t, "LOGOUT", s.Commands()[len(s.Commands())-1])
+		})
+	}
+}
+
+func TestExecutor_Run_Counts(t *testing.T) {
+	for _, listStatus := range []bool{false, true} {
+		t.Run(fmt.Sprintf("LIST-STATUS %t", listStatus), func(t *testing.T) {
+			s := newTestServerWithMails(t)
+			s.AddMessage("Archive", testMailNewsletter, `\Seen`)
+			if listStatus {
+				s.Update(func() { s.Caps = append(s.Caps, "LIST-STATUS") })
+			}
+
+			step := s.Step(venom.TestStep{
+				"action": "counts",
+			})
+			r, err := s.Executor().Run(context.Background(), step)
+			require.NoError(t, err)
+			result := r.(Result)
+			require.Empty(t, result.Err)
+			require.Equal(t, map[string]FolderCounts{
+				"Archive": {Messages: 1, Unseen: 0},
+				"INBOX":   {Messages: 2, Unseen: 2},
+			}, result.Folders)
+			if listStatus {
+				require.NotContains(t, s.Commands(), "STATUS")
+			} else {
+				require.Contains(t, s.Commands(), "STATUS")
+			}
+		})
+	}
+}
+
+func TestExecutor_Run_List(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("Archive/2023", testMailNewsletter)
+	s.AddMessage("Archive/2024", testMailOrder)
+	s.AddMessage("Projects/Venom/Specs", testMailOrder)
+
+	step := s.Step(venom.TestStep{
+		"action": "list",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, []string{"Archive/2023", "Archive/2024", "INBOX", "Projects/Venom/Specs"}, result.Mailboxes)
+	require.Nil(t, result.MailboxTree)
+
+	step["treeoutput"] = true
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, MailboxTree{
+		"Archive":  {"2023": {}, "2024": {}},
+		"INBOX":    {},
+		"Projects": {"Venom": {"Specs": {}}},
+	}, result.MailboxTree)
+}
+
+func TestExecutor_Run_Purge(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("Archive", testMailNewsletter)
+	s.AddMessage("Archive", testMailOrder)
+
+	step := s.Step(venom.TestStep{
+		"action": "purge",
+		"mbox":   "Archive",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "action purge requires confirmpurge: true", r.(Result).Err)
+	require.Len(t, s.Messages("Archive"), 2)
+
+	step["confirmpurge"] = true
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, 2, result.Purged)
+	require.Empty(t, s.Messages("Archive"))
+
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Zero(t, result.Purged)
+
+	delete(step, "mbox")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "action purge of INBOX requires allowpurgeinbox: true", r.(Result).Err)
+	require.Len(t, s.Messages("INBOX"), 2)
+
+	step["allowpurgeinbox"] = true
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.(Result).Purged)
+	require.Empty(t, s.Messages("INBOX"))
+}
+
+func TestExecutor_effectiveConfig(t *testing.T) {
+	e := Executor{
+		IMAPHost:      "imap.example.org",
+		IMAPUser:      "venom@example.org",
+		IMAPPassword:  "s3cr3t",
+		SearchSubject: "Order",
+	}
+	require.Equal(t, `address=imap.example.org:993 user="venom@example.org" password=<redacted> mbox="INBOX" tls="direct" criteria=[searchsubject="Order"]`, e.effectiveConfig())
+
+	e.TLSMode = "starttls"
+	e.IMAPPassword = ""
+	e.MBox = "Archive"
+	e.TLSCACert = "ca.pem"
+	e.TLSCAOnly = true
+	e.SearchFrom = "shop@"
+	require.Equal(t, `address=imap.example.org:143 user="venom@example.org" password=<empty> mbox="Archive" tls="starttls, tlscacert ca.pem only" criteria=[searchfrom="shop@" searchsubject="Order"]`, e.effectiveConfig())
+}
+
+func TestExecutor_Run_TLSModeSTARTTLS(t *testing.T) {
+	s := newStartTLSTestServer(t)
+	s.AddMessage("INBOX", testMailOrder)
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, s.CACert, 0o600))
+
+	step := s.Step(venom.TestStep{
+		"tlscacert":     caCert,
+		"tlscaonly":     true,
+		"tlsmode":       "starttls",
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "starttls", result.TLSMode)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, []string{"STARTTLS", "CAPABILITY", "LOGIN"}, s.Commands()[:3])
+
+	step["tlsmode"] = "direct"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to dial")
+
+	step["tlsmode"] = "plain"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `unsupported tlsmode "plain", expected direct or starttls`)
+
+	s.Update(func() { s.Caps = []string{"IMAP4rev1"} })
+	step["tlsmode"] = "starttls"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "tlsmode starttls requires the STARTTLS capability")
+}
+
+func TestExecutor_Run_IMAPWithTLS(t *testing.T) {
+	s := startTestServer(t, true)
+	s.AddMessage("INBOX", testMailOrder)
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, s.CACert, 0o600))
+
+	step := s.Step(venom.TestStep{
+		"tlscacert":     caCert,
+		"imapwithtls":   false,
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "plaintext", result.TLSMode)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, "LOGIN", s.Commands()[0])
+
+	// The connection is upgraded when the server advertises STARTTLS.
+	s.Update(func() { s.Caps = append(s.Caps, "STARTTLS") })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, tlsModeSTARTTLS, result.TLSMode)
+
+	step["tlsmode"] = "direct"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `imapwithtls false is incompatible with tlsmode "direct"`)
+
+	// A TLS connection is the default.
+	delete(step, "imapwithtls")
+	delete(step, "tlsmode")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to dial")
+}
+
+func TestExecutor_Run_IMAPTLSInsecureSkipVerify(t *testing.T) {
+	// The certificate of the server is only trusted with tlscacert through
+	// STARTTLS.
+	s := newStartTLSTestServer(t)
+	s.AddMessage("INBOX", testMailOrder)
+
+	step := s.Step(venom.TestStep{
+		"tlsmode":       "starttls",
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to start TLS")
+
+	step["imaptlsinsecureskipverify"] = true
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+}
+
+func TestExecutor_Run_TLSCipherSuites(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailOrder)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "TLS 1.3", result.TLSVersion)
+	require.NotEmpty(t, result.TLSCipherSuite)
+
+	step["tlsciphersuites"] = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "TLS 1.2", result.TLSVersion)
+	require.Equal(t, "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", result.TLSCipherSuite)
+
+	step["tlsciphersuites"] = []string{"TLS_RSA_WITH_RC4"}
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `unknown tlsciphersuites "TLS_RSA_WITH_RC4"`)
+
+	s.Update(func() {
+		s.serverTLSConfig.MaxVersion = tls.VersionTLS12
+		s.serverTLSConfig.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	})
+	step["tlsciphersuites"] = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Contains(t, result.Err, "unable to dial")
+	require.Contains(t, result.Err, "the server may not support any of the tlsciphersuites TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	require.Empty(t, result.TLSCipherSuite)
+}
+
+func TestExecutor_Run_IMAPTLSMinVersion(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailOrder)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	step["imaptlsminversion"] = "1.4"
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `unsupported imaptlsminversion "1.4", expected 1.0, 1.1, 1.2 or 1.3`)
+
+	step["imaptlsminversion"] = "1.3"
+	step["tlsciphersuites"] = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "imaptlsminversion 1.3 excludes all the tlsciphersuites")
+	delete(step, "tlsciphersuites")
+
+	// A server limited to TLS 1.1 is refused by default.
+	s.Update(func() {
+		s.serverTLSConfig.MinVersion = tls.VersionTLS10
+		s.serverTLSConfig.MaxVersion = tls.VersionTLS11
+	})
+	delete(step, "imaptlsminversion")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "protocol version not supported")
+
+	s.Update(func() { s.serverTLSConfig.MaxVersion = tls.VersionTLS12 })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "TLS 1.2", result.TLSVersion)
+
+	step["imaptlsminversion"] = "1.3"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "protocol version not supported")
+}
+
+func TestExecutor_Run_AuthMechanism(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "LOGIN", result.AuthMechanism)
+
+	s.Update(func() { s.Preauth = true })
+	commands := len(s.Commands())
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "PREAUTH", result.AuthMechanism)
+	for _, cmd := range s.Commands()[commands:] {
+		require.NotContains(t, cmd, "LOGIN")
+	}
+}
+
+func TestExecutor_Run_IMAPDialTimeout(t *testing.T) {
+	venom.InitTestLogger(t)
+	// The connections are accepted, but the server never greets them.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() // nolint
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	step := venom.TestStep{
+		"imaphost":        host,
+		"imapport":        port,
+		"imapuser":        "venom@example.org",
+		"imappassword":    "secret",
+		"searchsubject":   "Order",
+		"imapdialtimeout": "200ms",
+	}
+	start := time.Now()
+	r, err := Executor{}.Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to dial "+listener.Addr().String()+": ")
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	step["imapdialtimeout"] = "soon"
+	r, err = Executor{}.Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, `invalid imapdialtimeout "soon", expected a positive duration such as 10s`)
+}
+
+func TestExecutor_Run_ClientID(t *testing.T) {
+	s := newTestServerWithMails(t)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"clientid":      map[string]string{"name": "venom", "version": "1.2"},
+	})
+	// Without the capability, ID is not sent.
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+	require.NotContains(t, s.Commands(), "ID")
+	require.Nil(t, s.ClientID())
+
+	s.Update(func() { s.Caps = append(s.Caps, "ID") })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).Err)
+	require.Equal(t, map[string]string{"name": "venom", "version": "1.2"}, s.ClientID())
+
+	s.Update(func() { s.IDFail = true })
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to send client ID")
+	require.Eventually(t, func() bool { return s.OpenSessions() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestExecutor_connect_CloseOnError(t *testing.T) {
+	s := newStartTLSTestServer(t)
+	s.Update(func() { s.Caps = append(s.Caps, "AUTH=XOAUTH2") })
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, s.CACert, 0600))
+
+	tests := []struct {
+		name    string
+		setup   func(e *Executor)
+		wantErr string
+	}{
+		{name: "starttls handshake", wantErr: "unable to start TLS"},
+		{name: "login", setup: func(e *Executor) { e.TLSCACert, e.IMAPPassword = caCert, "wrong" }, wantErr: "unable to login"},
+		{name: "xoauth2", setup: func(e *Executor) {
+			e.TLSCACert, e.IMAPAuthMethod, e.IMAPAccessToken = caCert, authMethodXOAuth2, "expired"
+		}, wantErr: "unable to login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := s.Executor()
+			e.TLSMode = tlsModeSTARTTLS
+			if tt.setup != nil {
+				tt.setup(&e)
+			}
+			_, _, err := e.connect(context.Background())
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+			require.Eventually(t, func() bool { return s.OpenSessions() == 0 }, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestExecutor_address(t *testing.T) {
+	tests := []struct {
+		executor Executor
+		want     string
+	}{
+		{executor: Executor{IMAPHost: "imap.example.org"}, want: "imap.example.org:993"},
+		{executor: Executor{IMAPHost: "imap.example.org", TLSMode: "starttls"}, want: "imap.example.org:143"},
+		{executor: Executor{IMAPHost: "imap.example.org", TLSMode: "STARTTLS", IMAPPort: "1143"}, want: "imap.example.org:1143"},
+		{executor: Executor{IMAPHost: "imap.example.org", IMAPPort: ":10993"}, want: "imap.example.org:10993"},
+		{executor: Executor{IMAPHost: "imap.example.org:1993", TLSMode: "starttls"}, want: "imap.example.org:1993"},
+		{executor: Executor{IMAPHost: "imap.example.org", IMAPWithTLS: new(bool)}, want: "imap.example.org:143"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, tt.executor.address())
+	}
+}
+
+func TestExecutor_Run_SearchSince(t *testing.T) {
+	s := newTestServer(t)
+	old := s.AddMessage("INBOX", testMailOrder)
+	old.date = time.Now().Add(-48 * time.Hour)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"searchsince":   "teststart",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "Mail not found", r.(Result).Err)
+	require.Contains(t, s.Commands(), "UID SEARCH")
+
+	// The Date header is set by the sender, only the INTERNALDATE counts.
+	forged := s.AddMessage("INBOX", "Date: "+time.Now().Add(time.Hour).Format(time.RFC1123Z)+"\n"+strings.Replace(testMailOrder, "42", "43", -1))
+	forged.date = time.Now().Add(-10 * time.Second)
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "Mail not found", r.(Result).Err)
+
+	step["searchsince"] = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 43 confirmed", result.Subject)
+
+	step["searchsince"] = "yesterday"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, `invalid searchsince "yesterday", expected teststart or an RFC 3339 time`, r.(Result).Err)
+}
+
+func TestExecutor_getMail_FirstUnseen(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailNewsletter, `\Seen`)
+	s.AddMessage("INBOX", testMailOrder)
+	s.AddMessage("INBOX", testMailInvoice)
+	e := s.Executor()
+	e.FirstUnseen = true
+
+	e.SearchSubject = "Invoice"
+	_, err := e.getMail(context.Background())
+	require.Equal(t, errMailNotFound, err)
+
+	e.SearchSubject, e.SearchBody = "", "order 42"
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+	require.True(t, s.Messages("INBOX")[1].flags[`\Seen`])
+	require.False(t, s.Messages("INBOX")[2].flags[`\Seen`], "only the first unseen mail is fetched")
+
+	e.SearchBody = ""
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Invoice 42", m.Subject)
+
+	s.AddMessage("Archive", testMailNewsletter, `\Seen`)
+	e.MBox = "Archive"
+	_, err = e.getMail(context.Background())
+	require.Equal(t, errMailNotFound, err)
+}
+
+func TestExecutor_Run_ProtocolLog(t *testing.T) {
+	s := newTestServerWithMails(t)
+	e := s.Executor()
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+		"protocollog":   true,
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	log := strings.Join(result.ProtocolLog, "\n")
+	require.Regexp(t, `C: \w+ SELECT "INBOX"`, log)
+	require.Regexp(t, `S: \w+ OK \[READ-WRITE\] SELECT completed`, log)
+	require.NotContains(t, log, "LOGIN")
+	require.NotContains(t, log, e.IMAPPassword)
+
+	delete(step, "protocollog")
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Empty(t, r.(Result).ProtocolLog)
+}
+
+func TestProtocolLog_Write(t *testing.T) {
+	e := Executor{IMAPPassword: "secret", ProtocolLog: true}
+	l := e.newProtocolLog(context.Background())
+
+	fmt.Fprintln(l, `S: * OK [ALERT] Wrong password "secret"`)
+	require.Equal(t, []string{`S: * OK [ALERT] Wrong password "<redacted>"`}, l.collected())
+
+	line := strings.Repeat("x", 1024)
+	for i := 0; i < maxProtocolLogSize/len(line)+1; i++ {
+		fmt.Fprintln(l, line)
+	}
+	lines := l.collected()
+	require.Len(t, lines, maxProtocolLogSize/len(line)+1)
+	require.Equal(t, "... truncated", lines[len(lines)-1])
+}
+
+func TestExecutor_Run_MBoxes(t *testing.T) {
+	s := newTestServer(t)
+	s.AddMessage("INBOX", testMailNewsletter)
+	s.AddMessage("Junk", testMailOrder)
+	s.AddMessage("Archive", testMailInvoice)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "newsletter|Order",
+		"mboxes":        []string{"Junk", "INBOX"},
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, "Junk", result.DeliveredFolder)
+
+	step["searchsubject"] = "newsletter"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "INBOX", r.(Result).DeliveredFolder)
+
+	step["searchsubject"] = "Invoice"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "Mail not found", r.(Result).Err)
+
+	delete(step, "mboxes")
+	step["mbox"] = "Archive"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "Archive", r.(Result).DeliveredFolder)
+
+	step["mboxes"] = []string{"Junk"}
+	step["sinceuid"] = 0
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Equal(t, "mboxes can't be used with sinceuid, the UIDs are those of a single mbox", r.(Result).Err)
+}
+
+func TestExecutor_getMail_BodyMaxFetch(t *testing.T) {
+	for _, noPartial := range []bool{false, true} {
+		t.Run(fmt.Sprintf("partial fetch ignored %v", noPartial), func(t *testing.T) {
+			s := newTestServerWithMails(t)
+			s.AddMessage("INBOX", testMailInvoice)
+			s.Update(func() { s.NoPartialFetch = noPartial })
+			e := s.Executor()
+			e.SearchSubject = "Order"
+			e.ReturnBody = true
+			e.BodyMaxFetch = 10
+			e.StreamToDisk = noPartial
+
+			m, err := e.getMail(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, "Your order", m.Body)
+			require.Equal(t, "Your order", m.BodyText)
+
+			// The multipart body is cut in its first part.
+			e.SearchSubject, e.BodyMaxFetch = "Invoice", 60
+			m, err = e.getMail(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, "Invoice 42", m.Subject)
+			require.Len(t, m.Body, 60)
+		})
+	}
+}
+
+func TestExecutor_getMail_SeqNum(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", testMailInvoice)
+	e := s.Executor()
+
+	e.SeqNum = 2
+	m, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+
+	// The sequence numbers are renumbered once a message is expunged, not
+	// the UIDs.
+	e.SeqNum, e.DeleteOnSuccess = 1, true
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Weekly newsletter", m.Subject)
+	e.DeleteOnSuccess = false
+	m, err = e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Order 42 confirmed", m.Subject)
+	require.Equal(t, uint32(2), m.UID)
+
+	e.SearchSubject = "Invoice"
+	_, err = e.getMail(context.Background())
+	require.Equal(t, errMailNotFound, err)
+
+	e.SearchSubject, e.SeqNum = "", 3
+	_, err = e.getMail(context.Background())
+	require.Equal(t, errMailNotFound, err)
+
+	e.SeqNum = -1
+	_, err = e.getMail(context.Background())
+	require.EqualError(t, err, "seqnum must be greater than 0, the first message is 1")
+}
+
+func TestExecutor_Run_MatchIndex(t *testing.T) {
+	s := newTestServerWithMails(t)
+	s.AddMessage("INBOX", strings.Replace(testMailOrder, "42", "43", -1))
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result := r.(Result)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, 1, result.MatchIndex)
+	require.Equal(t, 2, result.Scanned)
+
+	step["countmatches"] = true
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, 1, result.MatchIndex)
+	require.Equal(t, 3, result.Scanned)
+
+	step["searchsubject"] = "Invoice"
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	result = r.(Result)
+	require.Equal(t, "Mail not found", result.Err)
+	require.Equal(t, 3, result.Scanned)
+}
+
+func TestResult_JSON(t *testing.T) {
+	spamScore := 1.5
+	highestUID := uint32(42)
+	result := Result{
+		Version:         ResultVersion,
+		Err:             "Mail not found",
+		ErrCode:         errCodeSearch,
+		ExpectedErr:     "unable to login",
+		UID:             42,
+		MessageID:       "<42@example.org>",
+		From:            "Shop <shop@example.org>",
+		To:              "customer@example.com",
+		Subject:         "Order 42 confirmed",
+		Body:            "Your order 42 is confirmed.",
+		BodyText:        "Your order 42 is confirmed.",
+		BodyRendered:    "Your order 42 is confirmed.",
+		BodyPart:        "id;amount",
+		BodyHash:        "dabc124cc01bfdc8a6d5f88bffa3a66a5f8b9c6dd9d6b1e89bd251656f22695e",
+		Extracted:       "42",
+		ExtractedAll:    []string{"42"},
+		Priority:        priorityHigh,
+		SpamScore:       &spamScore,
+		GmailLabels:     []string{"Orders"},
+		ThreadID:        "1234567890",
+		RecipientCount:  1,
+		AttachmentCount: 1,
+		Attachments:     []Attachment{{Name: "invoice-42.pdf", Type: "application/pdf", Size: 9, Content: "%PDF-1.4\n", Truncated: true}},
+		FromDomainValid: true,
+		FromDomainMX:    true,
+		AuthResults:     map[string]string{"dkim": "pass"},
+		DKIMDomain:      "example.org",
+		DKIMSelector:    "mail2024",
+		DKIMSignatures:  []DKIMSignature{{Domain: "example.org", Selector: "mail2024"}},
+		Count:           2,
+		MatchCount:      2,
+		MatchIndex:      1,
+		Scanned:         3,
+		Exists:          3,
+		Changed:         true,
+		HighestModSeq:   1 << 40,
+		QuotaUsed:       512,
+		QuotaLimit:      1024,
+		Folders:         map[string]FolderCounts{"INBOX": {Messages: 3, Unseen: 1}},
+		Mailboxes:       []string{"Archive", "Archive/2024", "INBOX"},
+		MailboxTree:     MailboxTree{"Archive": {"2024": {}}, "INBOX": {}},
+		Purged:          3,
+		DeliveredFolder: "INBOX",
+		MovedTo:         "Archive",
+		MovedToUID:      7,
+		ActionTaken:     actionTakenMoved,
+		Envelope:        &Envelope{Date: "Mon, 02 Jan 2006 15:04:05 +0000", Subject: "Order 42 confirmed", From: []string{"shop@example.org"}, To: []string{"customer@example.com"}, Cc: []string{"sales@example.org"}, MessageID: "<42@example.org>"},
+		Forwarded:       &Forwarded{Date: "Mon, 02 Jan 2006 15:04:05 +0000", Subject: "Order 41", From: "shop@example.org", To: "customer@example.com", MessageID: "<41@example.org>", Body: "Your order 41."},
+		InlineParts:     []string{"logo.png"},
+		MIMEParts:       []string{"multipart/mixed", "text/plain"},
+		Alerts:          []string{"Mailbox is almost full"},
+		TLSMode:         tlsModeDirect,
+		TLSVersion:      "TLS 1.3",
+		TLSCipherSuite:  "TLS_AES_128_GCM_SHA256",
+		AuthMechanism:   authMechanismLogin,
+		Mails:           []ResultMail{{UID: 42, MessageID: "<42@example.org>", From: "shop@example.org", To: "customer@example.com", Subject: "Order 42 confirmed", Body: "Your order 42 is confirmed."}},
+		Thread:          []ResultMail{{UID: 41, MessageID: "<41@example.org>", From: "shop@example.org", To: "customer@example.com", Subject: "Order 41", Body: "Your order 41."}},
+		TotalSize:       2048,
+		HighestUID:      &highestUID,
+		UIDValidity:     1,
+		ProtocolLog:     []string{"C: a1 LOGIN venom@example.org ********"},
+		Timings:         &Timings{ConnectSeconds: 0.25, SelectSeconds: 0.125, FetchSeconds: 0.5, ScanSeconds: 0.0625},
+		TimeSeconds:     1,
+	}
+	// A field added to Result must be added above, and to the golden file.
+	v := reflect.ValueOf(result)
+	for i := 0; i < v.NumField(); i++ {
+		require.False(t, v.Field(i).IsZero(), "Result.%s is not set", v.Type().Field(i).Name)
+		tag := v.Type().Field(i).Tag.Get("json")
+		if tag != "err" && tag != "version" {
+			require.True(t, strings.HasSuffix(tag, ",omitempty"), "Result.%s is not omitted when empty", v.Type().Field(i).Name)
+		}
+	}
+
+	var got strings.Builder
+	enc := json.NewEncoder(&got)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	require.NoError(t, enc.Encode(result))
+	golden := filepath.Join("testdata", "result.json")
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(golden, []byte(got.String()), 0644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	require.JSONEq(t, string(want), got.String(), "the JSON shape of Result changed, update %s with -update and ResultVersion if a field was renamed or removed", golden)
+
+	// Only err and version are kept in an empty result.
+	empty, err := json.Marshal(Result{Version: ResultVersion})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 1, "err": ""}`, string(empty))
+}
@@ -0,0 +1,71 @@
+package imap
+
+import (
+	"context"
+	"time"
+
+	"github.com/yesnault/go-imap/imap"
+
+	"github.com/ovh/venom"
+)
+
+// searchConnection returns the connection kept open since the previous search
+// of pollMail, or else a new one.
+func (e *Executor) searchConnection(ctx context.Context) (*imap.Client, error) {
+	if c := e.kept; c != nil {
+		e.kept = nil
+		if c.State() != imap.Closed {
+			return c, nil
+		}
+		venom.Debug(ctx, "The kept connection is closed, reconnecting")
+	}
+	c, tlsMode, err := e.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	e.connTLSMode = tlsMode
+	return c, nil
+}
+
+// releaseSearchConnection keeps c open for the next search of pollMail, with
+// KeepAliveInterval, or else logs out.
+func (e *Executor) releaseSearchConnection(c *imap.Client) {
+	if e.keepConn && c.State() != imap.Closed {
+		e.kept = c
+		return
+	}
+	e.logout(c)
+}
+
+// keepAlive waits for delay, sending a NOOP on the kept connection every
+// KeepAliveInterval so that the server does not drop it as idle. If the NOOP
+// fails, the connection is dropped and the next search reconnects.
+func (e *Executor) keepAlive(ctx context.Context, delay time.Duration) error {
+	interval := time.Duration(e.KeepAliveInterval) * time.Second
+	deadline := time.Now().Add(delay)
+	for {
+		remaining := time.Until(deadline)
+		if remaining < interval {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(remaining):
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		if e.kept == nil {
+			continue
+		}
+		venom.Debug(ctx, "Keepalive NOOP")
+		if _, err := check(e.kept.Noop()); err != nil {
+			venom.Warn(ctx, "Keepalive NOOP failed (%s), reconnecting at the next search", err)
+			e.logout(e.kept)
+			e.kept = nil
+		}
+	}
+}
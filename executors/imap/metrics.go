@@ -0,0 +1,63 @@
+package imap
+
+import (
+	"context"
+	"time"
+)
+
+// Metrics receives the metrics of the imap steps, to feed them into a
+// monitoring system. It is set in the context of the steps with WithMetrics.
+type Metrics interface {
+	// ObserveStep is called at the end of each step.
+	ObserveStep(ctx context.Context, m StepMetrics)
+}
+
+// StepMetrics are the metrics of an imap step.
+type StepMetrics struct {
+	// Action is the action of the step, empty to search a mail.
+	Action string
+	// Connect is the time spent connecting to the server and logging in,
+	// for all the connections of the step.
+	Connect time.Duration
+	// Select is the time spent selecting the mailboxes.
+	Select time.Duration
+	// Fetch is the time spent fetching the mails.
+	Fetch time.Duration
+	// Scan is the time spent decoding the fetched mails and matching them
+	// against the search criteria.
+	Scan time.Duration
+	// Total is the duration of the step.
+	Total time.Duration
+	// Found is true if a mail was found.
+	Found bool
+	// ErrCode is result.errcode, empty if the step succeeded.
+	ErrCode string
+}
+
+// metricsKey is the context key of the Metrics.
+type metricsKey struct{}
+
+// WithMetrics returns a copy of ctx in which the imap steps report their
+// metrics to m.
+func WithMetrics(ctx context.Context, m Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// reportMetrics reports the metrics of the step to the Metrics of ctx, if
+// any.
+func (e *Executor) reportMetrics(ctx context.Context, result Result, total time.Duration) {
+	m, ok := ctx.Value(metricsKey{}).(Metrics)
+	if !ok || m == nil {
+		return
+	}
+	m.ObserveStep(ctx, StepMetrics{
+		Action:  e.Action,
+		Connect: e.connectDuration,
+		Select:  e.selectDuration,
+		Fetch:   e.fetchDuration,
+		Scan:    e.scanDuration,
+		Total:   total,
+		Found:   result.UID != 0 || len(result.Mails) > 0,
+		ErrCode: result.ErrCode,
+	})
+}
@@ -0,0 +1,51 @@
+package imap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ovh/venom"
+)
+
+// testMetrics keeps the observed metrics.
+type testMetrics struct {
+	steps []StepMetrics
+}
+
+func (m *testMetrics) ObserveStep(ctx context.Context, sm StepMetrics) {
+	m.steps = append(m.steps, sm)
+}
+
+func TestExecutor_Run_Metrics(t *testing.T) {
+	s := newTestServerWithMails(t)
+	m := &testMetrics{}
+	ctx := WithMetrics(context.Background(), m)
+
+	step := s.Step(venom.TestStep{
+		"searchsubject": "Order",
+	})
+	_, err := s.Executor().Run(ctx, step)
+	require.NoError(t, err)
+
+	step["searchsubject"] = "Invoice"
+	_, err = s.Executor().Run(ctx, step)
+	require.NoError(t, err)
+
+	require.Len(t, m.steps, 2)
+	require.True(t, m.steps[0].Found)
+	require.Empty(t, m.steps[0].ErrCode)
+	require.Positive(t, m.steps[0].Connect)
+	require.Positive(t, m.steps[0].Select)
+	require.Positive(t, m.steps[0].Fetch)
+	require.Positive(t, m.steps[0].Scan)
+	require.GreaterOrEqual(t, m.steps[0].Total, m.steps[0].Connect+m.steps[0].Select+m.steps[0].Fetch+m.steps[0].Scan)
+	require.False(t, m.steps[1].Found)
+	require.Equal(t, errCodeSearch, m.steps[1].ErrCode)
+
+	// Without Metrics in the context, nothing is reported.
+	_, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Len(t, m.steps, 2)
+}
@@ -0,0 +1,1354 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yesnault/go-imap/imap"
+
+	"github.com/ovh/venom"
+)
+
+// testMessage is a message stored in a mailbox of the testServer.
+type testMessage struct {
+	uid    uint32
+	flags  map[string]bool
+	date   time.Time
+	labels []string
+	thrid  string
+	raw    []byte
+}
+
+func (m *testMessage) header() []byte {
+	if i := bytes.Index(m.raw, []byte("\r\n\r\n")); i >= 0 {
+		return m.raw[:i+4]
+	}
+	return m.raw
+}
+
+func (m *testMessage) text() []byte {
+	if i := bytes.Index(m.raw, []byte("\r\n\r\n")); i >= 0 {
+		return m.raw[i+4:]
+	}
+	return nil
+}
+
+func (m *testMessage) flagList() string {
+	flags := make([]string, 0, len(m.flags))
+	for f := range m.flags {
+		flags = append(flags, f)
+	}
+	sort.Strings(flags)
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+// testServer is a minimal in-memory IMAP server, listening on the loopback
+// interface with a self-signed certificate. It understands the subset of
+// RFC 3501 used by the executor: LOGIN, SELECT, STATUS, SEARCH, FETCH, STORE,
+// COPY, MOVE, EXPUNGE, LIST, CLOSE and LOGOUT, and GETQUOTAROOT (RFC 2087).
+type testServer struct {
+	t         *testing.T
+	listener  net.Listener
+	tlsConfig *tls.Config
+	// serverTLSConfig secures the connections of the server, read on each
+	// handshake.
+	serverTLSConfig *tls.Config
+	// CACert is the PEM certificate of the server, its own CA.
+	CACert []byte
+
+	Caps     []string
+	User     string
+	Password string
+	// AccessToken is the bearer token of User accepted by AUTHENTICATE
+	// XOAUTH2, when advertised in Caps.
+	AccessToken string
+	// DropFetchAfter closes the connection after sending this number of
+	// FETCH responses, once.
+	DropFetchAfter int
+	// SelectBusy makes this number of SELECT commands fail as if the
+	// mailbox was locked by another session.
+	SelectBusy int
+	// SelectBad makes this number of SELECT commands fail with BAD, as a
+	// protocol error.
+	SelectBad int
+	// QuotaUsage and QuotaLimit are the STORAGE quota of all the mailboxes,
+	// in KB, returned by GETQUOTAROOT.
+	QuotaUsage uint32
+	QuotaLimit uint32
+	// FetchFail makes this number of FETCH commands fail with NO and the
+	// response code FetchFailCode.
+	FetchFail     int
+	FetchFailCode string
+	// DropNoop closes the connections receiving a NOOP, as an idle timeout.
+	DropNoop bool
+	// Preauth greets the connections as already authenticated.
+	Preauth bool
+	// NoPartialFetch ignores the <partial> of the BODY[<section>] items,
+	// the whole sections are returned.
+	NoPartialFetch bool
+	// IDFail makes the ID commands fail with NO.
+	IDFail bool
+	// PlainLoginRefusal refuses the wrong credentials with a NO without
+	// response code, as some servers do.
+	PlainLoginRefusal bool
+
+	// mu guards the settings above once serving, see Update, and the state
+	// of the server below.
+	mu        sync.Mutex
+	mailboxes map[string][]*testMessage
+	uidNext   map[string]uint32
+	// modSeq is the HIGHESTMODSEQ of the mailboxes, increased by each
+	// appended mail and each STORE.
+	modSeq   uint64
+	commands []string
+	// clientID is the field-value list of the last ID command.
+	clientID map[string]string
+	// sessions is the number of open connections.
+	sessions int
+}
+
+// newTestServer starts a testServer with an empty INBOX, stopped at the end
+// of the test.
+func newTestServer(t *testing.T) *testServer {
+	return startTestServer(t, false)
+}
+
+// newStartTLSTestServer starts a testServer accepting plain connections, to be
+// upgraded with STARTTLS.
+func newStartTLSTestServer(t *testing.T) *testServer {
+	s := startTestServer(t, true)
+	s.Update(func() { s.Caps = append(s.Caps, "STARTTLS") })
+	return s
+}
+
+func startTestServer(t *testing.T, plain bool) *testServer {
+	venom.InitTestLogger(t)
+
+	cert, pool := testCertificate(t)
+	s := &testServer{
+		t:               t,
+		serverTLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		tlsConfig:       &tls.Config{RootCAs: pool},
+		CACert:          pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+		Caps:            []string{"IMAP4rev1"},
+		User:            "venom@example.org",
+		Password:        "secret",
+		mailboxes:       map[string][]*testMessage{"INBOX": {}},
+		uidNext:         map[string]uint32{"INBOX": 1},
+	}
+	var err error
+	if plain {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	} else {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.handshakeConfig())
+	}
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		s.listener.Close() // nolint
+	})
+
+	go s.serve()
+	return s
+}
+
+// testClientCertificate returns a self-signed client certificate and its key
+// as PEM, and the pool trusting it to set in the ClientCAs of the server.
+func testClientCertificate(t *testing.T) ([]byte, []byte, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "venom imap test client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), pool
+}
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "venom imap test server"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// threadID returns the Gmail thread ID of the message, a message which is not
+// a reply starts its own thread.
+func (m *testMessage) threadID() string {
+	if m.thrid != "" {
+		return m.thrid
+	}
+	return fmt.Sprint(1000 + m.uid)
+}
+
+// Executor returns an Executor configured to connect to the server, trusting
+// its certificate unless a TLS configuration is given.
+func (s *testServer) Executor() Executor {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return Executor{
+		IMAPHost:     host,
+		IMAPPort:     port,
+		IMAPUser:     s.User,
+		IMAPPassword: s.Password,
+		dialTLS:      s.dial,
+	}
+}
+
+// Step returns a step connecting to the server, with extra. A nil value in
+// extra removes the setting from the step.
+func (s *testServer) Step(extra venom.TestStep) venom.TestStep {
+	e := s.Executor()
+	step := venom.TestStep{
+		"imaphost":     e.IMAPHost,
+		"imapport":     e.IMAPPort,
+		"imapuser":     e.IMAPUser,
+		"imappassword": e.IMAPPassword,
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(step, k)
+			continue
+		}
+		step[k] = v
+	}
+	return step
+}
+
+// dial opens a connection to the server trusting its certificate, unless
+// config sets other RootCAs.
+func (s *testServer) dial(addr string, config *tls.Config, timeout time.Duration, l *protocolLog) (*imap.Client, error) {
+	if config == nil {
+		config = s.tlsConfig
+	} else if config.RootCAs == nil {
+		config = config.Clone()
+		config.RootCAs = s.tlsConfig.RootCAs
+	}
+	return dial(addr, config, timeout, l)
+}
+
+// Update changes the settings of the server with f, under its lock: the
+// sessions read them concurrently.
+func (s *testServer) Update(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// handshakeConfig returns the TLS configuration of the connections, taking
+// serverTLSConfig as of their handshake.
+func (s *testServer) handshakeConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.serverTLSConfig.Clone(), nil
+	}}
+}
+
+// AddMessage appends a raw RFC 5322 message to mbox, creating the mailbox if
+// needed. Line endings are normalized to CRLF.
+func (s *testServer) AddMessage(mbox, raw string, flags ...string) *testMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw = strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\n", "\r\n")
+	m := &testMessage{flags: map[string]bool{}, date: time.Now(), raw: []byte(raw)}
+	for _, f := range flags {
+		m.flags[f] = true
+	}
+	s.appendMessage(mbox, m)
+	return m
+}
+
+func (s *testServer) appendMessage(mbox string, m *testMessage) {
+	if _, ok := s.uidNext[mbox]; !ok {
+		s.uidNext[mbox] = 1
+	}
+	m.uid = s.uidNext[mbox]
+	s.uidNext[mbox]++
+	s.modSeq++
+	s.mailboxes[mbox] = append(s.mailboxes[mbox], m)
+}
+
+// Messages returns the messages currently stored in mbox.
+func (s *testServer) Messages(mbox string) []*testMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*testMessage(nil), s.mailboxes[mbox]...)
+}
+
+// Commands returns the name of every command received by the server, in order.
+func (s *testServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// ClientID returns the fields sent by the last ID command, nil without any.
+func (s *testServer) ClientID() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientID
+}
+
+// OpenSessions returns the number of connections not closed yet.
+func (s *testServer) OpenSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go (&testSession{
+			s:    s,
+			conn: conn,
+			r:    bufio.NewReader(conn),
+			w:    bufio.NewWriter(conn),
+		}).run()
+	}
+}
+
+// testSession is a client connection to the testServer.
+type testSession struct {
+	s        *testServer
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	selected string
+}
+
+func (ss *testSession) run() {
+	defer ss.conn.Close() // nolint
+	ss.s.mu.Lock()
+	ss.s.sessions++
+	greeting := "OK"
+	if ss.s.Preauth {
+		greeting = "PREAUTH"
+	}
+	caps := strings.Join(ss.s.Caps, " ")
+	ss.s.mu.Unlock()
+	defer func() {
+		ss.s.mu.Lock()
+		ss.s.sessions--
+		ss.s.mu.Unlock()
+	}()
+
+	ss.writef("* %s [CAPABILITY %s] venom test server ready", greeting, caps)
+	for {
+		if err := ss.w.Flush(); err != nil {
+			return
+		}
+		line, err := ss.readCommand()
+		if err != nil {
+			return
+		}
+		fields, err := parseTestFields(line)
+		if err != nil || len(fields) < 2 {
+			ss.writef("* BAD invalid command")
+			continue
+		}
+		tag, _ := fields[0].(string)
+		name, _ := fields[1].(string)
+		name = strings.ToUpper(name)
+		args := fields[2:]
+		if name == "UID" && len(args) > 0 {
+			sub, _ := args[0].(string)
+			name, args = "UID "+strings.ToUpper(sub), args[1:]
+		}
+
+		ss.s.mu.Lock()
+		ss.s.commands = append(ss.s.commands, name)
+		logout := ss.handle(tag, name, args)
+		ss.s.mu.Unlock()
+		if logout {
+			ss.w.Flush() // nolint
+			return
+		}
+	}
+}
+
+var testLiteralRegexp = regexp.MustCompile(`\{(\d+)(\+?)\}$`)
+
+// readCommand reads a full command line, inlining literals as quoted strings.
+func (ss *testSession) readCommand() (string, error) {
+	line, err := ss.readLine()
+	if err != nil {
+		return "", err
+	}
+	for {
+		m := testLiteralRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return line, nil
+		}
+		n, _ := strconv.Atoi(m[1])
+		if m[2] == "" {
+			ss.writef("+ Ready for literal data")
+			if err := ss.w.Flush(); err != nil {
+				return "", err
+			}
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(ss.r, literal); err != nil {
+			return "", err
+		}
+		rest, err := ss.readLine()
+		if err != nil {
+			return "", err
+		}
+		line = line[:len(line)-len(m[0])] + testQuote(string(literal)) + rest
+	}
+}
+
+func (ss *testSession) readLine() (string, error) {
+	line, err := ss.r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (ss *testSession) writef(format string, args ...interface{}) {
+	fmt.Fprintf(ss.w, format+"\r\n", args...)
+}
+
+// refuseLogin answers a LOGIN or an AUTHENTICATE with wrong credentials.
+func (ss *testSession) refuseLogin(tag string) {
+	if ss.s.PlainLoginRefusal {
+		ss.writef("%s NO Invalid credentials", tag)
+		return
+	}
+	ss.writef("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+}
+
+// handle runs a command, it returns true when the connection must be closed.
+// The server lock is held.
+func (ss *testSession) handle(tag, name string, args []interface{}) bool {
+	switch name {
+	case "CAPABILITY":
+		ss.writef("* CAPABILITY %s", strings.Join(ss.s.Caps, " "))
+		ss.writef("%s OK CAPABILITY completed", tag)
+	case "NOOP":
+		if ss.s.DropNoop {
+			return true
+		}
+		ss.writef("%s OK NOOP completed", tag)
+	case "LOGOUT":
+		ss.writef("* BYE venom test server logging out")
+		ss.writef("%s OK LOGOUT completed", tag)
+		return true
+	case "LOGIN":
+		if len(args) != 2 || testString(args[0]) != ss.s.User || testString(args[1]) != ss.s.Password {
+			ss.refuseLogin(tag)
+			break
+		}
+		ss.writef("%s OK [CAPABILITY %s] LOGIN completed", tag, strings.Join(ss.s.Caps, " "))
+	case "ID":
+		if ss.s.IDFail {
+			ss.writef("%s NO ID not allowed", tag)
+			break
+		}
+		list, _ := testArg(args, 0).([]interface{})
+		ss.s.clientID = map[string]string{}
+		for i := 0; i+1 < len(list); i += 2 {
+			ss.s.clientID[testString(list[i])] = testString(list[i+1])
+		}
+		ss.writef(`* ID ("name" "venom test server")`)
+		ss.writef("%s OK ID completed", tag)
+	case "AUTHENTICATE":
+		if !strings.EqualFold(testString(testArg(args, 0)), "XOAUTH2") {
+			ss.writef("%s NO Unsupported authentication mechanism", tag)
+			break
+		}
+		// Without SASL-IR, the initial response follows an empty challenge.
+		response := testString(testArg(args, 1))
+		if len(args) < 2 {
+			ss.writef("+ ")
+			if ss.w.Flush() != nil {
+				return true
+			}
+			response, _ = ss.readLine()
+		}
+		want := "user=" + ss.s.User + "\x01auth=Bearer " + ss.s.AccessToken + "\x01\x01"
+		if ss.s.AccessToken == "" || response != base64.StdEncoding.EncodeToString([]byte(want)) {
+			ss.writef("+ %s", base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`)))
+			if ss.w.Flush() != nil {
+				return true
+			}
+			ss.readLine() // nolint
+			ss.refuseLogin(tag)
+			break
+		}
+		ss.writef("%s OK [CAPABILITY %s] AUTHENTICATE completed", tag, strings.Join(ss.s.Caps, " "))
+	case "SELECT", "EXAMINE":
+		mbox := testString(testArg(args, 0))
+		if ss.s.SelectBad > 0 {
+			ss.s.SelectBad--
+			ss.selected = ""
+			ss.writef("%s BAD Invalid mailbox name", tag)
+			break
+		}
+		if ss.s.SelectBusy > 0 {
+			ss.s.SelectBusy--
+			ss.selected = ""
+			ss.writef("* OK [ALERT] Mailbox is locked by another session")
+			ss.writef("%s NO [INUSE] Mailbox in use", tag)
+			break
+		}
+		msgs, ok := ss.s.mailboxes[mbox]
+		if !ok {
+			ss.selected = ""
+			ss.writef("%s NO Mailbox does not exist", tag)
+			break
+		}
+		ss.selected = mbox
+		ss.writef(`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+		ss.writef("* %d EXISTS", len(msgs))
+		ss.writef("* 0 RECENT")
+		for i, m := range msgs {
+			if !m.flags[`\Seen`] {
+				ss.writef("* OK [UNSEEN %d] First unseen", i+1)
+				break
+			}
+		}
+		ss.writef("* OK [UIDVALIDITY 1] UIDs valid")
+		ss.writef("* OK [UIDNEXT %d] Predicted next UID", ss.s.uidNext[mbox])
+		if name == "EXAMINE" {
+			ss.writef("%s OK [READ-ONLY] EXAMINE completed", tag)
+		} else {
+			ss.writef("%s OK [READ-WRITE] SELECT completed", tag)
+		}
+	case "STATUS":
+		mbox := testString(testArg(args, 0))
+		msgs, ok := ss.s.mailboxes[mbox]
+		if !ok {
+			ss.writef("%s NO Mailbox does not exist", tag)
+			break
+		}
+		if items, _ := testArg(args, 1).([]interface{}); len(items) == 1 && testString(items[0]) == "HIGHESTMODSEQ" {
+			ss.writef("* STATUS %s (HIGHESTMODSEQ %d)", testQuote(mbox), ss.s.modSeq)
+		} else {
+			ss.writef("* STATUS %s (MESSAGES %d RECENT 0 UIDNEXT %d UIDVALIDITY 1 UNSEEN %d)", testQuote(mbox), len(msgs), ss.s.uidNext[mbox], testUnseen(msgs))
+		}
+		ss.writef("%s OK STATUS completed", tag)
+	case "STARTTLS":
+		ss.writef("%s OK Begin TLS negotiation now", tag)
+		if err := ss.w.Flush(); err != nil {
+			return true
+		}
+		ss.conn = tls.Server(ss.conn, ss.s.handshakeConfig())
+		ss.r, ss.w = bufio.NewReader(ss.conn), bufio.NewWriter(ss.conn)
+	case "LIST":
+		ss.list(tag, args)
+	case "GETQUOTAROOT":
+		mbox := testString(testArg(args, 0))
+		if _, ok := ss.s.mailboxes[mbox]; !ok {
+			ss.writef("%s NO Mailbox does not exist", tag)
+			break
+		}
+		ss.writef(`* QUOTAROOT %s ""`, testQuote(mbox))
+		ss.writef(`* QUOTA "" (STORAGE %d %d)`, ss.s.QuotaUsage, ss.s.QuotaLimit)
+		ss.writef("%s OK GETQUOTAROOT completed", tag)
+	case "CLOSE":
+		if ss.selected == "" {
+			ss.writef("%s BAD No mailbox selected", tag)
+			break
+		}
+		ss.expunge(false)
+		ss.selected = ""
+		ss.writef("%s OK CLOSE completed", tag)
+	case "UNSELECT":
+		if ss.selected == "" {
+			ss.writef("%s BAD No mailbox selected", tag)
+			break
+		}
+		ss.selected = ""
+		ss.writef("%s OK UNSELECT completed", tag)
+	case "EXPUNGE":
+		if ss.selected == "" {
+			ss.writef("%s BAD No mailbox selected", tag)
+			break
+		}
+		ss.expunge(true)
+		ss.writef("%s OK EXPUNGE completed", tag)
+	case "SEARCH", "UID SEARCH":
+		ss.search(tag, name, args)
+	case "UID SORT":
+		ss.sort(tag, args)
+	case "FETCH", "UID FETCH":
+		ss.fetch(tag, name, args)
+	case "STORE", "UID STORE":
+		ss.store(tag, name, args)
+	case "COPY", "UID COPY", "MOVE", "UID MOVE":
+		ss.copy(tag, name, args)
+	default:
+		ss.writef("%s BAD Unknown command %s", tag, name)
+	}
+	return false
+}
+
+// list answers LIST with all the mailboxes, whatever the pattern. With
+// RETURN (STATUS ...) (RFC 5819), their status follows each of them.
+func (ss *testSession) list(tag string, args []interface{}) {
+	withStatus := strings.EqualFold(testString(testArg(args, 2)), "RETURN")
+	names := make([]string, 0, len(ss.s.mailboxes))
+	for name := range ss.s.mailboxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ss.writef(`* LIST () "/" %s`, testQuote(name))
+		if withStatus {
+			msgs := ss.s.mailboxes[name]
+			ss.writef("* STATUS %s (MESSAGES %d UNSEEN %d)", testQuote(name), len(msgs), testUnseen(msgs))
+		}
+	}
+	ss.writef("%s OK LIST completed", tag)
+}
+
+// messages returns the messages of the selected mailbox designated by set,
+// along with their sequence numbers.
+func (ss *testSession) messages(set string, uid bool) ([]*testMessage, []int, error) {
+	seqset, err := imap.NewSeqSet(set)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs := ss.s.mailboxes[ss.selected]
+	var last uint32
+	if len(msgs) > 0 {
+		last = uint32(len(msgs))
+		if uid {
+			last = msgs[len(msgs)-1].uid
+		}
+	}
+	var found []*testMessage
+	var seqs []int
+	for i, m := range msgs {
+		n := uint32(i + 1)
+		if uid {
+			n = m.uid
+		}
+		if seqset.Contains(n) || (seqset.Dynamic() && n == last) {
+			found = append(found, m)
+			seqs = append(seqs, i+1)
+		}
+	}
+	return found, seqs, nil
+}
+
+func (ss *testSession) expunge(notify bool) {
+	msgs := ss.s.mailboxes[ss.selected]
+	for i := 0; i < len(msgs); {
+		if msgs[i].flags[`\Deleted`] {
+			if notify {
+				ss.writef("* %d EXPUNGE", i+1)
+			}
+			msgs = append(msgs[:i], msgs[i+1:]...)
+			continue
+		}
+		i++
+	}
+	ss.s.mailboxes[ss.selected] = msgs
+}
+
+func (ss *testSession) search(tag, name string, args []interface{}) {
+	if ss.selected == "" {
+		ss.writef("%s BAD No mailbox selected", tag)
+		return
+	}
+	if len(args) >= 2 && strings.EqualFold(testString(args[0]), "CHARSET") {
+		args = args[2:]
+	}
+	var results []string
+	for i, m := range ss.s.mailboxes[ss.selected] {
+		match, err := ss.matchSearch(m, args)
+		if err != nil {
+			ss.writef("%s BAD %s", tag, err)
+			return
+		}
+		if !match {
+			continue
+		}
+		if name == "UID SEARCH" {
+			results = append(results, strconv.Itoa(int(m.uid)))
+		} else {
+			results = append(results, strconv.Itoa(i+1))
+		}
+	}
+	if len(results) == 0 {
+		ss.writef("* SEARCH")
+	} else {
+		ss.writef("* SEARCH %s", strings.Join(results, " "))
+	}
+	ss.writef("%s OK SEARCH completed", tag)
+}
+
+// sort handles UID SORT (RFC 5256) for the ARRIVAL, DATE, FROM, SIZE and
+// SUBJECT keys.
+func (ss *testSession) sort(tag string, args []interface{}) {
+	criteria, ok := testArg(args, 0).([]interface{})
+	if ss.selected == "" || !ok || !ss.s.hasCap("SORT") || len(args) < 2 {
+		ss.writef("%s BAD Invalid SORT", tag)
+		return
+	}
+	for _, c := range criteria {
+		switch strings.ToUpper(testString(c)) {
+		case "REVERSE", "ARRIVAL", "DATE", "FROM", "SIZE", "SUBJECT":
+		default:
+			ss.writef("%s BAD Unsupported sort criterion %s", tag, testString(c))
+			return
+		}
+	}
+	var msgs []*testMessage
+	for _, m := range ss.s.mailboxes[ss.selected] {
+		match, err := ss.matchSearch(m, args[2:])
+		if err != nil {
+			ss.writef("%s BAD %s", tag, err)
+			return
+		}
+		if match {
+			msgs = append(msgs, m)
+		}
+	}
+
+	key := func(m *testMessage, criterion string) string {
+		msg, _ := mail.ReadMessage(bytes.NewReader(m.raw))
+		switch criterion {
+		case "ARRIVAL":
+			return m.date.UTC().Format(time.RFC3339Nano)
+		case "DATE":
+			if d, err := msg.Header.Date(); err == nil {
+				return d.UTC().Format(time.RFC3339Nano)
+			}
+			return m.date.UTC().Format(time.RFC3339Nano)
+		case "SIZE":
+			return fmt.Sprintf("%010d", len(m.raw))
+		case "SUBJECT", "FROM":
+			return strings.ToLower(msg.Header.Get(criterion))
+		}
+		return ""
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		reverse := false
+		for _, c := range criteria {
+			criterion := strings.ToUpper(testString(c))
+			if criterion == "REVERSE" {
+				reverse = true
+				continue
+			}
+			a, b := key(msgs[i], criterion), key(msgs[j], criterion)
+			if a != b {
+				return (a < b) != reverse
+			}
+			reverse = false
+		}
+		return false
+	})
+
+	results := []string{"SORT"}
+	for _, m := range msgs {
+		results = append(results, strconv.Itoa(int(m.uid)))
+	}
+	ss.writef("* %s", strings.Join(results, " "))
+	ss.writef("%s OK SORT completed", tag)
+}
+
+var testSearchFlags = map[string]string{
+	"SEEN":     `\Seen`,
+	"DELETED":  `\Deleted`,
+	"ANSWERED": `\Answered`,
+	"FLAGGED":  `\Flagged`,
+}
+
+// matchSearch reports whether m matches all the search keys.
+func (ss *testSession) matchSearch(m *testMessage, keys []interface{}) (bool, error) {
+	for len(keys) > 0 {
+		match, rest, err := ss.matchSearchKey(m, keys)
+		if err != nil {
+			return false, err
+		}
+		if !match {
+			return false, nil
+		}
+		keys = rest
+	}
+	return true, nil
+}
+
+func (ss *testSession) matchSearchKey(m *testMessage, keys []interface{}) (bool, []interface{}, error) {
+	if list, ok := keys[0].([]interface{}); ok {
+		match, err := ss.matchSearch(m, list)
+		return match, keys[1:], err
+	}
+	key := strings.ToUpper(testString(keys[0]))
+	keys = keys[1:]
+	value := func() (string, error) {
+		if len(keys) == 0 {
+			return "", fmt.Errorf("missing argument for %s", key)
+		}
+		v := testString(keys[0])
+		keys = keys[1:]
+		return v, nil
+	}
+	header := func(name string) (bool, []interface{}, error) {
+		v, err := value()
+		if err != nil {
+			return false, nil, err
+		}
+		msg, _ := mail.ReadMessage(bytes.NewReader(m.raw))
+		if msg == nil {
+			return false, keys, nil
+		}
+		return strings.Contains(strings.ToLower(msg.Header.Get(name)), strings.ToLower(v)), keys, nil
+	}
+
+	switch key {
+	case "ALL":
+		return true, keys, nil
+	case "SEEN", "DELETED", "ANSWERED", "FLAGGED":
+		return m.flags[testSearchFlags[key]], keys, nil
+	case "UNSEEN", "UNDELETED", "UNANSWERED", "UNFLAGGED":
+		return !m.flags[testSearchFlags[key[2:]]], keys, nil
+	case "SUBJECT", "FROM", "TO", "CC":
+		return header(key)
+	case "BODY":
+		v, err := value()
+		if err != nil {
+			return false, nil, err
+		}
+		return bytes.Contains(bytes.ToLower(m.text()), []byte(strings.ToLower(v))), keys, nil
+	case "SINCE":
+		v, err := value()
+		if err != nil {
+			return false, nil, err
+		}
+		since, err := time.ParseInLocation("2-Jan-2006", v, m.date.Location())
+		if err != nil {
+			return false, nil, err
+		}
+		return !m.date.Before(since), keys, nil
+	case "UID":
+		v, err := value()
+		if err != nil {
+			return false, nil, err
+		}
+		seqset, err := imap.NewSeqSet(v)
+		if err != nil {
+			return false, nil, err
+		}
+		return seqset.Contains(m.uid), keys, nil
+	case "X-GM-LABELS":
+		v, err := value()
+		if err != nil {
+			return false, nil, err
+		}
+		for _, l := range m.labels {
+			if l == v {
+				return true, keys, nil
+			}
+		}
+		return false, keys, nil
+	case "X-GM-THRID":
+		v, err := value()
+		if err != nil {
+			return false, nil, err
+		}
+		return m.threadID() == v, keys, nil
+	case "NOT":
+		match, rest, err := ss.matchSearchKey(m, keys)
+		return !match, rest, err
+	case "OR":
+		left, rest, err := ss.matchSearchKey(m, keys)
+		if err != nil {
+			return false, nil, err
+		}
+		right, rest, err := ss.matchSearchKey(m, rest)
+		return left || right, rest, err
+	}
+	return false, nil, fmt.Errorf("unsupported search key %s", key)
+}
+
+func (ss *testSession) fetch(tag, name string, args []interface{}) {
+	if ss.selected == "" || len(args) != 2 {
+		ss.writef("%s BAD Invalid FETCH", tag)
+		return
+	}
+	if ss.s.FetchFail > 0 {
+		ss.s.FetchFail--
+		ss.writef("%s NO [%s] Try again later", tag, ss.s.FetchFailCode)
+		return
+	}
+	uid := name == "UID FETCH"
+	msgs, seqs, err := ss.messages(testString(args[0]), uid)
+	if err != nil {
+		ss.writef("%s BAD %s", tag, err)
+		return
+	}
+	items, ok := args[1].([]interface{})
+	if !ok {
+		items = []interface{}{args[1]}
+	}
+	for i, m := range msgs {
+		attrs := []string{}
+		if uid {
+			attrs = append(attrs, fmt.Sprintf("UID %d", m.uid))
+		}
+		for _, it := range items {
+			item := strings.ToUpper(testString(it))
+			switch {
+			case item == "UID":
+				if !uid {
+					attrs = append(attrs, fmt.Sprintf("UID %d", m.uid))
+				}
+			case item == "FLAGS":
+				attrs = append(attrs, "FLAGS "+m.flagList())
+			case item == "INTERNALDATE":
+				attrs = append(attrs, "INTERNALDATE "+m.date.Format(imap.DATETIME))
+			case item == "RFC822.SIZE":
+				attrs = append(attrs, fmt.Sprintf("RFC822.SIZE %d", len(m.raw)))
+			case item == "RFC822":
+				attrs = append(attrs, "RFC822 "+testLiteral(m.raw))
+				m.flags[`\Seen`] = true
+			case item == "RFC822.HEADER":
+				attrs = append(attrs, "RFC822.HEADER "+testLiteral(m.header()))
+			case item == "RFC822.TEXT":
+				attrs = append(attrs, "RFC822.TEXT "+testLiteral(m.text()))
+				m.flags[`\Seen`] = true
+			case item == "ENVELOPE":
+				attrs = append(attrs, "ENVELOPE "+testEnvelope(m.raw))
+			case item == "X-GM-LABELS":
+				labels := make([]string, len(m.labels))
+				for i, l := range m.labels {
+					labels[i] = testQuote(l)
+				}
+				attrs = append(attrs, "X-GM-LABELS ("+strings.Join(labels, " ")+")")
+			case item == "X-GM-THRID":
+				attrs = append(attrs, "X-GM-THRID "+m.threadID())
+			case strings.HasPrefix(item, "BODY[") || strings.HasPrefix(item, "BODY.PEEK["):
+				attr, data, err := testBodySection(m, item, !ss.s.NoPartialFetch)
+				if err != nil {
+					ss.writef("%s BAD %s", tag, err)
+					return
+				}
+				if !strings.HasPrefix(item, "BODY.PEEK[") {
+					m.flags[`\Seen`] = true
+				}
+				attrs = append(attrs, attr+" "+testLiteral(data))
+			default:
+				ss.writef("%s BAD Unsupported FETCH item %s", tag, item)
+				return
+			}
+		}
+		ss.writef("* %d FETCH (%s)", seqs[i], strings.Join(attrs, " "))
+		if ss.s.DropFetchAfter > 0 && i+1 == ss.s.DropFetchAfter {
+			ss.s.DropFetchAfter = 0
+			ss.w.Flush()    // nolint
+			ss.conn.Close() // nolint
+			return
+		}
+	}
+	ss.writef("%s OK FETCH completed", tag)
+}
+
+var testSectionRegexp = regexp.MustCompile(`^BODY(?:\.PEEK)?\[([^\]]*)\](?:<(\d+)\.(\d+)>)?$`)
+
+// testBodySection returns the response attribute name and the data of a
+// BODY[<section>]<<partial>> item. The whole section is returned unless
+// partial is set.
+func testBodySection(m *testMessage, item string, partial bool) (string, []byte, error) {
+	match := testSectionRegexp.FindStringSubmatch(item)
+	if match == nil {
+		return "", nil, fmt.Errorf("invalid section %s", item)
+	}
+	var data []byte
+	switch match[1] {
+	case "":
+		data = m.raw
+	case "HEADER":
+		data = m.header()
+	case "TEXT":
+		data = m.text()
+	default:
+		part := testPartRegexp.FindStringSubmatch(match[1])
+		if part == nil {
+			return "", nil, fmt.Errorf("unsupported section %s", match[1])
+		}
+		header, content := testPart(m.raw, part[1])
+		data = content
+		if part[2] != "" {
+			data = header
+		}
+	}
+	attr := "BODY[" + match[1] + "]"
+	if match[2] != "" && partial {
+		offset, _ := strconv.Atoi(match[2])
+		length, _ := strconv.Atoi(match[3])
+		if offset > len(data) {
+			offset = len(data)
+		}
+		if offset+length > len(data) {
+			length = len(data) - offset
+		}
+		data = data[offset : offset+length]
+		attr += "<" + match[2] + ">"
+	}
+	return attr, data, nil
+}
+
+var testPartRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)*)(\.MIME)?$`)
+
+// testPart returns the MIME header and the content of the part of raw at
+// section, as 2.1, nil if there is no such part. The part 1 of a message which
+// is not multipart is its body.
+func testPart(raw []byte, section string) ([]byte, []byte) {
+	header, content := raw, []byte(nil)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		header, content = raw[:i+4], raw[i+4:]
+	}
+	for _, n := range strings.Split(section, ".") {
+		index, _ := strconv.Atoi(n)
+		msg, err := mail.ReadMessage(bytes.NewReader(header))
+		if err != nil {
+			return nil, nil
+		}
+		mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if !strings.HasPrefix(mediaType, "multipart/") {
+			if index != 1 {
+				return nil, nil
+			}
+			continue
+		}
+		mr := multipart.NewReader(bytes.NewReader(content), params["boundary"])
+		for i := 1; ; i++ {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				return nil, nil
+			}
+			if i < index {
+				continue
+			}
+			keys := make([]string, 0, len(p.Header))
+			for k := range p.Header {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var b bytes.Buffer
+			for _, k := range keys {
+				for _, v := range p.Header[k] {
+					fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+				}
+			}
+			b.WriteString("\r\n")
+			header = b.Bytes()
+			content, _ = io.ReadAll(p)
+			break
+		}
+	}
+	return header, content
+}
+
+func (ss *testSession) store(tag, name string, args []interface{}) {
+	if ss.selected == "" || len(args) != 3 {
+		ss.writef("%s BAD Invalid STORE", tag)
+		return
+	}
+	uid := name == "UID STORE"
+	msgs, seqs, err := ss.messages(testString(args[0]), uid)
+	if err != nil {
+		ss.writef("%s BAD %s", tag, err)
+		return
+	}
+	item := strings.ToUpper(testString(args[1]))
+	flags, ok := args[2].([]interface{})
+	if !ok {
+		flags = []interface{}{args[2]}
+	}
+	for i, m := range msgs {
+		switch strings.TrimSuffix(item, ".SILENT") {
+		case "FLAGS":
+			m.flags = map[string]bool{}
+			fallthrough
+		case "+FLAGS":
+			for _, f := range flags {
+				m.flags[testString(f)] = true
+			}
+		case "-FLAGS":
+			for _, f := range flags {
+				delete(m.flags, testString(f))
+			}
+		default:
+			ss.writef("%s BAD Invalid STORE item %s", tag, item)
+			return
+		}
+		ss.s.modSeq++
+		if !strings.HasSuffix(item, ".SILENT") {
+			if uid {
+				ss.writef("* %d FETCH (UID %d FLAGS %s)", seqs[i], m.uid, m.flagList())
+			} else {
+				ss.writef("* %d FETCH (FLAGS %s)", seqs[i], m.flagList())
+			}
+		}
+	}
+	ss.writef("%s OK STORE completed", tag)
+}
+
+func (ss *testSession) copy(tag, name string, args []interface{}) {
+	move := strings.HasSuffix(name, "MOVE")
+	if move && !ss.s.hasCap("MOVE") {
+		ss.writef("%s BAD Unknown command %s", tag, name)
+		return
+	}
+	if ss.selected == "" || len(args) != 2 {
+		ss.writef("%s BAD Invalid %s", tag, name)
+		return
+	}
+	msgs, _, err := ss.messages(testString(args[0]), strings.HasPrefix(name, "UID "))
+	if err != nil {
+		ss.writef("%s BAD %s", tag, err)
+		return
+	}
+	dest := testString(args[1])
+	if _, ok := ss.s.mailboxes[dest]; !ok {
+		ss.writef("%s NO [TRYCREATE] Mailbox does not exist", tag)
+		return
+	}
+	var srcUIDs, dstUIDs []string
+	for _, m := range msgs {
+		cp := &testMessage{flags: map[string]bool{}, date: m.date, labels: m.labels, thrid: m.thrid, raw: m.raw}
+		for f := range m.flags {
+			cp.flags[f] = true
+		}
+		ss.s.appendMessage(dest, cp)
+		srcUIDs, dstUIDs = append(srcUIDs, fmt.Sprint(m.uid)), append(dstUIDs, fmt.Sprint(cp.uid))
+		if move {
+			m.flags[`\Deleted`] = true
+		}
+	}
+	code := ""
+	if ss.s.hasCap("UIDPLUS") && len(msgs) > 0 {
+		code = fmt.Sprintf("[COPYUID 1 %s %s] ", strings.Join(srcUIDs, ","), strings.Join(dstUIDs, ","))
+	}
+	if move {
+		if code != "" {
+			ss.writef("* OK %sMoved", code)
+			code = ""
+		}
+		ss.expunge(true)
+	}
+	ss.writef("%s OK %s%s completed", tag, code, name)
+}
+
+func (s *testServer) hasCap(name string) bool {
+	for _, c := range s.Caps {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// testEnvelope builds the ENVELOPE structure of a raw message.
+func testEnvelope(raw []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "(NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL)"
+	}
+	h := msg.Header
+	nstring := func(name string) string {
+		if v := h.Get(name); v != "" {
+			return testString2IMAP(v)
+		}
+		return "NIL"
+	}
+	addresses := func(names ...string) string {
+		for _, name := range names {
+			list, err := h.AddressList(name)
+			if err != nil || len(list) == 0 {
+				continue
+			}
+			var addrs []string
+			for _, a := range list {
+				mailbox, host := a.Address, "NIL"
+				if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+					mailbox, host = a.Address[:i], testQuote(a.Address[i+1:])
+				}
+				name := "NIL"
+				if a.Name != "" {
+					name = testString2IMAP(a.Name)
+				}
+				addrs = append(addrs, fmt.Sprintf("(%s NIL %s %s)", name, testQuote(mailbox), host))
+			}
+			return "(" + strings.Join(addrs, "") + ")"
+		}
+		return "NIL"
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nstring("Date"), nstring("Subject"),
+		addresses("From"), addresses("Sender", "From"), addresses("Reply-To", "From"),
+		addresses("To"), addresses("Cc"), addresses("Bcc"),
+		nstring("In-Reply-To"), nstring("Message-Id"))
+}
+
+// testString2IMAP returns s as a quoted string, or as a literal when it
+// cannot be quoted.
+func testString2IMAP(s string) string {
+	if q := imap.Quote(s, false); q != "" {
+		return q
+	}
+	return testLiteral([]byte(s))
+}
+
+func testQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func testLiteral(b []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(b), b)
+}
+
+// testUnseen returns the number of messages without the \Seen flag.
+func testUnseen(msgs []*testMessage) int {
+	var unseen int
+	for _, m := range msgs {
+		if !m.flags[`\Seen`] {
+			unseen++
+		}
+	}
+	return unseen
+}
+
+func testArg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// testString returns the value of an atom or a string field.
+func testString(f interface{}) string {
+	s, _ := f.(string)
+	return s
+}
+
+// parseTestFields splits a command line into atoms, strings and
+// parenthesized lists. Quoted strings are unquoted, atoms containing a
+// bracketed section (BODY[HEADER.FIELDS (FROM)]) are kept whole.
+func parseTestFields(line string) ([]interface{}, error) {
+	fields, rest, err := parseTestList(line, 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q", rest)
+	}
+	return fields, nil
+}
+
+func parseTestList(s string, stop byte) ([]interface{}, string, error) {
+	fields := []interface{}{}
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			if stop != 0 {
+				return nil, "", fmt.Errorf("missing %q", stop)
+			}
+			return fields, "", nil
+		}
+		switch s[0] {
+		case stop:
+			return fields, s[1:], nil
+		case '(':
+			list, rest, err := parseTestList(s[1:], ')')
+			if err != nil {
+				return nil, "", err
+			}
+			fields, s = append(fields, list), rest
+		case '"':
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, "", fmt.Errorf("unterminated string")
+			}
+			fields, s = append(fields, b.String()), s[i+1:]
+		default:
+			i, depth := 0, 0
+			for ; i < len(s); i++ {
+				c := s[i]
+				if c == '[' {
+					depth++
+				} else if c == ']' {
+					depth--
+				} else if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+					break
+				}
+			}
+			if i == 0 {
+				return nil, "", fmt.Errorf("unexpected %q", s[0])
+			}
+			fields, s = append(fields, s[:i]), s[i:]
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/yesnault/go-imap/imap"
+
+	"github.com/ovh/venom"
+)
+
+// protocolLogMask is the log mask of the connections with debugprotocol or
+// protocollog: the lines exchanged with the server, except during LOGIN.
+const protocolLogMask = imap.LogConn | imap.LogRaw
+
+// maxProtocolLogSize is the maximum size of result.protocollog, in bytes.
+const maxProtocolLogSize = 64 * 1024
+
+// protocolLog receives the debug messages of the connections, the lines
+// exchanged with the server. They are written to venom's logger with
+// DebugProtocol, and kept for result.protocollog with ProtocolLog.
+type protocolLog struct {
+	ctx     context.Context
+	debug   bool
+	collect bool
+	// redact replaces the credentials, in case the server echoes them.
+	redact  *strings.Replacer
+	secrets []string
+
+	mu        sync.Mutex
+	lines     []string
+	size      int
+	truncated bool
+	// hidden drops the lines exchanged with the server during LOGIN.
+	hidden bool
+}
+
+// newProtocolLog returns the protocol log of e, nil without DebugProtocol
+// and ProtocolLog.
+func (e *Executor) newProtocolLog(ctx context.Context) *protocolLog {
+	if !e.DebugProtocol && !e.ProtocolLog {
+		return nil
+	}
+	var secrets []string
+	if e.IMAPPassword != "" {
+		secrets = append(secrets, e.IMAPPassword, "<redacted>")
+	}
+	if e.IMAPAccessToken != "" {
+		secrets = append(secrets, e.IMAPAccessToken, "<redacted>")
+	}
+	return &protocolLog{
+		ctx:     ctx,
+		debug:   e.DebugProtocol,
+		collect: e.ProtocolLog,
+		redact:  strings.NewReplacer(secrets...),
+		secrets: secrets,
+	}
+}
+
+// redactSecret also replaces secret by <redacted>, for the passwords only
+// known once connecting.
+func (l *protocolLog) redactSecret(secret string) {
+	if l == nil || secret == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.secrets = append(l.secrets, secret, "<redacted>")
+	l.redact = strings.NewReplacer(l.secrets...)
+}
+
+// logger returns the logger and the log mask of the connections logged to l,
+// the defaults of the imap package without l.
+func (l *protocolLog) logger() (*log.Logger, imap.LogMask) {
+	if l == nil {
+		return imap.DefaultLogger, imapLogMask
+	}
+	return log.New(l, "", 0), protocolLogMask
+}
+
+// login drops the lines exchanged with the server during LOGIN, until done.
+func (l *protocolLog) login(done bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hidden = !done
+}
+
+// isRawLine reports whether the debug message p is a line exchanged with the
+// server, logged with imap.LogRaw as "C: ..." or "S: ...".
+func isRawLine(p []byte) bool {
+	return bytes.HasPrefix(p, []byte("C: ")) || bytes.HasPrefix(p, []byte("S: "))
+}
+
+// Write receives a debug message of a connection.
+func (l *protocolLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hidden && isRawLine(p) {
+		return len(p), nil
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\r\n"), "\n") {
+		line = l.redact.Replace(strings.TrimRight(line, "\r"))
+		if l.debug {
+			venom.Debug(l.ctx, "imap: %s", line)
+		}
+		if !l.collect || l.truncated {
+			continue
+		}
+		if l.size+len(line) > maxProtocolLogSize {
+			l.lines = append(l.lines, "... truncated")
+			l.truncated = true
+			continue
+		}
+		l.lines = append(l.lines, line)
+		l.size += len(line)
+	}
+	return len(p), nil
+}
+
+// collected returns the lines kept for result.protocollog.
+func (l *protocolLog) collected() []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
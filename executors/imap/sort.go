@@ -0,0 +1,212 @@
+package imap
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yesnault/go-imap/imap"
+)
+
+// sortKeys are the sort criteria of the SORT extension (RFC 5256).
+var sortKeys = map[string]bool{
+	"ARRIVAL": true,
+	"CC":      true,
+	"DATE":    true,
+	"FROM":    true,
+	"SIZE":    true,
+	"SUBJECT": true,
+	"TO":      true,
+}
+
+// sortCriteria returns the sort criteria of SortBy, as "REVERSE DATE SUBJECT".
+func (e *Executor) sortCriteria() ([]string, error) {
+	criteria := strings.Fields(strings.ToUpper(e.SortBy))
+	for i, c := range criteria {
+		if c == "REVERSE" {
+			if i+1 == len(criteria) || !sortKeys[criteria[i+1]] {
+				return nil, fmt.Errorf("sortby: REVERSE must be followed by a sort key")
+			}
+			continue
+		}
+		if !sortKeys[c] {
+			return nil, fmt.Errorf("unsupported sortby key %q", c)
+		}
+	}
+	return criteria, nil
+}
+
+// serverSort returns the UIDs greater than sinceUID of the messages matching
+// the search keys, in the order of the criteria. The server must advertise
+// the SORT capability.
+func (e *Executor) serverSort(c *imap.Client, criteria []string, search []imap.Field, sinceUID uint32) ([]uint32, error) {
+	if _, ok := c.CommandConfig["UID SORT"]; !ok {
+		c.CommandConfig["UID SORT"] = &imap.CommandConfig{States: imap.Selected, Filter: imap.NameFilter}
+	}
+
+	keys := append([]imap.Field{}, search...)
+	if sinceUID > 0 {
+		seqset, _ := imap.NewSeqSet(fmt.Sprintf("%d:*", sinceUID+1))
+		keys = append(keys, "UID", seqset)
+	}
+	if len(keys) == 0 {
+		keys = append(keys, "ALL")
+	}
+	fields := make([]imap.Field, 0, len(criteria))
+	for _, c := range criteria {
+		fields = append(fields, c)
+	}
+
+	cmd, err := check(c.Send("UID SORT", append([]imap.Field{fields, "UTF-8"}, keys...)...))
+	if err != nil {
+		return nil, err
+	}
+	uids := []uint32{}
+	for _, rsp := range cmd.Data {
+		for _, f := range rsp.Fields[1:] {
+			// "n:*" always matches the last message, even if its UID is lower than n.
+			if uid := imap.AsNumber(f); uid > sinceUID {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	// Without criteria checked on the mails, only the first ones are needed.
+	if e.Limit > 0 && len(uids) > e.Limit && !e.searchedLocally() {
+		uids = uids[:e.Limit]
+	}
+	return uids, nil
+}
+
+// sortMessages orders the messages by the criteria: in the order of sorted,
+// the UIDs returned by the server, or else by comparing their attributes.
+func sortMessages(messages []imap.Response, criteria []string, sorted []uint32) []imap.Response {
+	if len(criteria) == 0 {
+		return messages
+	}
+	if sorted != nil {
+		rank := make(map[uint32]int, len(sorted))
+		for i, uid := range sorted {
+			rank[uid] = i
+		}
+		sort.SliceStable(messages, func(i, j int) bool {
+			return rank[messages[i].MessageInfo().UID] < rank[messages[j].MessageInfo().UID]
+		})
+		return messages
+	}
+
+	// The messages are fetched by UID, which orders the equal ones as
+	// required by RFC 5256.
+	sort.SliceStable(messages, func(i, j int) bool {
+		return compareMessages(messages[i].MessageInfo(), messages[j].MessageInfo(), criteria) < 0
+	})
+	return messages
+}
+
+// compareMessages compares a and b by the criteria, as a server without the
+// SORT capability would do.
+func compareMessages(a, b *imap.MessageInfo, criteria []string) int {
+	reverse := false
+	for _, c := range criteria {
+		if c == "REVERSE" {
+			reverse = true
+			continue
+		}
+		n := compareMessagesBy(a, b, c)
+		if reverse {
+			n = -n
+		}
+		if n != 0 {
+			return n
+		}
+		reverse = false
+	}
+	return 0
+}
+
+func compareMessagesBy(a, b *imap.MessageInfo, key string) int {
+	switch key {
+	case "ARRIVAL":
+		return compareTimes(a.InternalDate, b.InternalDate)
+	case "DATE":
+		return compareTimes(sentDate(a), sentDate(b))
+	case "SIZE":
+		switch {
+		case a.Size < b.Size:
+			return -1
+		case a.Size > b.Size:
+			return 1
+		}
+		return 0
+	case "SUBJECT":
+		return strings.Compare(baseSubject(a), baseSubject(b))
+	case "FROM":
+		return strings.Compare(firstMailbox(a, 2), firstMailbox(b, 2))
+	case "TO":
+		return strings.Compare(firstMailbox(a, 5), firstMailbox(b, 5))
+	case "CC":
+		return strings.Compare(firstMailbox(a, 6), firstMailbox(b, 6))
+	}
+	return 0
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// sentDate returns the Date header of the envelope, or else the internal date
+// of the message.
+func sentDate(m *imap.MessageInfo) time.Time {
+	env := imap.AsList(m.Attrs["ENVELOPE"])
+	if len(env) > 0 {
+		if d, err := mail.ParseDate(imap.AsString(env[0])); err == nil {
+			return d
+		}
+	}
+	return m.InternalDate
+}
+
+// baseSubject returns the subject of the envelope without its reply and
+// forward prefixes, in lower case.
+func baseSubject(m *imap.MessageInfo) string {
+	env := imap.AsList(m.Attrs["ENVELOPE"])
+	if len(env) < 2 {
+		return ""
+	}
+	s := strings.ToLower(strings.TrimSpace(decodeWords(imap.AsString(env[1]))))
+	for {
+		trimmed := s
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+		if trimmed == s {
+			return s
+		}
+		s = trimmed
+	}
+}
+
+// firstMailbox returns the mailbox, the local part, of the first address of
+// the envelope field i, in lower case.
+func firstMailbox(m *imap.MessageInfo, i int) string {
+	env := imap.AsList(m.Attrs["ENVELOPE"])
+	if len(env) <= i {
+		return ""
+	}
+	addrs := imap.AsList(env[i])
+	if len(addrs) == 0 {
+		return ""
+	}
+	addr := imap.AsList(addrs[0])
+	if len(addr) < 3 {
+		return ""
+	}
+	return strings.ToLower(imap.AsString(addr[2]))
+}
@@ -0,0 +1,32 @@
+package imap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/yesnault/go-imap/imap"
+)
+
+func TestCompareMessages(t *testing.T) {
+	message := func(subject, from string) *imap.MessageInfo {
+		env := []imap.Field{"Mon, 2 Jan 2006 10:00:00 +0000", subject, []imap.Field{[]imap.Field{nil, nil, from, "example.org"}}}
+		return &imap.MessageInfo{Attrs: imap.FieldMap{"ENVELOPE": env}}
+	}
+	tests := []struct {
+		name     string
+		a, b     *imap.MessageInfo
+		criteria []string
+		want     int
+	}{
+		{name: "subject", a: message("Beta", "a"), b: message("Alpha", "b"), criteria: []string{"SUBJECT"}, want: 1},
+		{name: "reply prefixes", a: message("RE: Fwd: alpha", "a"), b: message("Beta", "b"), criteria: []string{"SUBJECT"}, want: -1},
+		{name: "reverse", a: message("Alpha", "a"), b: message("Beta", "b"), criteria: []string{"REVERSE", "SUBJECT"}, want: 1},
+		{name: "second key", a: message("Alpha", "b"), b: message("Re: alpha", "A"), criteria: []string{"SUBJECT", "FROM"}, want: 1},
+		{name: "equal", a: message("Alpha", "a"), b: message("Alpha", "a"), criteria: []string{"DATE", "SUBJECT"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, compareMessages(tt.a, tt.b, tt.criteria))
+		})
+	}
+}
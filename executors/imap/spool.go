@@ -0,0 +1,104 @@
+package imap
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/yesnault/go-imap/imap"
+)
+
+// spooledItems are the data items holding a body, written to disk by a
+// spool.
+var spooledItems = []string{"RFC822", "BODY[]", "RFC822.TEXT", "BODY[TEXT]"}
+
+// isSpooled returns true if the attribute item, possibly partial as
+// "BODY[TEXT]<0>", holds a body.
+func isSpooled(item string) bool {
+	if i := strings.Index(item, "<"); i >= 0 {
+		item = item[:i]
+	}
+	for _, i := range spooledItems {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// spooledItem replaces a body in the attributes of a spooled message, it is
+// the path of the file holding the body.
+type spooledItem string
+
+// spool keeps the bodies of the fetched messages in temporary files, with
+// streamtodisk. Each body is written to disk as soon as its message is
+// received, so that only the message being received and the one being
+// searched are in memory, whatever the number and size of the messages.
+type spool struct {
+	dir string
+}
+
+// newSpool creates the directory of the temporary files, removed by close.
+func newSpool() (*spool, error) {
+	dir, err := os.MkdirTemp("", "venom-imap-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create the streamtodisk directory")
+	}
+	return &spool{dir: dir}, nil
+}
+
+// store writes the bodies of the fetched message rsp to disk and drops them
+// from rsp.
+func (s *spool) store(rsp *imap.Response) error {
+	info := rsp.MessageInfo()
+	if info == nil {
+		return nil
+	}
+	for item, v := range info.Attrs {
+		if !isSpooled(item) {
+			continue
+		}
+		f, err := os.CreateTemp(s.dir, "message-")
+		if err != nil {
+			return errors.Wrapf(err, "unable to spool message %d", info.UID)
+		}
+		_, errw := f.Write(imap.AsBytes(v))
+		if errc := f.Close(); errw == nil {
+			errw = errc
+		}
+		if errw != nil {
+			return errors.Wrapf(errw, "unable to spool message %d", info.UID)
+		}
+		info.Attrs[item] = spooledItem(f.Name())
+	}
+	// The attributes are decoded in info, the raw response still references
+	// the bodies.
+	rsp.Fields = nil
+	rsp.Raw = nil
+	return nil
+}
+
+// load returns a copy of the spooled message rsp with its bodies read from
+// disk. rsp itself is left unchanged, so that the bodies are released with
+// the copy.
+func (s *spool) load(rsp imap.Response) (imap.Response, error) {
+	info := *rsp.MessageInfo()
+	info.Attrs = make(imap.FieldMap, len(rsp.MessageInfo().Attrs))
+	for k, v := range rsp.MessageInfo().Attrs {
+		if path, ok := v.(spooledItem); ok {
+			b, err := os.ReadFile(string(path))
+			if err != nil {
+				return rsp, errors.Wrapf(err, "unable to read spooled message %d", info.UID)
+			}
+			v = b
+		}
+		info.Attrs[k] = v
+	}
+	rsp.Decoded = &info
+	return rsp, nil
+}
+
+// close removes the temporary files.
+func (s *spool) close() error {
+	return os.RemoveAll(s.dir)
+}
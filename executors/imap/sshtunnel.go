@@ -0,0 +1,172 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yesnault/go-imap/imap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTimeout bounds the connection to the SSH jump host, without
+// imapdialtimeout.
+const sshTimeout = 30 * time.Second
+
+// SSHTunnel is the SSH jump host through which the IMAP server is dialed. The
+// imaphost and imapport are resolved from the jump host.
+type SSHTunnel struct {
+	// Host is the host:port of the jump host, port 22 by default.
+	Host     string `json:"host,omitempty" yaml:"host,omitempty"`
+	User     string `json:"user,omitempty" yaml:"user,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	// KeyFile is a PEM private key, unencrypted.
+	KeyFile string `json:"keyfile,omitempty" yaml:"keyfile,omitempty"`
+	// KnownHostsFile holds the host key of the jump host,
+	// ~/.ssh/known_hosts by default.
+	KnownHostsFile string `json:"knownhostsfile,omitempty" yaml:"knownhostsfile,omitempty"`
+}
+
+// tunnelConn is a connection forwarded by the jump host. Closing it also
+// closes the SSH connection.
+type tunnelConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close() // nolint
+	return err
+}
+
+// dialTunnel opens the connection to the server through SSHTunnel, secured
+// with tlsConfig in tlsModeDirect, waiting for its greeting within timeout.
+// The connection to the jump host is also bounded by timeout when
+// imapdialtimeout is set, and by ctx.
+func (e *Executor) dialTunnel(ctx context.Context, tlsMode string, tlsConfig *tls.Config, timeout time.Duration) (*imap.Client, error) {
+	config, err := e.SSHTunnel.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	jumpHost := e.SSHTunnel.Host
+	if _, _, err := net.SplitHostPort(jumpHost); err != nil {
+		jumpHost = net.JoinHostPort(jumpHost, "22")
+	}
+	jumpTimeout := sshTimeout
+	if e.IMAPDialTimeout != "" {
+		jumpTimeout = timeout
+	}
+	client, err := dialSSH(ctx, jumpHost, config, jumpTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to connect to the sshtunnel %s", jumpHost)
+	}
+
+	addr := e.address()
+	conn, err := dialJump(ctx, client, addr, jumpTimeout)
+	if err != nil {
+		client.Close() // nolint
+		return nil, errors.Wrapf(err, "unable to connect to %s through the sshtunnel %s", addr, jumpHost)
+	}
+	if tlsMode != tlsModeDirect {
+		tlsConfig = nil
+	}
+	return newClient(tunnelConn{Conn: conn, client: client}, addr, tlsConfig, timeout, e.protocolLog)
+}
+
+// dialJump opens the connection to addr through the jump host client, within
+// timeout and ctx. The SSH client has no deadline, it is closed when either
+// expires to abort the dial.
+func dialJump(ctx context.Context, client *ssh.Client, addr string, timeout time.Duration) (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := client.Dial("tcp", addr)
+		done <- dialed{conn, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d := <-done:
+		return d.conn, d.err
+	case <-timer.C:
+		client.Close() // nolint
+		return nil, fmt.Errorf("no answer within %s", timeout)
+	case <-ctx.Done():
+		client.Close() // nolint
+		return nil, ctx.Err()
+	}
+}
+
+// dialSSH connects to the jump host addr and logs in with config, the TCP
+// connection and the SSH handshake within timeout.
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline) // nolint
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close() // nolint
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{}) // nolint
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// clientConfig returns the SSH configuration to log in to the jump host,
+// with its key or password, checking its host key.
+func (t *SSHTunnel) clientConfig() (*ssh.ClientConfig, error) {
+	if t.Host == "" || t.User == "" {
+		return nil, fmt.Errorf("sshtunnel requires a host and a user")
+	}
+	var auth []ssh.AuthMethod
+	if t.KeyFile != "" {
+		pem, err := os.ReadFile(t.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read the sshtunnel keyfile")
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid sshtunnel keyfile %s", t.KeyFile)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if t.Password != "" {
+		auth = append(auth, ssh.Password(t.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sshtunnel requires a keyfile or a password")
+	}
+
+	knownHosts := t.KnownHostsFile
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to find the sshtunnel knownhostsfile")
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the sshtunnel knownhostsfile")
+	}
+	return &ssh.ClientConfig{
+		User:            t.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
@@ -0,0 +1,200 @@
+package imap
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/ovh/venom"
+)
+
+// testSSHServer is a jump host forwarding the direct-tcpip channels, counting
+// them in Forwarded. With Stall set to 1, the channels are never answered.
+type testSSHServer struct {
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	Forwarded int32
+	Stall     int32
+}
+
+// newTestSSHServer starts a jump host accepting user with password, and
+// returns the known_hosts file of its host key.
+func newTestSSHServer(t *testing.T, user, password string) (*testSSHServer, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() }) // nolint
+
+	s := &testSSHServer{listener: listener, config: &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if c.User() == user && string(p) == password {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}}
+	s.config.AddHostKey(signer)
+	go s.serve()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{listener.Addr().String()}, signer.PublicKey())
+	require.NoError(t, os.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+	return s, knownHosts
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for ch := range chans {
+				s.forward(ch)
+			}
+		}()
+	}
+}
+
+// forward connects a direct-tcpip channel to its destination.
+func (s *testSSHServer) forward(ch ssh.NewChannel) {
+	var dest struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if ch.ChannelType() != "direct-tcpip" || ssh.Unmarshal(ch.ExtraData(), &dest) != nil {
+		ch.Reject(ssh.UnknownChannelType, "unsupported channel") // nolint
+		return
+	}
+	if atomic.LoadInt32(&s.Stall) == 1 {
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+	if err != nil {
+		ch.Reject(ssh.ConnectionFailed, err.Error()) // nolint
+		return
+	}
+	channel, reqs, err := ch.Accept()
+	if err != nil {
+		conn.Close() // nolint
+		return
+	}
+	atomic.AddInt32(&s.Forwarded, 1)
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(channel, conn) // nolint
+		channel.CloseWrite()   // nolint
+	}()
+	go func() {
+		io.Copy(conn, channel) // nolint
+		conn.Close()           // nolint
+	}()
+}
+
+func TestExecutor_Run_SSHTunnel(t *testing.T) {
+	s := newTestServerWithMails(t)
+	jump, knownHosts := newTestSSHServer(t, "jump", "s3cret")
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caCert, s.CACert, 0600))
+	// The known host key of another server at the same address.
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherKey, err := ssh.NewPublicKey(other)
+	require.NoError(t, err)
+	otherKnownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(otherKnownHosts, []byte(knownhosts.Line([]string{jump.listener.Addr().String()}, otherKey)+"\n"), 0600))
+
+	tests := []struct {
+		name    string
+		tunnel  map[string]interface{}
+		wantErr string
+	}{
+		{name: "tunnel", tunnel: map[string]interface{}{"host": jump.listener.Addr().String(), "user": "jump", "password": "s3cret", "knownhostsfile": knownHosts}},
+		{name: "wrong password", tunnel: map[string]interface{}{"host": jump.listener.Addr().String(), "user": "jump", "password": "wrong", "knownhostsfile": knownHosts}, wantErr: "unable to connect to the sshtunnel"},
+		{name: "unknown host key", tunnel: map[string]interface{}{"host": jump.listener.Addr().String(), "user": "jump", "password": "s3cret", "knownhostsfile": otherKnownHosts}, wantErr: "knownhosts: key mismatch"},
+		{name: "missing knownhostsfile", tunnel: map[string]interface{}{"host": jump.listener.Addr().String(), "user": "jump", "password": "s3cret", "knownhostsfile": filepath.Join(t.TempDir(), "missing")}, wantErr: "unable to read the sshtunnel knownhostsfile"},
+		{name: "no credentials", tunnel: map[string]interface{}{"host": jump.listener.Addr().String(), "user": "jump"}, wantErr: "sshtunnel requires a keyfile or a password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := s.Step(venom.TestStep{
+				"tlscacert":     caCert,
+				"searchsubject": "Order",
+				"sshtunnel":     tt.tunnel,
+			})
+			r, err := s.Executor().Run(context.Background(), step)
+			require.NoError(t, err)
+			result := r.(Result)
+			if tt.wantErr != "" {
+				require.Contains(t, result.Err, tt.wantErr)
+				return
+			}
+			require.Empty(t, result.Err)
+			require.Equal(t, "Order 42 confirmed", result.Subject)
+			require.NotZero(t, atomic.LoadInt32(&jump.Forwarded))
+		})
+	}
+}
+
+func TestExecutor_Run_SSHTunnel_IMAPDialTimeout(t *testing.T) {
+	s := newTestServerWithMails(t)
+	jump, knownHosts := newTestSSHServer(t, "jump", "s3cret")
+	// The jump host accepts the connections, but never answers.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close() // nolint
+
+	step := s.Step(venom.TestStep{
+		"searchsubject":   "Order",
+		"imapdialtimeout": "200ms",
+		"sshtunnel":       map[string]interface{}{"host": silent.Addr().String(), "user": "jump", "password": "s3cret", "knownhostsfile": knownHosts},
+	})
+	start := time.Now()
+	r, err := s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to connect to the sshtunnel "+silent.Addr().String())
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// The step context bounds it too.
+	delete(step, "imapdialtimeout")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	r, err = s.Executor().Run(ctx, step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "unable to connect to the sshtunnel")
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// The jump host logs in, but never opens the connection to the server.
+	atomic.StoreInt32(&jump.Stall, 1)
+	step["sshtunnel"] = map[string]interface{}{"host": jump.listener.Addr().String(), "user": "jump", "password": "s3cret", "knownhostsfile": knownHosts}
+	step["imapdialtimeout"] = "200ms"
+	start = time.Now()
+	r, err = s.Executor().Run(context.Background(), step)
+	require.NoError(t, err)
+	require.Contains(t, r.(Result).Err, "through the sshtunnel "+jump.listener.Addr().String()+": no answer within 200ms")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,136 @@
+package imap
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"regexp"
+	"sort"
+
+	"github.com/yesnault/go-imap/imap"
+
+	"github.com/ovh/venom"
+)
+
+// maxThreadSize is the maximum number of mails of result.thread.
+const maxThreadSize = 50
+
+// messageIDRegexp matches a message identifier of the Message-Id,
+// In-Reply-To and References headers.
+var messageIDRegexp = regexp.MustCompile(`<[^<>\s]+>`)
+
+// threadMessage is a fetched message with the identifiers linking it to its
+// conversation.
+type threadMessage struct {
+	rsp imap.Response
+	id  string
+	// refs are the identifiers of In-Reply-To and References.
+	refs []string
+}
+
+// thread returns the other mails of messages in the conversation of m, the
+// ones linked to it through their Message-Id, In-Reply-To and References
+// headers, directly or through other mails, by UID. At most maxThreadSize
+// mails are returned.
+func (e *Executor) thread(ctx context.Context, messages []imap.Response, m *Mail) ([]*Mail, error) {
+	var others []threadMessage
+	ids := map[string]bool{}
+	for _, msg := range messages {
+		if e.spool != nil {
+			var err error
+			if msg, err = e.spool.load(msg); err != nil {
+				return nil, err
+			}
+		}
+		tm, ok := parseThreadMessage(msg)
+		if !ok {
+			continue
+		}
+		if msg.MessageInfo().UID == m.UID {
+			tm.addIDs(ids)
+			continue
+		}
+		others = append(others, tm)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// The conversation grows with each linked mail, until no other one is.
+	var linked []threadMessage
+	for grown := true; grown; {
+		grown = false
+		remaining := others[:0]
+		for _, tm := range others {
+			if !(tm.id != "" && ids[tm.id]) && !anyOf(ids, tm.refs) {
+				remaining = append(remaining, tm)
+				continue
+			}
+			linked = append(linked, tm)
+			tm.addIDs(ids)
+			grown = true
+		}
+		others = remaining
+	}
+
+	sort.Slice(linked, func(i, j int) bool {
+		return linked[i].rsp.MessageInfo().UID < linked[j].rsp.MessageInfo().UID
+	})
+	if len(linked) > maxThreadSize {
+		venom.Warn(ctx, "The conversation of message %d has %d other mails, only the first %d are returned", m.UID, len(linked), maxThreadSize)
+		linked = linked[:maxThreadSize]
+	}
+	mails := make([]*Mail, 0, len(linked))
+	for _, tm := range linked {
+		tmail, err := e.extract(ctx, tm.rsp)
+		if err != nil {
+			venom.Warn(ctx, "Cannot extract the content of the mail: %s", err)
+			continue
+		}
+		mails = append(mails, tmail)
+	}
+	venom.Debug(ctx, "%d mails in the conversation of message %d", len(mails), m.UID)
+	return mails, nil
+}
+
+// parseThreadMessage returns the identifiers of the headers of msg. It returns
+// false if the headers were not fetched.
+func parseThreadMessage(msg imap.Response) (threadMessage, bool) {
+	header, _ := messageData(msg.MessageInfo().Attrs)
+	mmsg, err := mail.ReadMessage(bytes.NewReader(header))
+	if err != nil {
+		return threadMessage{}, false
+	}
+	tm := threadMessage{rsp: msg}
+	// A mail without Message-Id can still reply to the conversation.
+	if id := messageIDRegexp.FindString(mmsg.Header.Get("Message-Id")); id != "" {
+		tm.id = id
+	}
+	for _, name := range []string{"In-Reply-To", "References"} {
+		tm.refs = append(tm.refs, messageIDRegexp.FindAllString(mmsg.Header.Get(name), -1)...)
+	}
+	return tm, true
+}
+
+// addIDs adds the identifiers of tm to ids. A missing Message-Id does not link
+// the mails without one.
+func (tm threadMessage) addIDs(ids map[string]bool) {
+	if tm.id != "" {
+		ids[tm.id] = true
+	}
+	for _, ref := range tm.refs {
+		if ref != "" {
+			ids[ref] = true
+		}
+	}
+}
+
+// anyOf returns true if one of keys is in set.
+func anyOf(set map[string]bool, keys []string) bool {
+	for _, k := range keys {
+		if set[k] {
+			return true
+		}
+	}
+	return false
+}
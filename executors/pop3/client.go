@@ -0,0 +1,130 @@
+package pop3
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client is a minimal POP3 client (RFC 1939).
+type client struct {
+	conn net.Conn
+	text *textproto.Conn
+	// ctx and timeout bound each command, see setDeadline.
+	ctx     context.Context
+	timeout time.Duration
+}
+
+// dial connects to addr and reads the server greeting, within timeout and
+// ctx.
+func dial(ctx context.Context, addr string, tlsConfig *tls.Config, timeout time.Duration) (*client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{conn: conn, text: textproto.NewConn(conn), ctx: ctx, timeout: timeout}
+	if err := c.setDeadline(); err != nil {
+		c.close() // nolint
+		return nil, err
+	}
+	if _, err := c.readResponse(); err != nil {
+		c.close() // nolint
+		return nil, fmt.Errorf("invalid server greeting: %s", err)
+	}
+	return c, nil
+}
+
+// setDeadline bounds the next command by timeout, and by the deadline of
+// ctx if sooner.
+func (c *client) setDeadline() error {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := c.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return c.conn.SetDeadline(deadline)
+}
+
+// cmd sends a command and returns the text of its +OK response, the response
+// and its data within the deadline set by setDeadline.
+func (c *client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.setDeadline(); err != nil {
+		return "", err
+	}
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.readResponse()
+}
+
+func (c *client) readResponse() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		return "", fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	return "", fmt.Errorf("unexpected response %q", line)
+}
+
+func (c *client) login(user, password string) error {
+	if _, err := c.cmd("USER %s", user); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS %s", password)
+	return err
+}
+
+// stat returns the number of messages of the maildrop.
+func (c *client) stat() (int, error) {
+	rsp, err := c.cmd("STAT")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(rsp)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid STAT response %q", rsp)
+	}
+	return strconv.Atoi(fields[0])
+}
+
+// retr returns the content of message n, with LF line endings.
+func (c *client) retr(n int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", n); err != nil {
+		return nil, err
+	}
+	return c.text.ReadDotBytes()
+}
+
+// dele marks message n as deleted, it is removed by quit.
+func (c *client) dele(n int) error {
+	_, err := c.cmd("DELE %d", n)
+	return err
+}
+
+// quit ends the session, the server removes the deleted messages.
+func (c *client) quit() error {
+	_, err := c.cmd("QUIT")
+	c.close() // nolint
+	return err
+}
+
+func (c *client) close() error {
+	return c.text.Close()
+}
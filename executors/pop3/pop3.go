@@ -0,0 +1,263 @@
+package pop3
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+
+	"github.com/ovh/venom"
+)
+
+// Name for test pop3
+const Name = "pop3"
+
+// dialTimeout bounds the connection to the server, and each command.
+const dialTimeout = 30 * time.Second
+
+// New returns a new Test Exec
+func New() venom.Executor {
+	return &Executor{}
+}
+
+// Executor represents a Test Exec
+type Executor struct {
+	WithTLS         *bool  `json:"withtls,omitempty" yaml:"withtls,omitempty"`
+	POP3Host        string `json:"pop3host,omitempty" yaml:"pop3host,omitempty"`
+	POP3Port        string `json:"pop3port,omitempty" yaml:"pop3port,omitempty"`
+	POP3User        string `json:"pop3user,omitempty" yaml:"pop3user,omitempty"`
+	POP3Password    string `json:"pop3password,omitempty" yaml:"pop3password,omitempty"`
+	DeleteOnSuccess bool   `json:"deleteonsuccess,omitempty" yaml:"deleteonsuccess,omitempty"`
+	SearchFrom      string `json:"searchfrom,omitempty" yaml:"searchfrom,omitempty"`
+	SearchTo        string `json:"searchto,omitempty" yaml:"searchto,omitempty"`
+	SearchSubject   string `json:"searchsubject,omitempty" yaml:"searchsubject,omitempty"`
+	SearchBody      string `json:"searchbody,omitempty" yaml:"searchbody,omitempty"`
+}
+
+// Mail contains an analyzed mail
+type Mail struct {
+	From      string
+	To        string
+	Subject   string
+	MessageID string
+	Body      string
+}
+
+// Result represents a step result, it has the same shape as the result of
+// the imap executor.
+type Result struct {
+	Err         string  `json:"err" yaml:"error"`
+	MessageID   string  `json:"messageid,omitempty" yaml:"messageId,omitempty"`
+	From        string  `json:"from,omitempty" yaml:"from,omitempty"`
+	To          string  `json:"to,omitempty" yaml:"to,omitempty"`
+	Subject     string  `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Body        string  `json:"body,omitempty" yaml:"body,omitempty"`
+	TimeSeconds float64 `json:"timeseconds,omitempty" yaml:"timeSeconds,omitempty"`
+}
+
+// ZeroValueResult return an empty implementation of this executor result
+func (Executor) ZeroValueResult() interface{} {
+	return Result{}
+}
+
+// GetDefaultAssertions return default assertions for type exec
+func (Executor) GetDefaultAssertions() *venom.StepAssertions {
+	return &venom.StepAssertions{Assertions: []venom.Assertion{"result.err ShouldNotExist"}}
+}
+
+// Run execute TestStep of type exec
+func (Executor) Run(ctx context.Context, step venom.TestStep) (interface{}, error) {
+	var e Executor
+	if err := mapstructure.Decode(step, &e); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	result := Result{}
+	find, errs := e.getMail(ctx)
+	if errs != nil {
+		result.Err = errs.Error()
+	}
+	if find != nil {
+		result.MessageID = find.MessageID
+		result.From = find.From
+		result.To = find.To
+		result.Subject = find.Subject
+		result.Body = find.Body
+	} else if result.Err == "" {
+		result.Err = "searched mail not found"
+	}
+
+	elapsed := time.Since(start)
+	result.TimeSeconds = elapsed.Seconds()
+
+	return result, nil
+}
+
+// getMail retrieves the messages one by one, POP3 has no search command, and
+// returns the first one matching the search criteria.
+func (e *Executor) getMail(ctx context.Context) (*Mail, error) {
+	if e.SearchFrom == "" && e.SearchSubject == "" && e.SearchBody == "" && e.SearchTo == "" {
+		return nil, fmt.Errorf("you have to use one of searchfrom, searchto, searchsubject or searchbody parameters")
+	}
+
+	c, errc := e.connect(ctx)
+	if errc != nil {
+		return nil, errors.Wrapf(errc, "error while connecting")
+	}
+	defer c.quit() // nolint
+
+	count, err := c.stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while stat")
+	}
+	venom.Debug(ctx, "count messages:%d", count)
+	if count == 0 {
+		return nil, errors.New("No message to fetch")
+	}
+
+	for n := 1; n <= count; n++ {
+		raw, err := c.retr(n)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error while retrieving message %d", n)
+		}
+		m, erre := extract(ctx, raw)
+		if erre != nil {
+			venom.Warn(ctx, "Cannot extract the content of the mail: %s", erre)
+			continue
+		}
+
+		found, errs := e.isSearched(m)
+		if errs != nil {
+			return nil, errs
+		}
+		if found {
+			if e.DeleteOnSuccess {
+				venom.Debug(ctx, "Delete message %d", n)
+				if err := c.dele(n); err != nil {
+					return nil, fmt.Errorf("Error while deleting msg, err: %s", err)
+				}
+			}
+			return m, nil
+		}
+	}
+
+	return nil, errors.New("Mail not found")
+}
+
+func (e *Executor) connect(ctx context.Context) (*client, error) {
+	host, port := e.POP3Host, e.POP3Port
+	if port == "" {
+		port = "110"
+		if e.withTLS() {
+			port = "995"
+		}
+	}
+	addr := net.JoinHostPort(host, strings.TrimPrefix(port, ":"))
+	venom.Debug(ctx, "connecting to %s", addr)
+
+	var tlsConfig *tls.Config
+	if e.withTLS() {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+	c, err := dial(ctx, addr, tlsConfig, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial: %s", err)
+	}
+	if err := c.login(e.POP3User, e.POP3Password); err != nil {
+		c.close() // nolint
+		return nil, fmt.Errorf("unable to login: %s", err)
+	}
+	return c, nil
+}
+
+// withTLS returns WithTLS, true by default: the credentials are only sent in
+// plain text when asked.
+func (e *Executor) withTLS() bool {
+	return e.WithTLS == nil || *e.WithTLS
+}
+
+func (e *Executor) isSearched(m *Mail) (bool, error) {
+	criteria := []struct{ pattern, value string }{
+		{e.SearchFrom, m.From},
+		{e.SearchTo, m.To},
+		{e.SearchSubject, m.Subject},
+		{e.SearchBody, m.Body},
+	}
+	for _, c := range criteria {
+		if c.pattern == "" {
+			continue
+		}
+		ok, err := regexp.MatchString(c.pattern, c.value)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func extract(ctx context.Context, raw []byte) (*Mail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mail{MessageID: strings.TrimSpace(msg.Header.Get("Message-Id"))}
+	dec := new(mime.WordDecoder)
+	for _, h := range []struct {
+		name  string
+		value *string
+	}{{"Subject", &m.Subject}, {"From", &m.From}, {"To", &m.To}} {
+		*h.value, err = dec.DecodeHeader(msg.Header.Get(h.name))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode %s header: %s", h.name, err)
+		}
+	}
+
+	encoding := msg.Header.Get("Content-Transfer-Encoding")
+	r := transferDecoder(msg.Body, encoding)
+	venom.Debug(ctx, "Mail Content-Transfer-Encoding is %s ", encoding)
+
+	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(contentType, "multipart/") && params["boundary"] != "" {
+		// The body of the mail is its first part, with its own encoding.
+		p, errp := multipart.NewReader(r, params["boundary"]).NextPart()
+		if errp != nil {
+			return nil, fmt.Errorf("Error while reading first part: %s", errp)
+		}
+		r = transferDecoder(p, p.Header.Get("Content-Transfer-Encoding"))
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m.Body = string(body)
+	return m, nil
+}
+
+// transferDecoder decodes r according to its Content-Transfer-Encoding.
+func transferDecoder(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	}
+	// 7bit, 8bit and binary are not encoded.
+	return r
+}
@@ -0,0 +1,252 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ovh/venom"
+)
+
+const (
+	testMailOrder = "From: Shop <shop@example.org>\r\nTo: customer@example.com\r\nSubject: Order 42 confirmed\r\nMessage-Id: <42@example.org>\r\n\r\nYour order 42 is confirmed.\r\n.signature\r\n"
+	testMailNews  = "From: news@example.net\r\nTo: customer@example.com\r\nSubject: =?utf-8?q?Caf=C3=A9_news?=\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nRead the news of the caf=C3=A9.\r\n"
+	// testMailInvoice has a base64 first part.
+	testMailInvoice = "From: billing@example.org\r\nTo: customer@example.com\r\nSubject: Invoice 7\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b1\r\n\r\n--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: base64\r\n\r\nWW91ciBpbnZvaWNlIDcgaXMgYXR0YWNoZWQuDQo=\r\n--b1--\r\n"
+)
+
+// testServer is a minimal in-memory POP3 server listening on the loopback
+// interface, without TLS.
+type testServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []string
+	// stall is a command never answered, as by a hung server.
+	stall string
+}
+
+func newTestServer(t *testing.T, messages ...string) *testServer {
+	venom.InitTestLogger(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testServer{listener: l, messages: messages}
+	t.Cleanup(func() { l.Close() }) // nolint
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Executor() Executor {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return Executor{WithTLS: new(bool), POP3Host: host, POP3Port: port, POP3User: "venom", POP3Password: "secret"}
+}
+
+func (s *testServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.messages...)
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *testServer) session(conn net.Conn) {
+	defer conn.Close() // nolint
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush() // nolint
+	}
+
+	reply("+OK venom test server ready")
+	var user string
+	deleted := map[int]bool{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			reply("-ERR empty command")
+			continue
+		}
+		var n int
+		if len(fields) > 1 {
+			fmt.Sscan(fields[1], &n) // nolint
+		}
+
+		s.mu.Lock()
+		if strings.EqualFold(fields[0], s.stall) {
+			s.mu.Unlock()
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "USER":
+			user = fields[1]
+			reply("+OK")
+		case "PASS":
+			if user != "venom" || fields[1] != "secret" {
+				reply("-ERR invalid credentials")
+			} else {
+				reply("+OK logged in")
+			}
+		case "STAT":
+			reply("+OK %d 0", len(s.messages))
+		case "RETR":
+			if n < 1 || n > len(s.messages) || deleted[n] {
+				reply("-ERR no such message")
+				break
+			}
+			reply("+OK")
+			for _, l := range strings.SplitAfter(s.messages[n-1], "\r\n") {
+				if strings.HasPrefix(l, ".") {
+					l = "." + l
+				}
+				fmt.Fprint(w, l)
+			}
+			reply(".")
+		case "DELE":
+			deleted[n] = true
+			reply("+OK deleted")
+		case "QUIT":
+			var kept []string
+			for i, m := range s.messages {
+				if !deleted[i+1] {
+					kept = append(kept, m)
+				}
+			}
+			s.messages = kept
+			s.mu.Unlock()
+			reply("+OK bye")
+			return
+		default:
+			reply("-ERR unknown command")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestExecutor_getMail(t *testing.T) {
+	tests := []struct {
+		name        string
+		criteria    Executor
+		wantSubject string
+		wantErr     string
+	}{
+		{name: "no criteria", wantErr: "you have to use one of"},
+		{name: "from", criteria: Executor{SearchFrom: `shop@example\.org`}, wantSubject: "Order 42 confirmed"},
+		{name: "to", criteria: Executor{SearchTo: "customer@"}, wantSubject: "Café news"},
+		{name: "subject", criteria: Executor{SearchSubject: "^Order"}, wantSubject: "Order 42 confirmed"},
+		{name: "body", criteria: Executor{SearchBody: "news of the café"}, wantSubject: "Café news"},
+		{name: "multipart body", criteria: Executor{SearchBody: "^Your invoice 7 is attached"}, wantSubject: "Invoice 7"},
+		{name: "not found", criteria: Executor{SearchSubject: "Refund"}, wantErr: "Mail not found"},
+		{name: "invalid regexp", criteria: Executor{SearchSubject: "(Order"}, wantErr: "error parsing regexp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, testMailNews, testMailOrder, testMailInvoice)
+			e := s.Executor()
+			e.SearchFrom, e.SearchTo, e.SearchSubject, e.SearchBody = tt.criteria.SearchFrom, tt.criteria.SearchTo, tt.criteria.SearchSubject, tt.criteria.SearchBody
+
+			m, err := e.getMail(context.Background())
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSubject, m.Subject)
+		})
+	}
+}
+
+func TestExecutor_getMail_BadCredentials(t *testing.T) {
+	s := newTestServer(t, testMailOrder)
+	e := s.Executor()
+	e.POP3Password = "wrong"
+	e.SearchSubject = "Order"
+
+	_, err := e.getMail(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to login: invalid credentials")
+}
+
+func TestExecutor_getMail_DeleteOnSuccess(t *testing.T) {
+	s := newTestServer(t, testMailNews, testMailOrder)
+	e := s.Executor()
+	e.SearchSubject = "Order"
+	e.DeleteOnSuccess = true
+
+	_, err := e.getMail(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{testMailNews}, s.Messages())
+}
+
+func TestExecutor_Run(t *testing.T) {
+	s := newTestServer(t, testMailNews, testMailOrder)
+	e := s.Executor()
+
+	step := venom.TestStep{
+		"withtls":       false,
+		"pop3host":      e.POP3Host,
+		"pop3port":      e.POP3Port,
+		"pop3user":      e.POP3User,
+		"pop3password":  e.POP3Password,
+		"searchsubject": "Order",
+	}
+	r, err := Executor{}.Run(context.Background(), step)
+	require.NoError(t, err)
+
+	result := r.(Result)
+	require.Empty(t, result.Err)
+	require.Equal(t, "Order 42 confirmed", result.Subject)
+	require.Equal(t, "<42@example.org>", result.MessageID)
+	require.Equal(t, "Your order 42 is confirmed.\n.signature\n", result.Body)
+}
+
+func TestExecutor_getMail_DefaultTLS(t *testing.T) {
+	s := newTestServer(t, testMailOrder)
+	e := s.Executor()
+	e.WithTLS = nil
+	e.SearchSubject = "Order"
+
+	// The test server does not speak TLS, no credentials are sent to it.
+	_, err := e.getMail(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to dial")
+}
+
+func TestExecutor_getMail_CommandDeadline(t *testing.T) {
+	s := newTestServer(t, testMailOrder)
+	s.mu.Lock()
+	s.stall = "RETR"
+	s.mu.Unlock()
+	e := s.Executor()
+	e.SearchSubject = "Order"
+
+	// The connection is established, the deadline of ctx bounds the
+	// commands as well.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := e.getMail(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error while retrieving message 1")
+	require.Contains(t, err.Error(), "i/o timeout")
+	require.Less(t, time.Since(start), 5*time.Second)
+}
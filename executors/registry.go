@@ -11,6 +11,7 @@ import (
 	"github.com/ovh/venom/executors/kafka"
 	"github.com/ovh/venom/executors/mqtt"
 	"github.com/ovh/venom/executors/ovhapi"
+	"github.com/ovh/venom/executors/pop3"
 	"github.com/ovh/venom/executors/rabbitmq"
 	"github.com/ovh/venom/executors/readfile"
 	"github.com/ovh/venom/executors/redis"
@@ -33,6 +34,7 @@ var Registry map[string]Constructor = map[string]Constructor{
 	kafka.Name:      kafka.New,
 	mqtt.Name:       mqtt.New,
 	ovhapi.Name:     ovhapi.New,
+	pop3.Name:       pop3.New,
 	rabbitmq.Name:   rabbitmq.New,
 	readfile.Name:   readfile.New,
 	redis.Name:      redis.New,